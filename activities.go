@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+)
+
+// launchFailureWatcher surfaces the failed launches of the ASGs of a component while we wait for its
+// replacement instances, rather than noticing only when the wait times out.
+type launchFailureWatcher struct {
+	awsClient   *awsClient
+	component   string
+	journal     *asgJournal
+	asgs        []string
+	since       time.Time
+	policy      string
+	maxFailures int
+	failures    int
+	seen        map[string]bool
+}
+
+// Watches the given ASG, or all the ASGs of the component when it is empty, for launches failed since the
+// given time
+func newLaunchFailureWatcher(awsClient *awsClient, myComponent *componentType, asg string, since time.Time) (*launchFailureWatcher, error) {
+	policy, maxFailures, err := getLaunchFailurePolicy(myComponent.name)
+	if err != nil {
+		return nil, err
+	}
+
+	asgs := myComponent.asgs
+	if asg != "" {
+		asgs = []string{asg}
+	}
+	return &launchFailureWatcher{
+		awsClient:   awsClient,
+		component:   myComponent.name,
+		journal:     myComponent.journal,
+		asgs:        asgs,
+		since:       since,
+		policy:      policy,
+		maxFailures: maxFailures,
+		seen:        make(map[string]bool),
+	}, nil
+}
+
+// Reports the launches which failed since the last check. Returns an error when the roll should stop: on
+// the first failure with the fail policy, or once too many launches failed with the retry policy. In the
+// latter case the ASG is steered away from what made the launch fail before it retries.
+func (w *launchFailureWatcher) check() error {
+	for _, asg := range w.asgs {
+		activities, err := w.awsClient.autoscaling.getFailedLaunches(asg, w.since)
+		if err != nil {
+			glog.Errorf("an error occurred describing the scaling activities of ASG %s.\nError %s", asg, err)
+			continue
+		}
+
+		for _, activity := range activities {
+			activityID := aws.StringValue(activity.ActivityId)
+			if w.seen[activityID] {
+				continue
+			}
+			w.seen[activityID] = true
+			w.failures++
+
+			msg := fmt.Sprintf("A launch of ASG %s for component %s on cluster %s failed: %s", asg, w.component,
+				kubernetesCluster, aws.StringValue(activity.StatusMessage))
+			glog.Error(msg)
+			if err := postSlackMessage(msg); err != nil {
+				glog.Errorf("an error occurred posting to slack.\nError %s", err)
+			}
+
+			if w.policy == launchFailurePolicyFail {
+				return fmt.Errorf("launch failed in ASG %s: %s", asg, aws.StringValue(activity.StatusMessage))
+			}
+			if w.failures > w.maxFailures {
+				return fmt.Errorf("%d launches failed for component %s, the last one in ASG %s: %s", w.failures, w.component,
+					asg, aws.StringValue(activity.StatusMessage))
+			}
+			if err := w.avoid(asg, activity); err != nil {
+				glog.Errorf("an error occurred steering ASG %s away from the failed launch, it retries as is.\nError %s", asg, err)
+			}
+			glog.Infof("Waiting for ASG %s to retry the launch (%d/%d failures)", asg, w.failures, w.maxFailures)
+		}
+	}
+	return nil
+}
+
+// Steers the next launches of the ASG away from a failed one: out of the subnet it failed in when the ASG has
+// other subnets, or else off the instance type named in the failure when the ASG has other instance types.
+// The changes are recorded in the journal of the component, and reversed with the others at the end of the roll.
+func (w *launchFailureWatcher) avoid(asg string, activity *autoscaling.Activity) error {
+	if w.journal == nil {
+		return nil
+	}
+	group, err := w.awsClient.autoscaling.getASG(asg)
+	if err != nil {
+		return err
+	}
+
+	// The details of a launch activity look like {"Subnet ID":"subnet-1234","Availability Zone":"us-east-1a"}
+	var details map[string]interface{}
+	if err := json.Unmarshal([]byte(aws.StringValue(activity.Details)), &details); err == nil {
+		subnet, _ := details["Subnet ID"].(string)
+		subnets := strings.Split(aws.StringValue(group.VPCZoneIdentifier), ",")
+		if subnet != "" && len(subnets) > 1 && containsString(subnets, subnet) {
+			glog.Infof("Removing subnet %s from ASG %s for the rest of the roll", subnet, asg)
+			return w.journal.setSubnets(w.awsClient, asg, strings.Join(removeString(subnets, subnet), ","))
+		}
+	}
+
+	if group.MixedInstancesPolicy != nil && group.MixedInstancesPolicy.LaunchTemplate != nil {
+		message := " " + aws.StringValue(activity.StatusMessage) + " "
+		overrides := group.MixedInstancesPolicy.LaunchTemplate.Overrides
+		var kept []*autoscaling.LaunchTemplateOverrides
+		for _, override := range overrides {
+			if !strings.Contains(message, " "+aws.StringValue(override.InstanceType)+" ") {
+				kept = append(kept, override)
+			}
+		}
+		if len(kept) > 0 && len(kept) < len(overrides) {
+			glog.Infof("Removing %d instance types from ASG %s for the rest of the roll", len(overrides)-len(kept), asg)
+			return w.journal.setInstanceTypeOverrides(w.awsClient, asg, kept)
+		}
+	}
+
+	glog.Infof("ASG %s has no other subnet or instance type to fall back to", asg)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func fakeFailedLaunch(activityID string, start time.Time) *autoscaling.Activity {
+	return &autoscaling.Activity{
+		ActivityId:    aws.String(activityID),
+		Description:   aws.String("Launching a new EC2 instance.  Status Reason: InsufficientInstanceCapacity"),
+		StatusCode:    aws.String("Failed"),
+		StatusMessage: aws.String("We currently do not have sufficient m5.large capacity in the Availability Zone you requested"),
+		StartTime:     aws.Time(start),
+	}
+}
+
+func TestLaunchFailureWatcherFail(t *testing.T) {
+	os.Setenv("ROLLER_LAUNCH_FAILURE_POLICY", "fail")
+	defer os.Unsetenv("ROLLER_LAUNCH_FAILURE_POLICY")
+
+	start := time.Now()
+	fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{}
+
+	myComponent := &componentType{name: "k8s-node", asgs: []string{"infra-k8s-worker"}}
+	watcher, err := newLaunchFailureWatcher(newFakeAwsClient(), myComponent, "", start)
+	if err != nil {
+		t.Errorf("got error when creating the watcher: %s", err)
+	}
+	if err = watcher.check(); err != nil {
+		t.Errorf("got error without failed launches: %s", err)
+	}
+
+	fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{
+		Activities: []*autoscaling.Activity{fakeFailedLaunch("failed-launch", start.Add(time.Second))},
+	}
+	if err = watcher.check(); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestLaunchFailureWatcherRetry(t *testing.T) {
+	os.Setenv("ROLLER_LAUNCH_FAILURE_POLICY", "retry")
+	os.Setenv("ROLLER_LAUNCH_FAILURE_RETRIES", "1")
+	defer os.Unsetenv("ROLLER_LAUNCH_FAILURE_POLICY")
+	defer os.Unsetenv("ROLLER_LAUNCH_FAILURE_RETRIES")
+
+	start := time.Now()
+	fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{
+		Activities: []*autoscaling.Activity{fakeFailedLaunch("failed-launch", start.Add(time.Second))},
+	}
+
+	myComponent := &componentType{name: "k8s-node"}
+	watcher, err := newLaunchFailureWatcher(newFakeAwsClient(), myComponent, "infra-k8s-worker", start)
+	if err != nil {
+		t.Errorf("got error when creating the watcher: %s", err)
+	}
+	if err = watcher.check(); err != nil {
+		t.Errorf("expected the first failed launch to be retried, got %s", err)
+	}
+	// The same activity is only counted once
+	if err = watcher.check(); err != nil {
+		t.Errorf("expected the first failed launch to be retried, got %s", err)
+	}
+
+	fakeDescribeScalingActivitiesOutput.Activities = append([]*autoscaling.Activity{
+		fakeFailedLaunch("second-failed-launch", start.Add(2*time.Second)),
+	}, fakeDescribeScalingActivitiesOutput.Activities...)
+	if err = watcher.check(); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestLaunchFailureWatcherAvoidsFailedLaunches(t *testing.T) {
+	asg := "infra-k8s-worker"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String(asg),
+				VPCZoneIdentifier:    aws.String("subnet-a,subnet-b"),
+				MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+					LaunchTemplate: &autoscaling.LaunchTemplate{
+						LaunchTemplateSpecification: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("worker")},
+						Overrides: []*autoscaling.LaunchTemplateOverrides{
+							{InstanceType: aws.String("m5.large")},
+							{InstanceType: aws.String("m5a.large")},
+						},
+					},
+				},
+			},
+		},
+	}
+	defer func() { fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{} }()
+
+	start := time.Now()
+	failed := fakeFailedLaunch("failed-launch", start.Add(time.Second))
+	failed.Details = aws.String(`{"Subnet ID":"subnet-a","Availability Zone":"us-east-1a"}`)
+	fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{
+		Activities: []*autoscaling.Activity{failed},
+	}
+
+	// Retrying is the default
+	awsClient := newFakeAwsClient()
+	myComponent := &componentType{name: "k8s-node", journal: newASGJournal()}
+	watcher, err := newLaunchFailureWatcher(awsClient, myComponent, asg, start)
+	if err != nil {
+		t.Errorf("got error when creating the watcher: %s", err)
+	}
+	if err = watcher.check(); err != nil {
+		t.Errorf("expected the failed launch to be retried, got %s", err)
+	}
+	group := fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups[0]
+	if subnets := aws.StringValue(group.VPCZoneIdentifier); subnets != "subnet-b" {
+		t.Errorf("expected the failing subnet to be removed, got %s", subnets)
+	}
+
+	// Once the ASG has a single subnet left, the failing instance type goes instead
+	failed = fakeFailedLaunch("second-failed-launch", start.Add(2*time.Second))
+	failed.Details = aws.String(`{"Subnet ID":"subnet-b","Availability Zone":"us-east-1b"}`)
+	fakeDescribeScalingActivitiesOutput.Activities = append([]*autoscaling.Activity{failed}, fakeDescribeScalingActivitiesOutput.Activities...)
+	if err = watcher.check(); err != nil {
+		t.Errorf("expected the failed launch to be retried, got %s", err)
+	}
+	overrides := group.MixedInstancesPolicy.LaunchTemplate.Overrides
+	if len(overrides) != 1 || aws.StringValue(overrides[0].InstanceType) != "m5a.large" {
+		t.Errorf("expected only m5a.large to be left, got %s", overrides)
+	}
+	if aws.StringValue(group.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification.LaunchTemplateName) != "worker" {
+		t.Errorf("expected the launch template to be kept, got %s", group.MixedInstancesPolicy.LaunchTemplate)
+	}
+
+	restoreASGs(awsClient, myComponent)
+	if subnets := aws.StringValue(group.VPCZoneIdentifier); subnets != "subnet-a,subnet-b" {
+		t.Errorf("expected the subnets to be restored, got %s", subnets)
+	}
+	if overrides := group.MixedInstancesPolicy.LaunchTemplate.Overrides; len(overrides) != 2 {
+		t.Errorf("expected the instance types to be restored, got %s", overrides)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -13,6 +15,16 @@ type awsAutoscaling interface {
 	resumeProcesses(*autoscaling.ScalingProcessQuery) (string, error)
 	setDesiredCount(*autoscaling.SetDesiredCapacityInput) (string, error)
 	describeAutoscalingGroups(*autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+	startInstanceRefresh(*autoscaling.StartInstanceRefreshInput) (*autoscaling.StartInstanceRefreshOutput, error)
+	describeInstanceRefreshes(*autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error)
+	cancelInstanceRefresh(*autoscaling.CancelInstanceRefreshInput) (string, error)
+	putLifecycleHook(*autoscaling.PutLifecycleHookInput) (string, error)
+	deleteLifecycleHook(*autoscaling.DeleteLifecycleHookInput) (string, error)
+	completeLifecycleAction(*autoscaling.CompleteLifecycleActionInput) (string, error)
+	terminateInstanceInAutoScalingGroup(*autoscaling.TerminateInstanceInAutoScalingGroupInput) (string, error)
+	describeLaunchConfigurations(*autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error)
+	updateAutoScalingGroup(*autoscaling.UpdateAutoScalingGroupInput) (string, error)
+	describeScalingActivities(*autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error)
 }
 
 type awsAutoscalingClient struct {
@@ -23,9 +35,9 @@ type awsAutoscalingController struct {
 	client awsAutoscaling
 }
 
-func newAWSAutoscalingClient() awsAutoscaling {
+func newAWSAutoscalingClient(sess *session.Session) awsAutoscaling {
 	return &awsAutoscalingClient{
-		session: autoscaling.New(session.New()),
+		session: autoscaling.New(sess),
 	}
 }
 
@@ -57,6 +69,58 @@ func (autoScalingClient *awsAutoscalingClient) describeAutoscalingGroups(autosca
 	return autoScalingClient.session.DescribeAutoScalingGroups(autoscalingGroupInput)
 }
 
+func (autoScalingClient *awsAutoscalingClient) startInstanceRefresh(params *autoscaling.StartInstanceRefreshInput) (*autoscaling.StartInstanceRefreshOutput, error) {
+	return autoScalingClient.session.StartInstanceRefresh(params)
+}
+
+func (autoScalingClient *awsAutoscalingClient) describeInstanceRefreshes(params *autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error) {
+	return autoScalingClient.session.DescribeInstanceRefreshes(params)
+}
+
+func (autoScalingClient *awsAutoscalingClient) cancelInstanceRefresh(params *autoscaling.CancelInstanceRefreshInput) (string, error) {
+	var response *autoscaling.CancelInstanceRefreshOutput
+	response, err := autoScalingClient.session.CancelInstanceRefresh(params)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) putLifecycleHook(params *autoscaling.PutLifecycleHookInput) (string, error) {
+	var response *autoscaling.PutLifecycleHookOutput
+	response, err := autoScalingClient.session.PutLifecycleHook(params)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) deleteLifecycleHook(params *autoscaling.DeleteLifecycleHookInput) (string, error) {
+	var response *autoscaling.DeleteLifecycleHookOutput
+	response, err := autoScalingClient.session.DeleteLifecycleHook(params)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) completeLifecycleAction(params *autoscaling.CompleteLifecycleActionInput) (string, error) {
+	var response *autoscaling.CompleteLifecycleActionOutput
+	response, err := autoScalingClient.session.CompleteLifecycleAction(params)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) terminateInstanceInAutoScalingGroup(params *autoscaling.TerminateInstanceInAutoScalingGroupInput) (string, error) {
+	var response *autoscaling.TerminateInstanceInAutoScalingGroupOutput
+	response, err := autoScalingClient.session.TerminateInstanceInAutoScalingGroup(params)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) describeLaunchConfigurations(params *autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	return autoScalingClient.session.DescribeLaunchConfigurations(params)
+}
+
+func (autoScalingClient *awsAutoscalingClient) updateAutoScalingGroup(params *autoscaling.UpdateAutoScalingGroupInput) (string, error) {
+	var response *autoscaling.UpdateAutoScalingGroupOutput
+	response, err := autoScalingClient.session.UpdateAutoScalingGroup(params)
+	return response.String(), err
+}
+
+func (autoScalingClient *awsAutoscalingClient) describeScalingActivities(params *autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	return autoScalingClient.session.DescribeScalingActivities(params)
+}
+
 func (c *awsAutoscalingController) manageASGProcesses(asg string, scalingProcesses []*string, action string) (string, error) {
 	var err error
 	var response string
@@ -101,6 +165,52 @@ func (c *awsAutoscalingController) getDesiredCount(asg string) (int64, error) {
 	return -1, fmt.Errorf("Could not find desired count for ASG %s", asg)
 }
 
+func (c *awsAutoscalingController) getMaxSize(asg string) (int64, error) {
+	autoscalingGroupInput := &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{
+			&asg,
+		},
+	}
+	autoscalingGroupOutput, err := c.client.describeAutoscalingGroups(autoscalingGroupInput)
+	if err != nil {
+		return -1, err
+	}
+	for _, autoscalingGroup := range autoscalingGroupOutput.AutoScalingGroups {
+		if *autoscalingGroup.AutoScalingGroupName == asg {
+			return *autoscalingGroup.MaxSize, nil
+		}
+	}
+	return -1, fmt.Errorf("Could not find max size for ASG %s", asg)
+}
+
+func (c *awsAutoscalingController) setMaxSize(asg string, maxSize int64) (string, error) {
+	params := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(asg),
+		MaxSize:              aws.Int64(maxSize),
+	}
+	return c.client.updateAutoScalingGroup(params)
+}
+
+// Sets the subnets the ASG launches instances in, as a comma-separated list
+func (c *awsAutoscalingController) setSubnets(asg string, subnets string) (string, error) {
+	params := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(asg),
+		VPCZoneIdentifier:    aws.String(subnets),
+	}
+	return c.client.updateAutoScalingGroup(params)
+}
+
+// Sets the launch template and instance type overrides of the mixed instances policy of the ASG
+func (c *awsAutoscalingController) setMixedInstancesLaunchTemplate(asg string, launchTemplate *autoscaling.LaunchTemplate) (string, error) {
+	params := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(asg),
+		MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+			LaunchTemplate: launchTemplate,
+		},
+	}
+	return c.client.updateAutoScalingGroup(params)
+}
+
 func (c *awsAutoscalingController) getInstanceCount(asg string) (int, error) {
 	var instances []string
 	autoscalingGroupInput := &autoscaling.DescribeAutoScalingGroupsInput{
@@ -121,3 +231,182 @@ func (c *awsAutoscalingController) getInstanceCount(asg string) (int, error) {
 	}
 	return len(instances), nil
 }
+
+// Returns the IDs of the instances of the ASG in the given lifecycle state, such as Terminating:Wait
+func (c *awsAutoscalingController) getInstancesInLifecycleState(asg string, lifecycleState string) ([]string, error) {
+	var instances []string
+	autoscalingGroupInput := &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{
+			&asg,
+		},
+	}
+	autoscalingGroupOutput, err := c.client.describeAutoscalingGroups(autoscalingGroupInput)
+	if err != nil {
+		return instances, err
+	}
+	for _, autoscalingGroup := range autoscalingGroupOutput.AutoScalingGroups {
+		if *autoscalingGroup.AutoScalingGroupName == asg {
+			for _, instance := range autoscalingGroup.Instances {
+				if aws.StringValue(instance.LifecycleState) == lifecycleState {
+					instances = append(instances, *instance.InstanceId)
+				}
+			}
+		}
+	}
+	return instances, nil
+}
+
+func (c *awsAutoscalingController) startInstanceRefresh(asg string, minHealthyPercentage int64, instanceWarmup int64, checkpoints []int64, checkpointDelay int64) (string, error) {
+	preferences := &autoscaling.RefreshPreferences{
+		MinHealthyPercentage: aws.Int64(minHealthyPercentage),
+	}
+	if instanceWarmup > 0 {
+		preferences.InstanceWarmup = aws.Int64(instanceWarmup)
+	}
+	if len(checkpoints) > 0 {
+		preferences.CheckpointPercentages = aws.Int64Slice(checkpoints)
+		preferences.CheckpointDelay = aws.Int64(checkpointDelay)
+	}
+	params := &autoscaling.StartInstanceRefreshInput{
+		AutoScalingGroupName: aws.String(asg),
+		Preferences:          preferences,
+		Strategy:             aws.String("Rolling"),
+	}
+	response, err := c.client.startInstanceRefresh(params)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(response.InstanceRefreshId), nil
+}
+
+func (c *awsAutoscalingController) getInstanceRefresh(asg string, instanceRefreshID string) (*autoscaling.InstanceRefresh, error) {
+	params := &autoscaling.DescribeInstanceRefreshesInput{
+		AutoScalingGroupName: aws.String(asg),
+		InstanceRefreshIds: []*string{
+			aws.String(instanceRefreshID),
+		},
+	}
+	response, err := c.client.describeInstanceRefreshes(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, instanceRefresh := range response.InstanceRefreshes {
+		if aws.StringValue(instanceRefresh.InstanceRefreshId) == instanceRefreshID {
+			return instanceRefresh, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find instance refresh %s for ASG %s", instanceRefreshID, asg)
+}
+
+func (c *awsAutoscalingController) cancelInstanceRefresh(asg string) (string, error) {
+	params := &autoscaling.CancelInstanceRefreshInput{
+		AutoScalingGroupName: aws.String(asg),
+	}
+	return c.client.cancelInstanceRefresh(params)
+}
+
+func (c *awsAutoscalingController) putLifecycleHook(asg string, hookName string, transition string, heartbeatTimeout int64, defaultResult string) (string, error) {
+	params := &autoscaling.PutLifecycleHookInput{
+		AutoScalingGroupName: aws.String(asg),
+		LifecycleHookName:    aws.String(hookName),
+		LifecycleTransition:  aws.String(transition),
+		HeartbeatTimeout:     aws.Int64(heartbeatTimeout),
+		DefaultResult:        aws.String(defaultResult),
+	}
+	return c.client.putLifecycleHook(params)
+}
+
+func (c *awsAutoscalingController) deleteLifecycleHook(asg string, hookName string) (string, error) {
+	params := &autoscaling.DeleteLifecycleHookInput{
+		AutoScalingGroupName: aws.String(asg),
+		LifecycleHookName:    aws.String(hookName),
+	}
+	return c.client.deleteLifecycleHook(params)
+}
+
+func (c *awsAutoscalingController) completeLifecycleAction(asg string, hookName string, instanceID string, result string) (string, error) {
+	params := &autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(asg),
+		LifecycleHookName:     aws.String(hookName),
+		InstanceId:            aws.String(instanceID),
+		LifecycleActionResult: aws.String(result),
+	}
+	return c.client.completeLifecycleAction(params)
+}
+
+// Terminates an instance through its ASG, so that lifecycle hooks apply to it
+func (c *awsAutoscalingController) terminateInstanceInASG(instanceID string, decrementDesiredCapacity bool) (string, error) {
+	params := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(instanceID),
+		ShouldDecrementDesiredCapacity: aws.Bool(decrementDesiredCapacity),
+	}
+	return c.client.terminateInstanceInAutoScalingGroup(params)
+}
+
+func (c *awsAutoscalingController) getASG(asg string) (*autoscaling.Group, error) {
+	autoscalingGroupInput := &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{
+			&asg,
+		},
+	}
+	autoscalingGroupOutput, err := c.client.describeAutoscalingGroups(autoscalingGroupInput)
+	if err != nil {
+		return nil, err
+	}
+	for _, autoscalingGroup := range autoscalingGroupOutput.AutoScalingGroups {
+		if *autoscalingGroup.AutoScalingGroupName == asg {
+			return autoscalingGroup, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find ASG %s", asg)
+}
+
+func (c *awsAutoscalingController) getLaunchConfiguration(name string) (*autoscaling.LaunchConfiguration, error) {
+	params := &autoscaling.DescribeLaunchConfigurationsInput{
+		LaunchConfigurationNames: []*string{
+			aws.String(name),
+		},
+	}
+	response, err := c.client.describeLaunchConfigurations(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, launchConfiguration := range response.LaunchConfigurations {
+		if aws.StringValue(launchConfiguration.LaunchConfigurationName) == name {
+			return launchConfiguration, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find launch configuration %s", name)
+}
+
+// Returns the launches of the ASG which failed or were cancelled since the given time. Activities are
+// returned newest first, so we stop paging once we reach older ones.
+func (c *awsAutoscalingController) getFailedLaunches(asg string, since time.Time) ([]*autoscaling.Activity, error) {
+	var failed []*autoscaling.Activity
+	params := &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(asg),
+	}
+
+	for {
+		response, err := c.client.describeScalingActivities(params)
+		if err != nil {
+			return failed, err
+		}
+		for _, activity := range response.Activities {
+			if aws.TimeValue(activity.StartTime).Before(since) {
+				return failed, nil
+			}
+			status := aws.StringValue(activity.StatusCode)
+			if status != autoscaling.ScalingActivityStatusCodeFailed && status != autoscaling.ScalingActivityStatusCodeCancelled {
+				continue
+			}
+			if strings.HasPrefix(aws.StringValue(activity.Description), "Launching") {
+				failed = append(failed, activity)
+			}
+		}
+		if aws.StringValue(response.NextToken) == "" {
+			return failed, nil
+		}
+		params.NextToken = response.NextToken
+	}
+}
@@ -1,14 +1,42 @@
 package main
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 var fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{}
 
+var fakeDescribeInstanceRefreshesOutput = &autoscaling.DescribeInstanceRefreshesOutput{}
+
+// When set, the successive states of the instance refreshes being described,
+// the last one being repeated
+var fakeInstanceRefreshes []*autoscaling.InstanceRefresh
+
+var fakeStartedInstanceRefreshes []*autoscaling.StartInstanceRefreshInput
+
+var fakeCancelledInstanceRefreshes []*autoscaling.CancelInstanceRefreshInput
+
+var fakeCompletedLifecycleActions []*autoscaling.CompleteLifecycleActionInput
+
+var fakeDescribeLaunchConfigurationsOutput = &autoscaling.DescribeLaunchConfigurationsOutput{}
+
+var fakeUpdatedAutoScalingGroups []*autoscaling.UpdateAutoScalingGroupInput
+
+var fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{}
+
+var fakeTerminatedInstances []*autoscaling.TerminateInstanceInAutoScalingGroupInput
+
+var fakeSetDesiredCounts []*autoscaling.SetDesiredCapacityInput
+
+// The lifecycle hooks currently registered, by ASG and hook name
+var fakeLifecycleHooks = make(map[string]*autoscaling.PutLifecycleHookInput)
+
 type FakeAwsAutoscalingClient struct{}
 
 func newFakeAWSAutoscalingClient() awsAutoscaling {
@@ -24,13 +52,143 @@ func (autoScalingClient *FakeAwsAutoscalingClient) resumeProcesses(params *autos
 }
 
 func (autoScalingClient *FakeAwsAutoscalingClient) setDesiredCount(input *autoscaling.SetDesiredCapacityInput) (string, error) {
+	fakeSetDesiredCounts = append(fakeSetDesiredCounts, input)
+	for _, group := range fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups {
+		if *group.AutoScalingGroupName == *input.AutoScalingGroupName {
+			group.DesiredCapacity = input.DesiredCapacity
+			if fakeEc2Instances != nil {
+				fakeLaunchInstances(group)
+			}
+		}
+	}
 	return "{}", nil
 }
 
+// Launches healthy instances in the ASG until it reaches its desired count, the
+// way it would when its Launch process isn't suspended. The new instances get
+// the tags of the existing instances of the ASG but their version.
+func fakeLaunchInstances(group *autoscaling.Group) {
+	asg := aws.StringValue(group.AutoScalingGroupName)
+	newTags := []*ec2.Tag{
+		{Key: aws.String(tags.healthKey), Value: aws.String(tags.healthyValue)},
+	}
+	for _, instance := range fakeEc2Instances {
+		if fakeHasTag(instance, tags.asgKey, asg) {
+			for _, tag := range instance.Tags {
+				if key := aws.StringValue(tag.Key); key != tags.versionKey && key != tags.healthKey {
+					newTags = append(newTags, tag)
+				}
+			}
+			break
+		}
+	}
+
+	for int64(len(group.Instances)) < aws.Int64Value(group.DesiredCapacity) {
+		instanceID := fmt.Sprintf("i-%s-new-%d", asg, len(fakeEc2Instances))
+		group.Instances = append(group.Instances, &autoscaling.Instance{InstanceId: aws.String(instanceID)})
+		fakeEc2Instances = append(fakeEc2Instances, &ec2.Instance{
+			InstanceId: aws.String(instanceID),
+			LaunchTime: aws.Time(time.Now().Add(time.Second)),
+			Tags:       newTags,
+		})
+	}
+}
+
+// Removes a terminated instance from its ASG and from EC2
+func fakeRemoveInstance(instanceID string) {
+	for _, group := range fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups {
+		for i, instance := range group.Instances {
+			if aws.StringValue(instance.InstanceId) == instanceID {
+				group.Instances = append(group.Instances[:i], group.Instances[i+1:]...)
+				break
+			}
+		}
+	}
+	for i, instance := range fakeEc2Instances {
+		if aws.StringValue(instance.InstanceId) == instanceID {
+			fakeEc2Instances = append(fakeEc2Instances[:i], fakeEc2Instances[i+1:]...)
+			break
+		}
+	}
+}
+
 func (autoScalingClient *FakeAwsAutoscalingClient) describeAutoscalingGroups(autoscalingInstanceInput *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 	return fakeDescribeAutoScalingGroupsOutput, nil
 }
 
+func (autoScalingClient *FakeAwsAutoscalingClient) startInstanceRefresh(input *autoscaling.StartInstanceRefreshInput) (*autoscaling.StartInstanceRefreshOutput, error) {
+	fakeStartedInstanceRefreshes = append(fakeStartedInstanceRefreshes, input)
+	return &autoscaling.StartInstanceRefreshOutput{
+		InstanceRefreshId: aws.String("fake-instance-refresh-id"),
+	}, nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) describeInstanceRefreshes(input *autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error) {
+	if len(fakeInstanceRefreshes) == 0 {
+		return fakeDescribeInstanceRefreshesOutput, nil
+	}
+	instanceRefresh := fakeInstanceRefreshes[0]
+	if len(fakeInstanceRefreshes) > 1 {
+		fakeInstanceRefreshes = fakeInstanceRefreshes[1:]
+	}
+	instanceRefresh.InstanceRefreshId = input.InstanceRefreshIds[0]
+	return &autoscaling.DescribeInstanceRefreshesOutput{
+		InstanceRefreshes: []*autoscaling.InstanceRefresh{instanceRefresh},
+	}, nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) cancelInstanceRefresh(input *autoscaling.CancelInstanceRefreshInput) (string, error) {
+	fakeCancelledInstanceRefreshes = append(fakeCancelledInstanceRefreshes, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) putLifecycleHook(input *autoscaling.PutLifecycleHookInput) (string, error) {
+	fakeLifecycleHooks[*input.AutoScalingGroupName+"/"+*input.LifecycleHookName] = input
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) deleteLifecycleHook(input *autoscaling.DeleteLifecycleHookInput) (string, error) {
+	delete(fakeLifecycleHooks, *input.AutoScalingGroupName+"/"+*input.LifecycleHookName)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) completeLifecycleAction(input *autoscaling.CompleteLifecycleActionInput) (string, error) {
+	fakeCompletedLifecycleActions = append(fakeCompletedLifecycleActions, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) terminateInstanceInAutoScalingGroup(input *autoscaling.TerminateInstanceInAutoScalingGroupInput) (string, error) {
+	fakeTerminatedInstances = append(fakeTerminatedInstances, input)
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) describeLaunchConfigurations(input *autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	return fakeDescribeLaunchConfigurationsOutput, nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) updateAutoScalingGroup(input *autoscaling.UpdateAutoScalingGroupInput) (string, error) {
+	fakeUpdatedAutoScalingGroups = append(fakeUpdatedAutoScalingGroups, input)
+	for _, group := range fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups {
+		if *group.AutoScalingGroupName != *input.AutoScalingGroupName {
+			continue
+		}
+		if input.MaxSize != nil {
+			group.MaxSize = input.MaxSize
+		}
+		if input.VPCZoneIdentifier != nil {
+			group.VPCZoneIdentifier = input.VPCZoneIdentifier
+		}
+		if input.MixedInstancesPolicy != nil {
+			group.MixedInstancesPolicy = input.MixedInstancesPolicy
+		}
+	}
+	return "{}", nil
+}
+
+func (autoScalingClient *FakeAwsAutoscalingClient) describeScalingActivities(input *autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	return fakeDescribeScalingActivitiesOutput, nil
+}
+
 func TestAwsManageASGProcessesSuspend(t *testing.T) {
 	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
 	scalingProcesses := []*string{
@@ -84,6 +242,27 @@ func TestAwsGetDesiredCount(t *testing.T) {
 	}
 }
 
+func TestAwsGetMaxSize(t *testing.T) {
+	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
+	asgName := "infra-k8s-worker"
+	maxSize := int64(12)
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: &asgName,
+				MaxSize:              &maxSize,
+			},
+		},
+	}
+	size, err := awsAutoscalingController.getMaxSize(asgName)
+	if err != nil {
+		t.Errorf("got error when attempting to get max size for an ASG: %s", err)
+	}
+	if size != 12 {
+		t.Errorf("got wrong max size for an ASG: expected 12, got %d", size)
+	}
+}
+
 func TestAwsGetInstanceCount(t *testing.T) {
 	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
 	asgName := "infra-k8s-worker"
@@ -110,3 +289,113 @@ func TestAwsGetInstanceCount(t *testing.T) {
 		t.Errorf("got wrong count when attempting to get instance count for an ASG: expected 1, got %d", count)
 	}
 }
+
+func TestAwsGetInstancesInLifecycleState(t *testing.T) {
+	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
+	asgName := "infra-k8s-worker"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: &asgName,
+				Instances: []*autoscaling.Instance{
+					{
+						InstanceId:     aws.String("i-in-service"),
+						LifecycleState: aws.String("InService"),
+					},
+					{
+						InstanceId:     aws.String("i-terminating"),
+						LifecycleState: aws.String("Terminating:Wait"),
+					},
+				},
+			},
+		},
+	}
+	instances, err := awsAutoscalingController.getInstancesInLifecycleState(asgName, "Terminating:Wait")
+	if err != nil {
+		t.Errorf("got error when attempting to get instances in lifecycle state: %s", err)
+	}
+	if len(instances) != 1 || instances[0] != "i-terminating" {
+		t.Errorf("expected only i-terminating, got %s", instances)
+	}
+}
+
+func TestAwsStartAndGetInstanceRefresh(t *testing.T) {
+	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
+	asgName := "infra-k8s-worker"
+	id, err := awsAutoscalingController.startInstanceRefresh(asgName, 90, 300, []int64{50, 100}, 600)
+	if err != nil {
+		t.Errorf("got error when attempting to start an instance refresh: %s", err)
+	}
+	if id != "fake-instance-refresh-id" {
+		t.Errorf("expected fake-instance-refresh-id, got %s", id)
+	}
+
+	fakeDescribeInstanceRefreshesOutput = &autoscaling.DescribeInstanceRefreshesOutput{
+		InstanceRefreshes: []*autoscaling.InstanceRefresh{
+			{
+				InstanceRefreshId: aws.String(id),
+				Status:            aws.String("InProgress"),
+			},
+		},
+	}
+	instanceRefresh, err := awsAutoscalingController.getInstanceRefresh(asgName, id)
+	if err != nil {
+		t.Errorf("got error when attempting to describe an instance refresh: %s", err)
+	}
+	if aws.StringValue(instanceRefresh.Status) != "InProgress" {
+		t.Errorf("expected InProgress, got %s", aws.StringValue(instanceRefresh.Status))
+	}
+
+	_, err = awsAutoscalingController.getInstanceRefresh(asgName, "missing-id")
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestAwsTerminateInstanceInASG(t *testing.T) {
+	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
+	fakeTerminatedInstances = nil
+
+	_, err := awsAutoscalingController.terminateInstanceInASG("i-fake-instanceid", true)
+	if err != nil {
+		t.Errorf("got error when terminating instance: %s", err)
+	}
+	if len(fakeTerminatedInstances) != 1 || !*fakeTerminatedInstances[0].ShouldDecrementDesiredCapacity {
+		t.Errorf("expected i-fake-instanceid to be terminated with decrement, got %v", fakeTerminatedInstances)
+	}
+}
+
+func TestAwsGetFailedLaunches(t *testing.T) {
+	awsAutoscalingController := newAWSAutoscalingController(newFakeAWSAutoscalingClient())
+	now := time.Now()
+	fakeDescribeScalingActivitiesOutput = &autoscaling.DescribeScalingActivitiesOutput{
+		Activities: []*autoscaling.Activity{
+			{
+				ActivityId:  aws.String("failed-launch"),
+				Description: aws.String("Launching a new EC2 instance.  Status Reason: InsufficientInstanceCapacity"),
+				StatusCode:  aws.String("Failed"),
+				StartTime:   aws.Time(now),
+			},
+			{
+				ActivityId:  aws.String("launch"),
+				Description: aws.String("Launching a new EC2 instance: i-fake-instanceid"),
+				StatusCode:  aws.String("Successful"),
+				StartTime:   aws.Time(now.Add(-time.Minute)),
+			},
+			{
+				ActivityId:  aws.String("old-failed-launch"),
+				Description: aws.String("Launching a new EC2 instance.  Status Reason: InsufficientInstanceCapacity"),
+				StatusCode:  aws.String("Failed"),
+				StartTime:   aws.Time(now.Add(-time.Hour)),
+			},
+		},
+	}
+
+	failed, err := awsAutoscalingController.getFailedLaunches("infra-k8s-worker", now.Add(-10*time.Minute))
+	if err != nil {
+		t.Errorf("got error when getting failed launches: %s", err)
+	}
+	if len(failed) != 1 || *failed[0].ActivityId != "failed-launch" {
+		t.Errorf("expected only the recent failed launch, got %v", failed)
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
+import "github.com/aws/aws-sdk-go/aws/session"
+
 type awsClient struct {
-	ec2         *awsEc2Controller
-	autoscaling *awsAutoscalingController
+	ec2           *awsEc2Controller
+	autoscaling   *awsAutoscalingController
+	serviceQuotas *awsServiceQuotasController
 }
 
-func newAwsClient() *awsClient {
+// newAwsClient creates the controllers of all the AWS services, sharing a
+// single session and its credentials, and a single throttle for all their
+// APIs
+func newAwsClient(sess *session.Session, throttle *awsThrottle) *awsClient {
+	sess = throttledSession(sess)
 	awsClient := &awsClient{
-		ec2:         newAWSEc2Controller(newAWSEc2Client()),
-		autoscaling: newAWSAutoscalingController(newAWSAutoscalingClient()),
+		ec2:           newAWSEc2Controller(throttledEc2{client: newAWSEc2Client(sess), throttle: throttle}),
+		autoscaling:   newAWSAutoscalingController(throttledAutoscaling{client: newAWSAutoscalingClient(sess), throttle: throttle}),
+		serviceQuotas: newAWSServiceQuotasController(throttledServiceQuotas{client: newAWSServiceQuotasClient(sess), throttle: throttle}),
 	}
 	return awsClient
 }
@@ -1,13 +1,20 @@
 package main
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
 
 func TestAwsClient(t *testing.T) {
-	awsClient := newAwsClient()
+	awsClient := newAwsClient(session.New(), newAWSThrottle(10, 20, 8))
 	if awsClient.ec2 == nil {
 		t.Failed()
 	}
 	if awsClient.autoscaling == nil {
 		t.Failed()
 	}
+	if awsClient.serviceQuotas == nil {
+		t.Failed()
+	}
 }
@@ -14,6 +14,8 @@ type awsEc2 interface {
 	describeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
 	describeTags(*ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error)
 	terminateInstances(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+	describeLaunchTemplateVersions(*ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error)
+	describeSubnets(*ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error)
 }
 
 type awsEc2Client struct {
@@ -25,9 +27,9 @@ type awsEc2Controller struct {
 	filters []*ec2.Filter
 }
 
-func newAWSEc2Client() awsEc2 {
+func newAWSEc2Client(sess *session.Session) awsEc2 {
 	return &awsEc2Client{
-		session: ec2.New(session.New()),
+		session: ec2.New(sess),
 	}
 }
 
@@ -49,6 +51,14 @@ func (e awsEc2Client) terminateInstances(input *ec2.TerminateInstancesInput) (*e
 	return e.session.TerminateInstances(input)
 }
 
+func (e awsEc2Client) describeLaunchTemplateVersions(input *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	return e.session.DescribeLaunchTemplateVersions(input)
+}
+
+func (e awsEc2Client) describeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	return e.session.DescribeSubnets(input)
+}
+
 func (c *awsEc2Controller) describeInstances(request *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
 	// Instances are paged
 	results := []*ec2.Instance{}
@@ -90,41 +100,68 @@ func (c *awsEc2Controller) describeInstancesNotMatchingAnsibleVersion(request *e
 
 	// Apparently negative filters do not work with AWS so here we filter
 	// out the instances which do not match the desired ansible version
-	results, err = c.instancesNotMatchingTagValue("version", ansibleVersion, results)
+	results, err = c.instancesNotMatchingTagValue(tags.versionKey, ansibleVersion, results)
 
 	return results, err
 }
 
 func (c *awsEc2Controller) getInstanceHealth(instance string) (string, error) {
-	status := "Unset"
-	params := &ec2.DescribeTagsInput{
-		Filters: []*ec2.Filter{
-			{
-				Name: aws.String("tag:healthy"),
-				Values: []*string{
-					aws.String("*"),
-				},
-			},
-			{
-				Name: aws.String("resource-id"),
-				Values: []*string{
-					aws.String(instance),
+	health, err := c.getInstancesHealth([]string{instance})
+	return health[instance], err
+}
+
+// Returns the value of the health tag of each instance, or Unset, describing
+// the tags of up to 200 instances in a single call
+func (c *awsEc2Controller) getInstancesHealth(instances []string) (map[string]string, error) {
+	health := make(map[string]string)
+	for _, instance := range instances {
+		health[instance] = "Unset"
+	}
+
+	for start := 0; start < len(instances); start += 200 {
+		end := start + 200
+		if end > len(instances) {
+			end = len(instances)
+		}
+		params := &ec2.DescribeTagsInput{
+			Filters: []*ec2.Filter{
+				c.newEC2Filter("key", tags.healthKey),
+				{
+					Name:   aws.String("resource-id"),
+					Values: aws.StringSlice(instances[start:end]),
 				},
 			},
-		},
-	}
+		}
 
-	resp, err := c.client.describeTags(params)
-	if err != nil {
-		return status, err
+		// Tags are paged
+		for {
+			resp, err := c.client.describeTags(params)
+			if err != nil {
+				return health, err
+			}
+			for _, tag := range resp.Tags {
+				if *tag.Key == tags.healthKey {
+					health[*tag.ResourceId] = *tag.Value
+				}
+			}
+			if resp.NextToken == nil {
+				break
+			}
+			params.NextToken = resp.NextToken
+		}
 	}
+	return health, nil
+}
 
-	for _, tag := range resp.Tags {
-		if *tag.Key == "healthy" {
-			status = *tag.Value
+// Returns the instances of the component according to the tag schema
+func (c *awsEc2Controller) instancesOfComponent(component string, instances []*ec2.Instance) ([]*ec2.Instance, error) {
+	results := []*ec2.Instance{}
+	for _, instance := range instances {
+		if tags.isComponent(instance, component) {
+			results = append(results, instance)
 		}
 	}
-	return status, err
+	return results, nil
 }
 
 func (c *awsEc2Controller) instancesMatchingTagValue(tagName, tagValue string, instances []*ec2.Instance) ([]*ec2.Instance, error) {
@@ -157,6 +194,16 @@ func (c *awsEc2Controller) filtersInstancesByTagValue(tagName, tagValue string,
 	return results, nil
 }
 
+// Returns the value of the tag on the instance, or an empty string if it is not set
+func (c *awsEc2Controller) getTagValue(instance *ec2.Instance, tagName string) string {
+	for _, tag := range instance.Tags {
+		if *tag.Key == tagName {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
 func (c *awsEc2Controller) getUniqueTagValues(tagName string, instances []*ec2.Instance) ([]string, error) {
 	var results []string
 
@@ -223,7 +270,9 @@ func (c *awsEc2Controller) terminateInstance(instance string) (*ec2.TerminateIns
 	return resp, err
 }
 
-func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType, ansibleVersion string, count int, t time.Time) ([]string, error) {
+// Waits for count new instances of the component launched after t, in the given ASG unless it is empty.
+// watcher, if not nil, is checked for failed launches while we wait.
+func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType, asg string, ansibleVersion string, count int, t time.Time, watcher *launchFailureWatcher) ([]string, error) {
 	newInstances := make(map[string]struct{})
 	var err error
 
@@ -234,11 +283,15 @@ func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType,
 		var inv []*ec2.Instance
 
 		params := &ec2.DescribeInstancesInput{}
-		params.Filters = []*ec2.Filter{c.newEC2Filter("tag:ServiceComponent", myComponent.name)}
+		params.Filters = tags.componentFilters(myComponent.name)
+		if asg != "" {
+			params.Filters = append(params.Filters, tags.asgFilter(asg))
+		}
 
 		inv, err = c.describeInstancesNotMatchingAnsibleVersion(params, ansibleVersion)
 		if err != nil {
-			glog.Fatalf("An error occurred getting the EC2 inventory: %s.\n", err)
+			err = fmt.Errorf("an error occurred getting the EC2 inventory: %s", err)
+			break
 		}
 
 		var instanceList []string
@@ -248,6 +301,14 @@ func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType,
 
 		for _, e := range inv {
 			if e.LaunchTime.After(t) {
+				// A new spot instance interrupted before we got to it will be backfilled by the ASG
+				if c.isSpotInterrupted(e) {
+					if _, ok := newInstances[*e.InstanceId]; ok {
+						glog.Infof("New %s instance %s was interrupted, waiting for the ASG to backfill it\n", myComponent.name, *e.InstanceId)
+						delete(newInstances, *e.InstanceId)
+					}
+					continue
+				}
 				// Using a map with empty values gives us a set and/or a unique slice
 				newInstances[*e.InstanceId] = struct{}{}
 			}
@@ -257,7 +318,15 @@ func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType,
 			break
 		}
 
-		time.Sleep(time.Second * 30)
+		if watcher != nil {
+			if err = watcher.check(); err != nil {
+				break
+			}
+		}
+
+		if err = sleepUnlessAborted(time.Second * 30); err != nil {
+			break
+		}
 	}
 
 	// We want to return a slice here rather than a map with empty values
@@ -266,6 +335,11 @@ func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType,
 		replacementInstances = append(replacementInstances, instance)
 	}
 
+	if err != nil {
+		glog.Infof("Exiting find after an error for component %s: %s.\n", myComponent.name, err)
+		return replacementInstances, err
+	}
+
 	if len(replacementInstances) < count {
 		glog.Infof("Exiting find with an error for component %s.\n", myComponent.name)
 		return replacementInstances, fmt.Errorf("Found %d/%d replacement %s instances. Giving up",
@@ -276,19 +350,36 @@ func (c *awsEc2Controller) findReplacementInstances(myComponent *componentType,
 	return replacementInstances, err
 }
 
-func (c *awsEc2Controller) verifyReplacementInstances(myComponent *componentType, instances []string) ([]string, error) {
+// Waits for the instances to become healthy. Returns the instances which never did, and separately the spot
+// instances which were interrupted while we waited.
+func (c *awsEc2Controller) verifyReplacementInstances(myComponent *componentType, instances []string) ([]string, []string, error) {
 	var err error
 	var status string
+	var interrupted []string
 
 	for loop := 0; loop < 30; loop++ {
+		// Spot instances can be reclaimed while they boot, the ASG will backfill them
+		var reclaimed []string
+		reclaimed, err = c.interruptedSpotInstances(instances)
+		if err != nil {
+			return instances, interrupted, err
+		}
+		for _, instance := range reclaimed {
+			glog.Infof("Component %s instance %s was interrupted before becoming healthy\n", myComponent.name, instance)
+			instances = removeString(instances, instance)
+			interrupted = append(interrupted, instance)
+		}
+
+		var health map[string]string
+		health, err = c.getInstancesHealth(instances)
+		if err != nil {
+			return instances, interrupted, err
+		}
 		for i := len(instances) - 1; i >= 0; i-- {
 			instance := instances[i]
-			status, err = c.getInstanceHealth(instance)
-			if err != nil {
-				return instances, err
-			}
+			status = health[instance]
 			glog.Infof("Component %s instance %s current status is %s - %s \n", myComponent.name, instance, status, timeStamp())
-			if status == "True" {
+			if status == tags.healthyValue {
 				glog.Infof("Verification complete component %s instance %s is healthy\n", myComponent.name, instance)
 				// Remove instance from the slice so we don't check it again
 				instances = append(instances[:i], instances[i+1:]...)
@@ -299,16 +390,161 @@ func (c *awsEc2Controller) verifyReplacementInstances(myComponent *componentType
 		// If any instances are not yet healthy, keep checking
 		if len(instances) > 0 {
 			glog.Infof("Still waiting for the following %s instances to become healthy %s\n", myComponent.name, instances)
-			time.Sleep(time.Second * 30)
+			if err = sleepUnlessAborted(time.Second * 30); err != nil {
+				return instances, interrupted, err
+			}
 			continue
 		}
 		break
 	}
 
 	if len(instances) > 0 {
-		return instances, fmt.Errorf("Failed to verify %s instances %s", myComponent.name, instances)
+		return instances, interrupted, fmt.Errorf("Failed to verify %s instances %s", myComponent.name, instances)
 	}
 
 	glog.Infof("Verification complete component %s all instances are healthy\n", myComponent.name)
-	return instances, nil
+	return instances, interrupted, nil
+}
+
+// Returns a version of a launch template, known by its ID or its name. The version can be a number, $Latest
+// or $Default.
+func (c *awsEc2Controller) getLaunchTemplateVersion(launchTemplateID string, launchTemplateName string, version string) (*ec2.LaunchTemplateVersion, error) {
+	params := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: []*string{
+			aws.String(version),
+		},
+	}
+	if launchTemplateID != "" {
+		params.LaunchTemplateId = aws.String(launchTemplateID)
+	} else {
+		params.LaunchTemplateName = aws.String(launchTemplateName)
+	}
+	response, err := c.client.describeLaunchTemplateVersions(params)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.LaunchTemplateVersions) == 0 {
+		return nil, fmt.Errorf("Could not find version %s of launch template %s%s", version, launchTemplateID, launchTemplateName)
+	}
+	return response.LaunchTemplateVersions[0], nil
+}
+
+// Spot instances reclaimed by EC2 end up with one of these state reasons
+var spotInterruptionCodes = map[string]bool{
+	"Server.SpotInstanceTermination": true,
+	"Server.SpotInstanceShutdown":    true,
+}
+
+func (c *awsEc2Controller) isSpotInstance(instance *ec2.Instance) bool {
+	return aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot
+}
+
+func (c *awsEc2Controller) isSpotInterrupted(instance *ec2.Instance) bool {
+	return c.isSpotInstance(instance) && instance.StateReason != nil && spotInterruptionCodes[aws.StringValue(instance.StateReason.Code)]
+}
+
+func (c *awsEc2Controller) getCapacityComposition(instances []*ec2.Instance) *capacityComposition {
+	composition := &capacityComposition{}
+	for _, instance := range instances {
+		if c.isSpotInstance(instance) {
+			composition.spot++
+		} else {
+			composition.onDemand++
+		}
+	}
+	return composition
+}
+
+// Returns the instances among the given ones which are spot instances reclaimed by EC2
+func (c *awsEc2Controller) interruptedSpotInstances(instances []string) ([]string, error) {
+	var interrupted []string
+	if len(instances) == 0 {
+		return interrupted, nil
+	}
+
+	params := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: aws.StringSlice(instances),
+			},
+		},
+	}
+	results, err := c.describeInstances(params)
+	if err != nil {
+		return interrupted, err
+	}
+	for _, instance := range results {
+		if c.isSpotInterrupted(instance) {
+			interrupted = append(interrupted, *instance.InstanceId)
+		}
+	}
+	return interrupted, nil
+}
+
+// Returns the instances among the given ones which are terminated or no longer
+// known to EC2. They are described by ID only, without the filters of the
+// cluster, so that a stopped instance or one which lost its tags isn't taken
+// for gone.
+func (c *awsEc2Controller) goneInstances(instances []string) ([]string, error) {
+	found := make(map[string]bool)
+	for start := 0; start < len(instances); start += 200 {
+		end := start + 200
+		if end > len(instances) {
+			end = len(instances)
+		}
+		params := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("instance-id"),
+					Values: aws.StringSlice(instances[start:end]),
+				},
+			},
+		}
+
+		// Instances are paged
+		for {
+			response, err := c.client.describeInstances(params)
+			if err != nil {
+				return nil, fmt.Errorf("error listing AWS instances: %v", err)
+			}
+			for _, reservation := range response.Reservations {
+				for _, instance := range reservation.Instances {
+					if instance.State != nil && (aws.StringValue(instance.State.Name) == ec2.InstanceStateNameShuttingDown ||
+						aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated) {
+						continue
+					}
+					found[aws.StringValue(instance.InstanceId)] = true
+				}
+			}
+			if aws.StringValue(response.NextToken) == "" {
+				break
+			}
+			params.NextToken = response.NextToken
+		}
+	}
+
+	var gone []string
+	for _, instance := range instances {
+		if !found[instance] {
+			gone = append(gone, instance)
+		}
+	}
+	return gone, nil
+}
+
+// Returns the number of free IP addresses across the subnets
+func (c *awsEc2Controller) getAvailableIPs(subnets []string) (int, error) {
+	params := &ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(subnets),
+	}
+	response, err := c.client.describeSubnets(params)
+	if err != nil {
+		return 0, err
+	}
+	available := 0
+	for _, subnet := range response.Subnets {
+		available += int(aws.Int64Value(subnet.AvailableIpAddressCount))
+	}
+	return available, nil
 }
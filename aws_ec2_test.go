@@ -1,11 +1,34 @@
 package main
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
+var fakeDescribeLaunchTemplateVersionsOutput = &ec2.DescribeLaunchTemplateVersionsOutput{}
+
+var fakeDescribeSubnetsOutput = &ec2.DescribeSubnetsOutput{}
+
+var fakeDescribeTagsOutput = &ec2.DescribeTagsOutput{}
+
+var fakeDescribeTagsCalls = 0
+
+// The resources whose tags were described, in order
+var fakeDescribedTagsResources []string
+
+// When set, the instances known to the fake EC2 API, which filters them by
+// ID and tags and removes them when they are terminated
+var fakeEc2Instances []*ec2.Instance
+
+// When set, called before the fake EC2 API describes the instances, with the
+// number of times it did so far
+var fakeBeforeDescribeInstances func(calls int)
+
+var fakeDescribeInstancesCalls = 0
+
 type FakeAwsEc2Client struct{}
 
 func newFakeAWSEc2Client() awsEc2 {
@@ -26,12 +49,58 @@ func fakeEc2Instance() *ec2.Instance {
 	}
 }
 
+// Returns whether the instance matches the instance-id, tag:<key> and tag-key
+// filters, other filters are ignored
+func fakeInstanceMatches(instance *ec2.Instance, filters []*ec2.Filter) bool {
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+		values := aws.StringValueSlice(filter.Values)
+		switch {
+		case name == "instance-id":
+			if !containsString(values, aws.StringValue(instance.InstanceId)) {
+				return false
+			}
+		case name == "tag-key":
+			if !fakeHasTag(instance, values[0], "") {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			if !fakeHasTag(instance, strings.TrimPrefix(name, "tag:"), values[0]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func fakeHasTag(instance *ec2.Instance, key, value string) bool {
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return value == "" || aws.StringValue(tag.Value) == value
+		}
+	}
+	return false
+}
+
 func (e FakeAwsEc2Client) describeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	if fakeBeforeDescribeInstances != nil {
+		fakeBeforeDescribeInstances(fakeDescribeInstancesCalls)
+	}
+	fakeDescribeInstancesCalls++
+
 	reservation := &ec2.Reservation{
 		Instances: []*ec2.Instance{
 			fakeEc2Instance(),
 		},
 	}
+	if fakeEc2Instances != nil {
+		reservation.Instances = nil
+		for _, instance := range fakeEc2Instances {
+			if fakeInstanceMatches(instance, input.Filters) {
+				reservation.Instances = append(reservation.Instances, instance)
+			}
+		}
+	}
 	describeInstancesOutput := &ec2.DescribeInstancesOutput{
 		Reservations: []*ec2.Reservation{
 			reservation,
@@ -41,10 +110,48 @@ func (e FakeAwsEc2Client) describeInstances(input *ec2.DescribeInstancesInput) (
 }
 
 func (e FakeAwsEc2Client) describeTags(input *ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error) {
-	return &ec2.DescribeTagsOutput{}, nil
+	fakeDescribeTagsCalls++
+	if fakeEc2Instances == nil {
+		return fakeDescribeTagsOutput, nil
+	}
+
+	var key string
+	var resources []string
+	for _, filter := range input.Filters {
+		switch aws.StringValue(filter.Name) {
+		case "key":
+			key = aws.StringValue(filter.Values[0])
+		case "resource-id":
+			resources = aws.StringValueSlice(filter.Values)
+		}
+	}
+	fakeDescribedTagsResources = append(fakeDescribedTagsResources, resources...)
+	output := &ec2.DescribeTagsOutput{}
+	for _, instance := range fakeEc2Instances {
+		if !containsString(resources, aws.StringValue(instance.InstanceId)) {
+			continue
+		}
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == key {
+				output.Tags = append(output.Tags, &ec2.TagDescription{ResourceId: instance.InstanceId, Key: tag.Key, Value: tag.Value})
+			}
+		}
+	}
+	return output, nil
+}
+
+func (e FakeAwsEc2Client) describeLaunchTemplateVersions(input *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	return fakeDescribeLaunchTemplateVersionsOutput, nil
+}
+
+func (e FakeAwsEc2Client) describeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	return fakeDescribeSubnetsOutput, nil
 }
 
 func (e FakeAwsEc2Client) terminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	for _, instanceID := range aws.StringValueSlice(input.InstanceIds) {
+		fakeRemoveInstance(instanceID)
+	}
 	return &ec2.TerminateInstancesOutput{}, nil
 }
 
@@ -60,3 +167,57 @@ func TestAwsEc2Client_DescribeInstances(t *testing.T) {
 		t.Error("Could not describe instances")
 	}
 }
+
+func TestAwsEc2Controller_GetTagValue(t *testing.T) {
+	ec2Controller := newAWSEc2Controller(newFakeAWSEc2Client())
+	instance := fakeEc2Instance()
+
+	if value := ec2Controller.getTagValue(instance, "version"); value != "blah" {
+		t.Errorf("expected blah, got %s", value)
+	}
+	if value := ec2Controller.getTagValue(instance, "missing"); value != "" {
+		t.Errorf("expected an empty value, got %s", value)
+	}
+}
+
+func TestIsSpotInterrupted(t *testing.T) {
+	controller := newAWSEc2Controller(newFakeAWSEc2Client())
+
+	spot := fakeEc2Instance()
+	spot.InstanceLifecycle = aws.String("spot")
+	if controller.isSpotInterrupted(spot) {
+		t.Error("expected a running spot instance not to be interrupted")
+	}
+	spot.StateReason = &ec2.StateReason{Code: aws.String("Server.SpotInstanceTermination")}
+	if !controller.isSpotInterrupted(spot) {
+		t.Error("expected the spot instance to be interrupted")
+	}
+
+	onDemand := fakeEc2Instance()
+	if composition := controller.getCapacityComposition([]*ec2.Instance{spot, onDemand}); composition.spot != 1 || composition.onDemand != 1 {
+		t.Errorf("expected 1 on-demand and 1 spot instances, got %s", composition)
+	}
+}
+
+func TestGetInstancesHealth(t *testing.T) {
+	fakeDescribeTagsOutput = &ec2.DescribeTagsOutput{
+		Tags: []*ec2.TagDescription{
+			{ResourceId: aws.String("i-1"), Key: aws.String("healthy"), Value: aws.String("True")},
+			{ResourceId: aws.String("i-2"), Key: aws.String("healthy"), Value: aws.String("False")},
+		},
+	}
+	fakeDescribeTagsCalls = 0
+	defer func() { fakeDescribeTagsOutput = &ec2.DescribeTagsOutput{} }()
+
+	controller := newAWSEc2Controller(newFakeAWSEc2Client())
+	health, err := controller.getInstancesHealth([]string{"i-1", "i-2", "i-3"})
+	if err != nil {
+		t.Errorf("got error when getting the health of the instances: %s", err)
+	}
+	if health["i-1"] != "True" || health["i-2"] != "False" || health["i-3"] != "Unset" {
+		t.Errorf("got unexpected health %v", health)
+	}
+	if fakeDescribeTagsCalls != 1 {
+		t.Errorf("expected the tags to be described in a single call, got %d", fakeDescribeTagsCalls)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+)
+
+type awsServiceQuotas interface {
+	getServiceQuota(*servicequotas.GetServiceQuotaInput) (*servicequotas.GetServiceQuotaOutput, error)
+}
+
+type awsServiceQuotasClient struct {
+	session *servicequotas.ServiceQuotas
+}
+
+type awsServiceQuotasController struct {
+	client awsServiceQuotas
+}
+
+func newAWSServiceQuotasClient(sess *session.Session) awsServiceQuotas {
+	return &awsServiceQuotasClient{
+		session: servicequotas.New(sess),
+	}
+}
+
+func newAWSServiceQuotasController(awsServiceQuotasClient awsServiceQuotas) *awsServiceQuotasController {
+	return &awsServiceQuotasController{
+		client: awsServiceQuotasClient,
+	}
+}
+
+func (serviceQuotasClient *awsServiceQuotasClient) getServiceQuota(params *servicequotas.GetServiceQuotaInput) (*servicequotas.GetServiceQuotaOutput, error) {
+	return serviceQuotasClient.session.GetServiceQuota(params)
+}
+
+// Returns the applied value of a quota in the region
+func (c *awsServiceQuotasController) getQuotaValue(serviceCode string, quotaCode string) (float64, error) {
+	params := &servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String(serviceCode),
+		QuotaCode:   aws.String(quotaCode),
+	}
+	response, err := c.client.getServiceQuota(params)
+	if err != nil {
+		return 0, err
+	}
+	return aws.Float64Value(response.Quota.Value), nil
+}
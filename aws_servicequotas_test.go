@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+)
+
+var fakeQuotaValue = 1000.0
+
+type FakeAwsServiceQuotasClient struct{}
+
+func newFakeAWSServiceQuotasClient() awsServiceQuotas {
+	return &FakeAwsServiceQuotasClient{}
+}
+
+func (serviceQuotasClient *FakeAwsServiceQuotasClient) getServiceQuota(input *servicequotas.GetServiceQuotaInput) (*servicequotas.GetServiceQuotaOutput, error) {
+	return &servicequotas.GetServiceQuotaOutput{
+		Quota: &servicequotas.ServiceQuota{
+			QuotaCode: input.QuotaCode,
+			Value:     aws.Float64(fakeQuotaValue),
+		},
+	}, nil
+}
+
+func TestAwsGetQuotaValue(t *testing.T) {
+	controller := newAWSServiceQuotasController(newFakeAWSServiceQuotasClient())
+	value, err := controller.getQuotaValue("ec2", onDemandStandardQuotaCode)
+	if err != nil {
+		t.Errorf("got error when getting quota: %s", err)
+	}
+	if value != fakeQuotaValue {
+		t.Errorf("expected %f, got %f", fakeQuotaValue, value)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+var (
+	awsRoleArn         = os.Getenv("AWS_ROLE_ARN")
+	awsExternalID      = os.Getenv("AWS_EXTERNAL_ID")
+	awsRoleSessionName = os.Getenv("AWS_ROLE_SESSION_NAME")
+	awsRoleDurationStr = os.Getenv("AWS_ROLE_DURATION_SECONDS")
+	// Assumed role credentials are refreshed this long before they expire
+	awsRoleExpiryWindow = 5 * time.Minute
+)
+
+// awsSessionSettings describes how to reach the AWS account and region of a
+// cluster, optionally through an assumed role
+type awsSessionSettings struct {
+	region      string
+	account     string
+	profile     string
+	roleArn     string
+	externalID  string
+	sessionName string
+	duration    time.Duration
+}
+
+// Returns the session settings of the cluster being rolled. {account} in the
+// role ARN is replaced by the account of the cluster, so a single setting
+// covers a role of the same name in every account.
+func getAWSSessionSettings() (*awsSessionSettings, error) {
+	settings := &awsSessionSettings{
+		region:      awsRegion,
+		account:     awsAccount,
+		profile:     awsProfile,
+		roleArn:     awsRoleArn,
+		externalID:  awsExternalID,
+		sessionName: awsRoleSessionName,
+	}
+
+	if strings.Contains(settings.roleArn, "{account}") {
+		if settings.account == "" {
+			return nil, fmt.Errorf("AWS_ROLE_ARN %s needs AWS_ACCOUNT to be set", settings.roleArn)
+		}
+		settings.roleArn = strings.Replace(settings.roleArn, "{account}", settings.account, -1)
+	}
+
+	if settings.sessionName == "" {
+		settings.sessionName = "kubernetes-updater"
+		if cluster != "" {
+			settings.sessionName = settings.sessionName + "-" + cluster
+		}
+	}
+	// Role session names are limited to 64 characters
+	if len(settings.sessionName) > 64 {
+		settings.sessionName = settings.sessionName[:64]
+	}
+
+	duration, err := parseIntSetting("AWS_ROLE_DURATION_SECONDS", awsRoleDurationStr, 3600)
+	if err != nil {
+		return nil, err
+	}
+	if duration < 900 {
+		return nil, fmt.Errorf("AWS_ROLE_DURATION_SECONDS must be at least 900, got %d", duration)
+	}
+	settings.duration = time.Duration(duration) * time.Second
+
+	return settings, nil
+}
+
+// newAWSSession creates the session shared by all the AWS clients. When a
+// role is set, its credentials are assumed on top of the ambient ones and
+// refreshed before they expire, so they outlive long rolls.
+func newAWSSession(settings *awsSessionSettings) (*session.Session, error) {
+	options := session.Options{
+		Config:            aws.Config{Region: aws.String(settings.region)},
+		Profile:           settings.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create the AWS session\n Error: %s", err)
+	}
+
+	if settings.roleArn == "" {
+		return sess, nil
+	}
+
+	creds := stscreds.NewCredentials(sess, settings.roleArn, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = settings.sessionName
+		p.Duration = settings.duration
+		p.ExpiryWindow = awsRoleExpiryWindow
+		if settings.externalID != "" {
+			p.ExternalID = aws.String(settings.externalID)
+		}
+	})
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// Returns an AWS client for the account and region of the cluster being rolled
+func newClusterAwsClient() (*awsClient, error) {
+	settings, err := getAWSSessionSettings()
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newAWSSession(settings)
+	if err != nil {
+		return nil, err
+	}
+	throttle, err := getAWSThrottle()
+	if err != nil {
+		return nil, err
+	}
+	return newAwsClient(sess, throttle), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetAWSSessionSettings(t *testing.T) {
+	awsAccount = "123456789012"
+	awsRoleArn = "arn:aws:iam::{account}:role/kubernetes-updater"
+	cluster = "infra"
+	defer func() {
+		awsAccount = ""
+		awsRoleArn = ""
+		cluster = ""
+	}()
+
+	settings, err := getAWSSessionSettings()
+	if err != nil {
+		t.Errorf("got error when getting the session settings: %s", err)
+	}
+	if settings.roleArn != "arn:aws:iam::123456789012:role/kubernetes-updater" {
+		t.Errorf("got unexpected role ARN %s", settings.roleArn)
+	}
+	if settings.sessionName != "kubernetes-updater-infra" || settings.duration != time.Hour {
+		t.Errorf("got unexpected session settings: %+v", settings)
+	}
+
+	awsAccount = ""
+	if _, err := getAWSSessionSettings(); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestNewAWSSession(t *testing.T) {
+	settings := &awsSessionSettings{
+		region:      "us-west-2",
+		roleArn:     "arn:aws:iam::123456789012:role/kubernetes-updater",
+		externalID:  "secret",
+		sessionName: "kubernetes-updater",
+		duration:    time.Hour,
+	}
+	sess, err := newAWSSession(settings)
+	if err != nil {
+		t.Errorf("got error when creating the session: %s", err)
+	}
+	if *sess.Config.Region != "us-west-2" {
+		t.Errorf("expected region us-west-2, got %s", *sess.Config.Region)
+	}
+	if sess.Config.Credentials == nil {
+		t.Error("expected the assumed role credentials to be set")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/golang/glog"
+	"github.com/juju/ratelimit"
+)
+
+var (
+	awsRateLimitStr       = os.Getenv("ROLLER_AWS_RATE_LIMIT")
+	awsRateBurstStr       = os.Getenv("ROLLER_AWS_RATE_BURST")
+	awsThrottleRetriesStr = os.Getenv("ROLLER_AWS_THROTTLE_RETRIES")
+	// The delay before the first retry of a throttled request, doubled on each
+	// retry up to the max
+	awsThrottleBaseDelay = time.Second
+	awsThrottleMaxDelay  = 30 * time.Second
+)
+
+// awsThrottle rate limits the requests of all the AWS clients with a shared
+// token bucket, and retries the requests which are throttled anyway. The
+// bucket is shared within the process only: it doesn't account for the other
+// processes using the same AWS account, and each cluster of a fleet run has
+// its own.
+type awsThrottle struct {
+	bucket     *ratelimit.Bucket
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func newAWSThrottle(rate float64, burst int, maxRetries int) *awsThrottle {
+	return &awsThrottle{
+		bucket:     ratelimit.NewBucketWithRate(rate, int64(burst)),
+		maxRetries: maxRetries,
+		baseDelay:  awsThrottleBaseDelay,
+		maxDelay:   awsThrottleMaxDelay,
+	}
+}
+
+// Returns the throttle set by ROLLER_AWS_RATE_LIMIT requests per second,
+// ROLLER_AWS_RATE_BURST and ROLLER_AWS_THROTTLE_RETRIES
+func getAWSThrottle() (*awsThrottle, error) {
+	rate, err := parseIntSetting("ROLLER_AWS_RATE_LIMIT", awsRateLimitStr, 10)
+	if err != nil {
+		return nil, err
+	}
+	burst, err := parseIntSetting("ROLLER_AWS_RATE_BURST", awsRateBurstStr, 20)
+	if err != nil {
+		return nil, err
+	}
+	retries, err := parseIntSetting("ROLLER_AWS_THROTTLE_RETRIES", awsThrottleRetriesStr, 8)
+	if err != nil {
+		return nil, err
+	}
+	if rate < 1 || burst < 1 || retries < 0 {
+		return nil, fmt.Errorf("ROLLER_AWS_RATE_LIMIT and ROLLER_AWS_RATE_BURST must be at least 1, and ROLLER_AWS_THROTTLE_RETRIES not negative")
+	}
+	return newAWSThrottle(float64(rate), burst, retries), nil
+}
+
+// Runs the request once a token is available, retrying with an exponential
+// backoff while it is throttled
+func (t *awsThrottle) do(operation string, f func() error) error {
+	delay := t.baseDelay
+	for attempt := 0; ; attempt++ {
+		t.bucket.Wait(1)
+		err := f()
+		if err == nil || !request.IsErrorThrottle(err) || attempt >= t.maxRetries {
+			return err
+		}
+
+		// Jitter spreads the retries of the concurrent rolls
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		glog.V(4).Infof("AWS request %s was throttled, retrying in %v: %s", operation, wait, err)
+		time.Sleep(wait)
+		if delay *= 2; delay > t.maxDelay {
+			delay = t.maxDelay
+		}
+	}
+}
+
+// throttleRetryer is the default retryer of the SDK, minus the retries of the
+// throttled requests, which are left to the throttle so that they are neither
+// retried twice nor outside of the token bucket
+type throttleRetryer struct {
+	client.DefaultRetryer
+}
+
+func (r throttleRetryer) ShouldRetry(req *request.Request) bool {
+	if req.IsErrorThrottle() {
+		return false
+	}
+	return r.DefaultRetryer.ShouldRetry(req)
+}
+
+// Returns a copy of the session for the clients wrapped with the throttle
+func throttledSession(sess *session.Session) *session.Session {
+	retryer := throttleRetryer{client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries}}
+	return sess.Copy(request.WithRetryer(aws.NewConfig(), retryer))
+}
+
+// throttledEc2 wraps an awsEc2 client with the throttle
+type throttledEc2 struct {
+	client   awsEc2
+	throttle *awsThrottle
+}
+
+func (e throttledEc2) describeInstances(input *ec2.DescribeInstancesInput) (output *ec2.DescribeInstancesOutput, err error) {
+	err = e.throttle.do("DescribeInstances", func() error {
+		output, err = e.client.describeInstances(input)
+		return err
+	})
+	return output, err
+}
+
+func (e throttledEc2) describeTags(input *ec2.DescribeTagsInput) (output *ec2.DescribeTagsOutput, err error) {
+	err = e.throttle.do("DescribeTags", func() error {
+		output, err = e.client.describeTags(input)
+		return err
+	})
+	return output, err
+}
+
+func (e throttledEc2) terminateInstances(input *ec2.TerminateInstancesInput) (output *ec2.TerminateInstancesOutput, err error) {
+	err = e.throttle.do("TerminateInstances", func() error {
+		output, err = e.client.terminateInstances(input)
+		return err
+	})
+	return output, err
+}
+
+func (e throttledEc2) describeLaunchTemplateVersions(input *ec2.DescribeLaunchTemplateVersionsInput) (output *ec2.DescribeLaunchTemplateVersionsOutput, err error) {
+	err = e.throttle.do("DescribeLaunchTemplateVersions", func() error {
+		output, err = e.client.describeLaunchTemplateVersions(input)
+		return err
+	})
+	return output, err
+}
+
+func (e throttledEc2) describeSubnets(input *ec2.DescribeSubnetsInput) (output *ec2.DescribeSubnetsOutput, err error) {
+	err = e.throttle.do("DescribeSubnets", func() error {
+		output, err = e.client.describeSubnets(input)
+		return err
+	})
+	return output, err
+}
+
+// throttledAutoscaling wraps an awsAutoscaling client with the throttle
+type throttledAutoscaling struct {
+	client   awsAutoscaling
+	throttle *awsThrottle
+}
+
+// Throttles the requests which only return their response as a string
+func (a throttledAutoscaling) do(operation string, f func() (string, error)) (response string, err error) {
+	err = a.throttle.do(operation, func() error {
+		response, err = f()
+		return err
+	})
+	return response, err
+}
+
+func (a throttledAutoscaling) suspendProcesses(params *autoscaling.ScalingProcessQuery) (string, error) {
+	return a.do("SuspendProcesses", func() (string, error) { return a.client.suspendProcesses(params) })
+}
+
+func (a throttledAutoscaling) resumeProcesses(params *autoscaling.ScalingProcessQuery) (string, error) {
+	return a.do("ResumeProcesses", func() (string, error) { return a.client.resumeProcesses(params) })
+}
+
+func (a throttledAutoscaling) setDesiredCount(params *autoscaling.SetDesiredCapacityInput) (string, error) {
+	return a.do("SetDesiredCapacity", func() (string, error) { return a.client.setDesiredCount(params) })
+}
+
+func (a throttledAutoscaling) cancelInstanceRefresh(params *autoscaling.CancelInstanceRefreshInput) (string, error) {
+	return a.do("CancelInstanceRefresh", func() (string, error) { return a.client.cancelInstanceRefresh(params) })
+}
+
+func (a throttledAutoscaling) putLifecycleHook(params *autoscaling.PutLifecycleHookInput) (string, error) {
+	return a.do("PutLifecycleHook", func() (string, error) { return a.client.putLifecycleHook(params) })
+}
+
+func (a throttledAutoscaling) deleteLifecycleHook(params *autoscaling.DeleteLifecycleHookInput) (string, error) {
+	return a.do("DeleteLifecycleHook", func() (string, error) { return a.client.deleteLifecycleHook(params) })
+}
+
+func (a throttledAutoscaling) completeLifecycleAction(params *autoscaling.CompleteLifecycleActionInput) (string, error) {
+	return a.do("CompleteLifecycleAction", func() (string, error) { return a.client.completeLifecycleAction(params) })
+}
+
+func (a throttledAutoscaling) terminateInstanceInAutoScalingGroup(params *autoscaling.TerminateInstanceInAutoScalingGroupInput) (string, error) {
+	return a.do("TerminateInstanceInAutoScalingGroup", func() (string, error) { return a.client.terminateInstanceInAutoScalingGroup(params) })
+}
+
+func (a throttledAutoscaling) updateAutoScalingGroup(params *autoscaling.UpdateAutoScalingGroupInput) (string, error) {
+	return a.do("UpdateAutoScalingGroup", func() (string, error) { return a.client.updateAutoScalingGroup(params) })
+}
+
+func (a throttledAutoscaling) describeAutoscalingGroups(params *autoscaling.DescribeAutoScalingGroupsInput) (output *autoscaling.DescribeAutoScalingGroupsOutput, err error) {
+	err = a.throttle.do("DescribeAutoScalingGroups", func() error {
+		output, err = a.client.describeAutoscalingGroups(params)
+		return err
+	})
+	return output, err
+}
+
+func (a throttledAutoscaling) startInstanceRefresh(params *autoscaling.StartInstanceRefreshInput) (output *autoscaling.StartInstanceRefreshOutput, err error) {
+	err = a.throttle.do("StartInstanceRefresh", func() error {
+		output, err = a.client.startInstanceRefresh(params)
+		return err
+	})
+	return output, err
+}
+
+func (a throttledAutoscaling) describeInstanceRefreshes(params *autoscaling.DescribeInstanceRefreshesInput) (output *autoscaling.DescribeInstanceRefreshesOutput, err error) {
+	err = a.throttle.do("DescribeInstanceRefreshes", func() error {
+		output, err = a.client.describeInstanceRefreshes(params)
+		return err
+	})
+	return output, err
+}
+
+func (a throttledAutoscaling) describeLaunchConfigurations(params *autoscaling.DescribeLaunchConfigurationsInput) (output *autoscaling.DescribeLaunchConfigurationsOutput, err error) {
+	err = a.throttle.do("DescribeLaunchConfigurations", func() error {
+		output, err = a.client.describeLaunchConfigurations(params)
+		return err
+	})
+	return output, err
+}
+
+func (a throttledAutoscaling) describeScalingActivities(params *autoscaling.DescribeScalingActivitiesInput) (output *autoscaling.DescribeScalingActivitiesOutput, err error) {
+	err = a.throttle.do("DescribeScalingActivities", func() error {
+		output, err = a.client.describeScalingActivities(params)
+		return err
+	})
+	return output, err
+}
+
+// throttledServiceQuotas wraps an awsServiceQuotas client with the throttle
+type throttledServiceQuotas struct {
+	client   awsServiceQuotas
+	throttle *awsThrottle
+}
+
+func (q throttledServiceQuotas) getServiceQuota(params *servicequotas.GetServiceQuotaInput) (output *servicequotas.GetServiceQuotaOutput, err error) {
+	err = q.throttle.do("GetServiceQuota", func() error {
+		output, err = q.client.getServiceQuota(params)
+		return err
+	})
+	return output, err
+}
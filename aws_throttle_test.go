@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func newTestAWSThrottle(maxRetries int) *awsThrottle {
+	throttle := newAWSThrottle(1000, 1000, maxRetries)
+	throttle.baseDelay = time.Millisecond
+	throttle.maxDelay = time.Millisecond
+	return throttle
+}
+
+func TestAWSThrottleRetriesThrottledRequests(t *testing.T) {
+	throttle := newTestAWSThrottle(3)
+
+	calls := 0
+	err := throttle.do("DescribeTags", func() error {
+		calls++
+		if calls < 3 {
+			return awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected the request to succeed after retries, got %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+
+	calls = 0
+	err = throttle.do("DescribeTags", func() error {
+		calls++
+		return awserr.New("Throttling", "Rate exceeded", nil)
+	})
+	if err == nil || calls != 4 {
+		t.Errorf("expected the request to fail after 4 calls, got %d calls and error %v", calls, err)
+	}
+}
+
+func TestAWSThrottleDoesNotRetryOtherErrors(t *testing.T) {
+	throttle := newTestAWSThrottle(3)
+
+	calls := 0
+	err := throttle.do("TerminateInstances", func() error {
+		calls++
+		return errors.New("boom")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected a single failed call, got %d calls and error %v", calls, err)
+	}
+}
+
+func TestThrottledEc2(t *testing.T) {
+	controller := newAWSEc2Controller(throttledEc2{client: newFakeAWSEc2Client(), throttle: newTestAWSThrottle(3)})
+	if _, err := controller.getInstanceHealth("i-1"); err != nil {
+		t.Errorf("got error when getting the health of the instance: %s", err)
+	}
+}
+
+func TestThrottledServiceQuotas(t *testing.T) {
+	controller := newAWSServiceQuotasController(throttledServiceQuotas{client: newFakeAWSServiceQuotasClient(), throttle: newTestAWSThrottle(3)})
+	if _, err := controller.getQuotaValue("ec2", "L-1216C47A"); err != nil {
+		t.Errorf("got error when getting the quota value: %s", err)
+	}
+}
+
+func TestThrottleRetryer(t *testing.T) {
+	retryer := throttleRetryer{client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries}}
+
+	// Throttled requests are retried by the throttle only
+	throttled := &request.Request{Error: awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)}
+	if retryer.ShouldRetry(throttled) {
+		t.Error("expected the throttled request not to be retried by the SDK")
+	}
+
+	// Other transient errors still are
+	transient := &request.Request{Error: awserr.New("RequestTimeout", "Request timed out.", nil)}
+	if !retryer.ShouldRetry(transient) {
+		t.Error("expected the transient error to be retried by the SDK")
+	}
+}
+
+func TestGetAWSThrottleInvalid(t *testing.T) {
+	awsRateLimitStr = "0"
+	defer func() { awsRateLimitStr = "" }()
+
+	if _, err := getAWSThrottle(); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
@@ -1,55 +1,171 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/api/v1"
-	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
-	meta_v1 "k8s.io/client-go/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 type kubernetesClient interface {
-	getDeployment(service string, namespace string) (*v1beta1.Deployment, error)
-	updateDeployment(*v1beta1.Deployment) (*v1beta1.Deployment, error)
-	getNodes(v1.ListOptions) (*v1.NodeList, error)
-	updateNode(*v1.Node) (*v1.Node, error)
+	getDeployment(service string, namespace string) (*apps_v1.Deployment, error)
+	scaleDeployment(service string, namespace string, replicas int32) (int32, error)
+	getNodes(meta_v1.ListOptions) (*v1.NodeList, error)
+	setNodeUnschedulable(name string, unschedulable bool) (*v1.Node, error)
+	deleteNode(name string) error
+	getPods(namespace string, listOptions meta_v1.ListOptions) (*v1.PodList, error)
+	getDeployments(namespace string, listOptions meta_v1.ListOptions) (*apps_v1.DeploymentList, error)
+	getStatefulSets(namespace string, listOptions meta_v1.ListOptions) (*apps_v1.StatefulSetList, error)
+	evictPod(namespace string, name string) error
 }
 
 type kubernetesClientConfig struct {
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
 }
 
-func newClient(server string, username string, password string) kubernetesClient {
-	config := &rest.Config{
-		Host:     server,
-		Username: username,
-		Password: password,
-		QPS:      100.0,
-		Burst:    200,
+var (
+	kubeconfigPath      = os.Getenv("KUBECONFIG")
+	kubernetesContext   = os.Getenv("KUBERNETES_CONTEXT")
+	kubernetesInCluster = os.Getenv("KUBERNETES_IN_CLUSTER")
+	kubernetesToken     = os.Getenv("KUBERNETES_TOKEN")
+	kubernetesCertFile  = os.Getenv("KUBERNETES_CLIENT_CERT")
+	kubernetesKeyFile   = os.Getenv("KUBERNETES_CLIENT_KEY")
+	kubernetesCAFile    = os.Getenv("KUBERNETES_CA_FILE")
+	// The configuration of the target cluster, set once at startup
+	kubernetesConfig *rest.Config
+)
+
+// Returns the configuration of the target cluster, in order of precedence
+// from the service account of the pod when running in the cluster, from a
+// kubeconfig file and context, or from KUBERNETES_SERVER and its credentials:
+// a bearer token, a client certificate or basic auth. KUBERNETES_SERVER and
+// KUBERNETES_CA_FILE override the server and CA bundle of the kubeconfig.
+func getKubernetesConfig() (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+
+	switch {
+	case kubernetesInCluster == "true":
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the in-cluster kubernetes configuration: %s", err)
+		}
+	case kubeconfigPath != "":
+		rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: kubernetesContext}
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the kubeconfig %s: %s", kubeconfigPath, err)
+		}
+		if kubernetesServer != "" {
+			config.Host = kubernetesServer
+		}
+		if kubernetesCAFile != "" {
+			config.TLSClientConfig.CAFile = kubernetesCAFile
+		}
+	default:
+		if kubernetesServer == "" {
+			return nil, fmt.Errorf("set the KUBERNETES_SERVER variable to the desired kubernetes server, or KUBECONFIG, or KUBERNETES_IN_CLUSTER=true")
+		}
+		if kubernetesToken == "" && kubernetesCertFile == "" && kubernetesUsername == "" {
+			return nil, fmt.Errorf("set one of KUBERNETES_TOKEN, KUBERNETES_CLIENT_CERT or KUBERNETES_USERNAME to authenticate to %s", kubernetesServer)
+		}
+		if (kubernetesCertFile == "") != (kubernetesKeyFile == "") {
+			return nil, fmt.Errorf("set both KUBERNETES_CLIENT_CERT and KUBERNETES_CLIENT_KEY")
+		}
+		config = &rest.Config{
+			Host:        kubernetesServer,
+			Username:    kubernetesUsername,
+			Password:    kubernetesPassword,
+			BearerToken: kubernetesToken,
+			TLSClientConfig: rest.TLSClientConfig{
+				CertFile: kubernetesCertFile,
+				KeyFile:  kubernetesKeyFile,
+				CAFile:   kubernetesCAFile,
+			},
+		}
+	}
+
+	config.QPS = 100.0
+	config.Burst = 200
+	return config, nil
+}
+
+// Builds a kubernetes client from the configuration. A variable so that tests
+// can hand out a fake client instead.
+var newClient = func(config *rest.Config) (kubernetesClient, error) {
+	if config == nil {
+		return nil, fmt.Errorf("the kubernetes configuration is not set")
 	}
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		return nil, fmt.Errorf("unable to create the kubernetes client: %s", err)
 	}
-	return &kubernetesClientConfig{clientset: clientset}
+	return &kubernetesClientConfig{clientset: clientset}, nil
 }
 
-func (c kubernetesClientConfig) getDeployment(service string, namespace string) (*v1beta1.Deployment, error) {
-	deployment := c.clientset.Extensions().Deployments(namespace)
-	return deployment.Get(service, meta_v1.GetOptions{})
+func (c kubernetesClientConfig) getDeployment(service string, namespace string) (*apps_v1.Deployment, error) {
+	return c.clientset.AppsV1().Deployments(namespace).Get(context.TODO(), service, meta_v1.GetOptions{})
 }
 
-func (c kubernetesClientConfig) updateDeployment(newDeployment *v1beta1.Deployment) (*v1beta1.Deployment, error) {
-	deployment := c.clientset.Extensions().Deployments(newDeployment.ObjectMeta.Namespace)
-	return deployment.Update(newDeployment)
+// Sets the replicas of a deployment with a merge patch of its Scale
+// subresource, which only needs the permission to scale deployments and
+// doesn't conflict with the controllers updating the rest of the deployment.
+// The typed client can't decode the Scale the API server returns into a
+// deployment, so the replicas which were set are returned.
+func (c kubernetesClientConfig) scaleDeployment(service string, namespace string, replicas int32) (int32, error) {
+	patch := []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas))
+	_, err := c.clientset.AppsV1().Deployments(namespace).Patch(context.TODO(), service, types.MergePatchType,
+		patch, meta_v1.PatchOptions{}, "scale")
+	if err != nil {
+		return 0, err
+	}
+	return replicas, nil
 }
 
-func (c kubernetesClientConfig) getNodes(listOptions v1.ListOptions) (*v1.NodeList, error) {
-	nodeList, err := c.clientset.Core().Nodes().List(listOptions)
-	return nodeList, err
+func (c kubernetesClientConfig) getNodes(listOptions meta_v1.ListOptions) (*v1.NodeList, error) {
+	return c.clientset.CoreV1().Nodes().List(context.TODO(), listOptions)
 }
 
-func (c kubernetesClientConfig) updateNode(newNode *v1.Node) (*v1.Node, error) {
-	node, err := c.clientset.Core().Nodes().Update(newNode)
-	return node, err
+// Cordons or uncordons a node with a strategic merge patch of its
+// schedulability, leaving alone the fields kubelet and the controllers keep
+// updating, so that it doesn't conflict with them
+func (c kubernetesClientConfig) setNodeUnschedulable(name string, unschedulable bool) (*v1.Node, error) {
+	patch := []byte(fmt.Sprintf(`{"spec":{"unschedulable":%t}}`, unschedulable))
+	return c.clientset.CoreV1().Nodes().Patch(context.TODO(), name, types.StrategicMergePatchType,
+		patch, meta_v1.PatchOptions{})
+}
+
+func (c kubernetesClientConfig) deleteNode(name string) error {
+	return c.clientset.CoreV1().Nodes().Delete(context.TODO(), name, meta_v1.DeleteOptions{})
+}
+
+func (c kubernetesClientConfig) getPods(namespace string, listOptions meta_v1.ListOptions) (*v1.PodList, error) {
+	return c.clientset.CoreV1().Pods(namespace).List(context.TODO(), listOptions)
+}
+
+func (c kubernetesClientConfig) getDeployments(namespace string, listOptions meta_v1.ListOptions) (*apps_v1.DeploymentList, error) {
+	return c.clientset.AppsV1().Deployments(namespace).List(context.TODO(), listOptions)
+}
+
+func (c kubernetesClientConfig) getStatefulSets(namespace string, listOptions meta_v1.ListOptions) (*apps_v1.StatefulSetList, error) {
+	return c.clientset.AppsV1().StatefulSets(namespace).List(context.TODO(), listOptions)
+}
+
+func (c kubernetesClientConfig) evictPod(namespace string, name string) error {
+	eviction := &policy.Eviction{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	return c.clientset.CoreV1().Pods(namespace).EvictV1(context.TODO(), eviction)
 }
@@ -1,80 +1,174 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"k8s.io/client-go/pkg/api/v1"
-	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
-	meta_v1 "k8s.io/client-go/pkg/apis/meta/v1"
-)
+	"testing"
 
-type FakeKubernetesClientConfig struct{}
+	apps_v1 "k8s.io/api/apps/v1"
+	autoscaling_v1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+)
 
-var fakeDeployment = &v1beta1.Deployment{
-	Spec: v1beta1.DeploymentSpec{
+var fakeDeployment = &apps_v1.Deployment{
+	ObjectMeta: meta_v1.ObjectMeta{
+		Name:      "fake-service",
+		Namespace: "fake-namespace",
+	},
+	Spec: apps_v1.DeploymentSpec{
 		Replicas: int32p(1),
 		Template: v1.PodTemplateSpec{
-			ObjectMeta: v1.ObjectMeta{
+			ObjectMeta: meta_v1.ObjectMeta{
 				Name:      "fake-service",
 				Namespace: "fake-namespace",
 			},
 			Spec: v1.PodSpec{},
 		},
 	},
+	Status: apps_v1.DeploymentStatus{
+		AvailableReplicas: 1,
+	},
 }
 
 var fakeNode = v1.Node{
-	ObjectMeta: v1.ObjectMeta{
-		Name:      "fake-service",
-		Namespace: "fake-namespace",
+	ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "fake-service",
+		Labels: map[string]string{"instance-id": "i-fake-instanceid"},
 	},
 	Spec: v1.NodeSpec{
 		Unschedulable: false,
 	},
 }
 
-func fakeNodeList(listOptions v1.ListOptions) *v1.NodeList {
-	labels := make(map[string]string)
-	labels["instance-id"] = "i-fake-instanceid"
+var fakeProviderNode = v1.Node{
+	ObjectMeta: meta_v1.ObjectMeta{
+		Name: "fake-provider-node",
+	},
+	Spec: v1.NodeSpec{
+		ProviderID: "aws:///us-east-1a/i-fake-provider-instanceid",
+	},
+}
 
-	if listOptions.LabelSelector != keysString(labels) {
-		return &v1.NodeList{
-			ListMeta: meta_v1.ListMeta{},
-			Items:    []v1.Node{},
-		}
-	}
+// The workloads the fake clientset is seeded with, set up by each test
+var fakePodList = &v1.PodList{}
 
-	fakeNode.Labels = labels
+var fakeDeploymentList = &apps_v1.DeploymentList{}
 
-	nodeList := &v1.NodeList{
-		ListMeta: meta_v1.ListMeta{},
-		Items: []v1.Node{
-			fakeNode,
-		},
+var fakeStatefulSetList = &apps_v1.StatefulSetList{}
+
+var (
+	podsResource        = v1.SchemeGroupVersion.WithResource("pods")
+	deploymentsResource = apps_v1.SchemeGroupVersion.WithResource("deployments")
+)
+
+// Returns the object, named after its position when the test left its name
+// out, since the fake clientset needs unique names
+func fakeNamed(object meta_v1.Object, kind string, i int) meta_v1.Object {
+	if object.GetName() == "" {
+		object.SetName(fmt.Sprintf("fake-%s-%d", kind, i))
 	}
-	return nodeList
+	return object
+}
+
+// Returns a fake clientset seeded with the fake nodes and deployment and the
+// workloads of the test. The object tracker of the fake clientset neither
+// evicts pods nor handles the scale subresource, so reactors do it.
+func newFakeClientset() *fake.Clientset {
+	objects := []runtime.Object{fakeDeployment.DeepCopy(), fakeNode.DeepCopy(), fakeProviderNode.DeepCopy()}
+	for i := range fakePodList.Items {
+		pod := fakePodList.Items[i].DeepCopy()
+		fakeNamed(pod, "pod", i)
+		objects = append(objects, pod)
+	}
+	for i := range fakeDeploymentList.Items {
+		deployment := fakeDeploymentList.Items[i].DeepCopy()
+		fakeNamed(deployment, "deployment", i)
+		objects = append(objects, deployment)
+	}
+	for i := range fakeStatefulSetList.Items {
+		statefulSet := fakeStatefulSetList.Items[i].DeepCopy()
+		fakeNamed(statefulSet, "statefulset", i)
+		objects = append(objects, statefulSet)
+	}
+	clientset := fake.NewClientset(objects...)
+
+	clientset.PrependReactor("create", "pods", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8s_testing.CreateAction).GetObject().(*policy.Eviction)
+		return true, nil, clientset.Tracker().Delete(podsResource, eviction.Namespace, eviction.Name)
+	})
+	clientset.PrependReactor("patch", "deployments", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		patch := action.(k8s_testing.PatchAction)
+		scale := &autoscaling_v1.Scale{}
+		if err := json.Unmarshal(patch.GetPatch(), scale); err != nil {
+			return true, nil, err
+		}
+		obj, err := clientset.Tracker().Get(deploymentsResource, patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		deployment := obj.(*apps_v1.Deployment).DeepCopy()
+		deployment.Spec.Replicas = int32p(scale.Spec.Replicas)
+		if err := clientset.Tracker().Update(deploymentsResource, deployment, patch.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		// All the typed client makes of the Scale returned by the API server
+		return true, &apps_v1.Deployment{}, nil
+	})
+	return clientset
 }
 
 func newFakeClient() kubernetesClient {
-	return &FakeKubernetesClientConfig{}
+	return &kubernetesClientConfig{clientset: newFakeClientset()}
 }
 
-func (c FakeKubernetesClientConfig) getDeployment(service string, namespace string) (*v1beta1.Deployment, error) {
-	if service == fakeDeployment.Spec.Template.ObjectMeta.Name && namespace ==
-		fakeDeployment.Spec.Template.ObjectMeta.Namespace {
-		return fakeDeployment, nil
+func TestGetKubernetesConfig(t *testing.T) {
+	kubernetesServer = "https://kubernetes"
+	kubernetesToken = "token"
+	kubernetesCAFile = "/etc/kubernetes/ca.pem"
+	defer func() {
+		kubernetesServer = ""
+		kubernetesToken = ""
+		kubernetesCAFile = ""
+	}()
+
+	config, err := getKubernetesConfig()
+	if err != nil {
+		t.Errorf("got error when getting the kubernetes config: %s", err)
+	}
+	if config.Host != "https://kubernetes" || config.BearerToken != "token" || config.TLSClientConfig.CAFile != "/etc/kubernetes/ca.pem" {
+		t.Errorf("got unexpected kubernetes config %+v", config)
+	}
+	kubernetesToken = ""
+	if _, err := getKubernetesConfig(); err == nil {
+		t.Error("expected an error without credentials but got nil")
 	}
-	err := fmt.Errorf("deployments.extensions \"%s\" not found", service)
-	return &v1beta1.Deployment{}, err
-}
 
-func (c FakeKubernetesClientConfig) updateDeployment(newDeployment *v1beta1.Deployment) (*v1beta1.Deployment, error) {
-	return newDeployment, nil
-}
+	kubernetesCertFile = "/etc/kubernetes/client.pem"
+	defer func() { kubernetesCertFile = "" }()
+	if _, err := getKubernetesConfig(); err == nil {
+		t.Error("expected an error without the client key but got nil")
+	}
 
-func (c FakeKubernetesClientConfig) getNodes(listOptions v1.ListOptions) (*v1.NodeList, error) {
-	return fakeNodeList(listOptions), nil
+	kubeconfigPath = "/nonexistent/kubeconfig"
+	defer func() { kubeconfigPath = "" }()
+	if _, err := getKubernetesConfig(); err == nil {
+		t.Error("expected an error for a missing kubeconfig but got nil")
+	}
 }
 
-func (c FakeKubernetesClientConfig) updateNode(newNode *v1.Node) (*v1.Node, error) {
-	return newNode, nil
+func TestNewClientWithoutConfig(t *testing.T) {
+	if _, err := newClient(nil); err == nil {
+		t.Error("expected error but got nil")
+	}
 }
@@ -1,10 +1,10 @@
 package main
 
-import v1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+import apps_v1 "k8s.io/api/apps/v1"
 
 type deploymentController interface {
-	getDeployment(kubernetesClient) (*v1beta1.Deployment, error)
-	updateDeployment(kubernetesClient, *v1beta1.Deployment) (*v1beta1.Deployment, error)
+	getDeployment(kubernetesClient) (*apps_v1.Deployment, error)
+	scaleDeployment(kubernetesClient, int32) (int32, error)
 }
 
 type kubernetesDeployment struct {
@@ -12,25 +12,15 @@ type kubernetesDeployment struct {
 	namespace string
 }
 
-func (k kubernetesDeployment) getDeployment(client kubernetesClient) (*v1beta1.Deployment, error) {
+func (k kubernetesDeployment) getDeployment(client kubernetesClient) (*apps_v1.Deployment, error) {
 	deploymentObject, err := client.getDeployment(k.service, k.namespace)
 	return deploymentObject, err
 }
 
-func (k kubernetesDeployment) updateDeployment(client kubernetesClient, deployment *v1beta1.Deployment) (*v1beta1.Deployment, error) {
-	deploymentObject, err := client.updateDeployment(deployment)
-	return deploymentObject, err
+func (k kubernetesDeployment) scaleDeployment(client kubernetesClient, replicaCount int32) (int32, error) {
+	return client.scaleDeployment(k.service, k.namespace, replicaCount)
 }
 
 func setReplicasForDeployment(client kubernetesClient, deploymentContoller deploymentController, replicaCount int32) (int32, error) {
-	deploymentObject, err := deploymentContoller.getDeployment(client)
-	if err != nil {
-		return replicaCount, err
-	}
-	deploymentObject.Spec.Replicas = int32p(replicaCount)
-	newDeploymentObject, err := deploymentContoller.updateDeployment(client, deploymentObject)
-	if err != nil {
-		return *deploymentObject.Spec.Replicas, err
-	}
-	return *newDeploymentObject.Spec.Replicas, nil
+	return deploymentContoller.scaleDeployment(client, replicaCount)
 }
@@ -3,6 +3,12 @@ package main
 import (
 	"fmt"
 	"testing"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8s_testing "k8s.io/client-go/testing"
 )
 
 func TestGetReplicaCount(t *testing.T) {
@@ -36,6 +42,48 @@ func TestDecreasingReplicaCount(t *testing.T) {
 	}
 }
 
+func TestSetReplicasPatchesScale(t *testing.T) {
+	clientset := newFakeClientset()
+	var patches []k8s_testing.PatchAction
+	clientset.PrependReactor("patch", "deployments", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		patches = append(patches, action.(k8s_testing.PatchAction))
+		return false, nil, nil
+	})
+	client := &kubernetesClientConfig{clientset: clientset}
+	deploymentController := kubernetesDeployment{service: "fake-service",
+		namespace: "fake-namespace"}
+
+	replicas, err := setReplicasForDeployment(client, deploymentController, int32(3))
+	if err != nil {
+		t.Errorf("got error when setting the replicas: %s", err)
+	}
+	if replicas != int32(3) {
+		t.Errorf("expected 3, got %d", replicas)
+	}
+	if len(patches) != 1 || patches[0].GetSubresource() != "scale" || patches[0].GetPatchType() != types.MergePatchType ||
+		string(patches[0].GetPatch()) != `{"spec":{"replicas":3}}` {
+		t.Errorf("expected a single merge patch of the scale subresource, got %v", patches)
+	}
+	deploymentObject, _ := deploymentController.getDeployment(client)
+	if *deploymentObject.Spec.Replicas != int32(3) {
+		t.Errorf("expected the deployment to have 3 replicas, got %d", *deploymentObject.Spec.Replicas)
+	}
+}
+
+func TestSetReplicasConflict(t *testing.T) {
+	clientset := newFakeClientset()
+	clientset.PrependReactor("patch", "deployments", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewConflict(apps_v1.Resource("deployments"), "fake-service", fmt.Errorf("the object has been modified"))
+	})
+	client := &kubernetesClientConfig{clientset: clientset}
+	deploymentController := kubernetesDeployment{service: "fake-service",
+		namespace: "fake-namespace"}
+
+	if _, err := setReplicasForDeployment(client, deploymentController, int32(3)); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
 func TestMissingService(t *testing.T) {
 	client := newFakeClient()
 	deploymentController := kubernetesDeployment{service: "missing-service",
@@ -45,8 +93,8 @@ func TestMissingService(t *testing.T) {
 		t.Error("expected error but got nil")
 	}
 	if err != nil {
-		if fmt.Sprintf("%s", err) != "deployments.extensions \"missing-service\" not found" {
-			t.Errorf("expected error \"deployments.extensions \"missing-service\" not found\","+
+		if fmt.Sprintf("%s", err) != "deployments.apps \"missing-service\" not found" {
+			t.Errorf("expected error \"deployments.apps \"missing-service\" not found\","+
 				"but got \"%s\"", err)
 		}
 	}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// How long we keep evicting the pods of the nodes being drained
+	drainTimeout = 5 * time.Minute
+	// How often we retry evictions and check whether the nodes are empty
+	drainPollInterval = 10 * time.Second
+)
+
+func isMirrorPod(pod v1.Pod) bool {
+	_, ok := pod.Annotations["kubernetes.io/config.mirror"]
+	return ok
+}
+
+// Evicts the pods running on the nodes of the given instances, except for
+// DaemonSet and mirror pods. Evictions refused because of a disruption budget
+// are retried until all the pods are gone or drainTimeout expires. The
+// instances without a node don't keep the others from being drained, and are
+// reported in the error once they are.
+func drainKubernetesNodes(client kubernetesClient, instanceList []string) error {
+	nodesController := kubernetesNodes{}
+	nodeNames := make(map[string]bool)
+
+	glog.V(4).Infof("Fetching kubernetes nodes to drain for instance IDs: %s\n", instanceList)
+	nodes, missingErr := nodesController.getNodesByInstanceID(client, instanceList)
+	if nodes == nil {
+		return fmt.Errorf("failed to drain nodes: %s", missingErr)
+	}
+	for _, node := range nodes {
+		nodeNames[node.Name] = true
+	}
+
+	start := time.Now()
+	for {
+		pods, err := client.getPods("", meta_v1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list pods: %s", err)
+		}
+
+		var remaining []string
+		for _, pod := range pods.Items {
+			if !nodeNames[pod.Spec.NodeName] || isDaemonSetPod(pod) || isMirrorPod(pod) {
+				continue
+			}
+			if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+				continue
+			}
+			remaining = append(remaining, fmt.Sprintf("%s/%s", pod.Namespace, pod.Name))
+
+			// Pods already being deleted only need to go away
+			if pod.DeletionTimestamp != nil {
+				continue
+			}
+			glog.V(4).Infof("Evicting pod %s/%s from node %s\n", pod.Namespace, pod.Name, pod.Spec.NodeName)
+			if err := client.evictPod(pod.Namespace, pod.Name); err != nil {
+				glog.V(4).Infof("Unable to evict pod %s/%s, will retry. Error: %s", pod.Namespace, pod.Name, err)
+			}
+		}
+
+		if len(remaining) == 0 {
+			if missingErr != nil {
+				return fmt.Errorf("failed to drain nodes: %s", missingErr)
+			}
+			glog.V(2).Infof("Drained kubernetes nodes for instance IDs: %s\n", instanceList)
+			return nil
+		}
+		if time.Since(start) >= drainTimeout {
+			if missingErr != nil {
+				return fmt.Errorf("timed out after %s, pods still running: %s, and %s", drainTimeout, remaining, missingErr)
+			}
+			return fmt.Errorf("timed out after %s, pods still running: %s", drainTimeout, remaining)
+		}
+
+		glog.V(4).Infof("Waiting for %d pods to leave the nodes being drained - %s", len(remaining), timeStamp())
+		if err := sleepUnlessAborted(drainPollInterval); err != nil {
+			return err
+		}
+	}
+}
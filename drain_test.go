@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDrainKubernetesNodes(t *testing.T) {
+	resetFakeWorkloads()
+	drainPollInterval = time.Millisecond
+
+	web := fakeOwnedPod("fake-service", "ReplicaSet", "web", v1.PodRunning)
+	web.Name = "web-1"
+	logs := fakeOwnedPod("fake-service", "DaemonSet", "logs", v1.PodRunning)
+	logs.Name = "logs-1"
+	other := fakeOwnedPod("other-node", "ReplicaSet", "web", v1.PodRunning)
+	other.Name = "web-2"
+	fakePodList.Items = []v1.Pod{web, logs, other}
+
+	client := newFakeClient()
+	err := drainKubernetesNodes(client, []string{"i-fake-instanceid"})
+	if err != nil {
+		t.Errorf("failed to drain nodes: %s", err)
+	}
+	pods, _ := client.getPods("", meta_v1.ListOptions{})
+	if len(pods.Items) != 2 {
+		t.Errorf("expected only the daemonset pod and the pod of the other node to be left, got %d pods", len(pods.Items))
+	}
+	for _, pod := range pods.Items {
+		if pod.Name == "web-1" {
+			t.Error("expected pod web-1 to be evicted")
+		}
+	}
+	resetFakeWorkloads()
+}
+
+func TestDrainKubernetesNodesMissingNode(t *testing.T) {
+	resetFakeWorkloads()
+	drainPollInterval = time.Millisecond
+
+	web := fakeOwnedPod("fake-service", "ReplicaSet", "web", v1.PodRunning)
+	web.Name = "web-1"
+	fakePodList.Items = []v1.Pod{web}
+
+	// An instance without a node doesn't keep the others from being drained
+	client := newFakeClient()
+	if err := drainKubernetesNodes(client, []string{"i-missing-instanceid", "i-fake-instanceid"}); err == nil {
+		t.Error("expected error but got nil")
+	}
+	pods, _ := client.getPods("", meta_v1.ListOptions{})
+	if len(pods.Items) != 0 {
+		t.Errorf("expected pod web-1 to be evicted, got %d pods", len(pods.Items))
+	}
+	resetFakeWorkloads()
+}
+
+func TestDrainKubernetesNodesTimeout(t *testing.T) {
+	resetFakeWorkloads()
+	drainPollInterval = time.Millisecond
+	drainTimeout = 5 * time.Millisecond
+	defer func() { drainTimeout = 5 * time.Minute }()
+
+	// A pod stuck terminating keeps the node from being drained
+	stuck := fakeOwnedPod("fake-service", "ReplicaSet", "web", v1.PodRunning)
+	stuck.Name = "web-1"
+	stuck.DeletionTimestamp = &meta_v1.Time{}
+	fakePodList.Items = []v1.Pod{stuck}
+
+	err := drainKubernetesNodes(newFakeClient(), []string{"i-fake-instanceid"})
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+	resetFakeWorkloads()
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+const (
+	fleetFailurePolicyStop     = "stop"
+	fleetFailurePolicyContinue = "continue"
+)
+
+var (
+	rollerClusters         = os.Getenv("ROLLER_CLUSTERS")
+	clusterDiscoveryTag    = os.Getenv("ROLLER_CLUSTER_DISCOVERY_TAG")
+	canaryCluster          = os.Getenv("ROLLER_CANARY_CLUSTER")
+	fleetParallelismStr    = os.Getenv("ROLLER_FLEET_PARALLELISM")
+	fleetFailurePolicy     = os.Getenv("ROLLER_FLEET_FAILURE_POLICY")
+	fleetEnvironmentUnsets = []string{"ROLLER_CLUSTERS", "ROLLER_CLUSTER_DISCOVERY_TAG", "ROLLER_CANARY_CLUSTER"}
+)
+
+// fleetCluster is a cluster of the fleet, with the AWS region and account it
+// lives in when they differ from those of the roller
+type fleetCluster struct {
+	name    string
+	region  string
+	account string
+}
+
+// Parses a cluster of ROLLER_CLUSTERS, given as name[:region[:account]]
+func parseFleetCluster(spec string) (*fleetCluster, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid cluster %q in ROLLER_CLUSTERS, expected name[:region[:account]]", spec)
+	}
+	c := &fleetCluster{name: parts[0]}
+	if len(parts) > 1 {
+		c.region = parts[1]
+	}
+	if len(parts) > 2 {
+		c.account = parts[2]
+	}
+	return c, nil
+}
+
+// fleetSettings controls how the clusters of a fleet are rolled
+type fleetSettings struct {
+	clusters      []*fleetCluster
+	canary        string
+	parallelism   int
+	stopOnFailure bool
+}
+
+// clusterRun tracks the roll of a single cluster of the fleet
+type clusterRun struct {
+	name   string
+	status string
+	start  time.Time
+	finish time.Time
+	err    error
+}
+
+// Returns whether the roller was asked to roll several clusters
+func fleetMode() bool {
+	return cluster == "" && (rollerClusters != "" || clusterDiscoveryTag != "")
+}
+
+func getFleetSettings(awsClient *awsClient) (*fleetSettings, error) {
+	settings := &fleetSettings{canary: canaryCluster, stopOnFailure: true}
+
+	parallelism, err := parseIntSetting("ROLLER_FLEET_PARALLELISM", fleetParallelismStr, 1)
+	if err != nil {
+		return nil, err
+	}
+	if parallelism < 1 {
+		return nil, fmt.Errorf("ROLLER_FLEET_PARALLELISM must be at least 1, got %d", parallelism)
+	}
+	settings.parallelism = parallelism
+
+	switch fleetFailurePolicy {
+	case "", fleetFailurePolicyStop:
+	case fleetFailurePolicyContinue:
+		settings.stopOnFailure = false
+	default:
+		return nil, fmt.Errorf("unknown ROLLER_FLEET_FAILURE_POLICY %q, expected one of %s or %s",
+			fleetFailurePolicy, fleetFailurePolicyStop, fleetFailurePolicyContinue)
+	}
+
+	for _, spec := range strings.Split(rollerClusters, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		c, err := parseFleetCluster(spec)
+		if err != nil {
+			return nil, err
+		}
+		settings.add(c)
+	}
+
+	if clusterDiscoveryTag != "" {
+		discovered, err := discoverClusters(awsClient, clusterDiscoveryTag)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range discovered {
+			settings.add(&fleetCluster{name: name})
+		}
+	}
+
+	if len(settings.clusters) == 0 {
+		return nil, fmt.Errorf("no cluster to roll")
+	}
+	if len(settings.clusters) > 1 && !perClusterKubernetesTarget() {
+		return nil, fmt.Errorf("rolling several clusters needs {cluster} in KUBERNETES_SERVER, or in KUBERNETES_CONTEXT with KUBECONFIG, " +
+			"otherwise every roll would cordon, drain and scale the same kubernetes cluster")
+	}
+	return settings, nil
+}
+
+// Returns whether each cluster of the fleet is reached through its own
+// kubernetes API server, {cluster} in KUBERNETES_SERVER or KUBERNETES_CONTEXT
+// being replaced by the name of the cluster
+func perClusterKubernetesTarget() bool {
+	if strings.Contains(kubernetesServer, "{cluster}") {
+		return true
+	}
+	return kubeconfigPath != "" && strings.Contains(kubernetesContext, "{cluster}")
+}
+
+// Adds a cluster to the fleet unless it is already part of it
+func (f *fleetSettings) add(c *fleetCluster) {
+	for _, existing := range f.clusters {
+		if existing.name == c.name {
+			return
+		}
+	}
+	f.clusters = append(f.clusters, c)
+}
+
+// Returns the values of the discovery tag of the running instances of the
+// region, which are the names of the clusters to roll
+func discoverClusters(awsClient *awsClient, tagKey string) ([]string, error) {
+	params := &ec2.DescribeInstancesInput{}
+	params.Filters = []*ec2.Filter{
+		awsClient.ec2.newEC2Filter("tag-key", tagKey),
+		awsClient.ec2.newEC2Filter("instance-state-name", "running"),
+	}
+	instances, err := awsClient.ec2.describeInstances(params)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to discover the clusters with tag %s\n Error: %s", tagKey, err)
+	}
+	return awsClient.ec2.getUniqueTagValues(tagKey, instances)
+}
+
+// Rolls the canary cluster first, then the other clusters with at most
+// parallelism of them at once. When a cluster fails, the clusters which are
+// not started yet are skipped if the policy says to stop, and always when the
+// failed cluster is the canary.
+func (f *fleetSettings) run(rollCluster func(c *fleetCluster) error) []*clusterRun {
+	var runs, rest []*clusterRun
+	var canary *clusterRun
+	clusters := map[string]*fleetCluster{}
+	if f.canary != "" {
+		canary = &clusterRun{name: f.canary}
+		runs = append(runs, canary)
+		clusters[f.canary] = &fleetCluster{name: f.canary}
+	}
+	for _, c := range f.clusters {
+		clusters[c.name] = c
+		if c.name != f.canary {
+			r := &clusterRun{name: c.name}
+			runs = append(runs, r)
+			rest = append(rest, r)
+		}
+	}
+
+	execute := func(r *clusterRun) {
+		r.start = time.Now()
+		r.err = rollCluster(clusters[r.name])
+		r.finish = time.Now()
+		r.status = "success"
+		if r.err != nil {
+			r.status = "failure"
+			glog.Errorf("The roll of cluster %s failed: %s", r.name, r.err)
+		}
+	}
+
+	if canary != nil {
+		glog.V(2).Infof("Rolling canary cluster %s", canary.name)
+		execute(canary)
+		if canary.err != nil {
+			for _, r := range rest {
+				r.status = "skipped"
+			}
+			return runs
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := false
+	slots := make(chan struct{}, f.parallelism)
+	for _, r := range rest {
+		slots <- struct{}{}
+		mu.Lock()
+		stop := failed && f.stopOnFailure
+		mu.Unlock()
+		if stop {
+			<-slots
+			r.status = "skipped"
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *clusterRun) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			execute(r)
+			if r.err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	return runs
+}
+
+// Returns the environment of the roller for a single cluster of the fleet
+func clusterEnvironment(c *fleetCluster) []string {
+	overrides := map[string]string{
+		"CLUSTER":           c.name,
+		"KUBERNETES_SERVER": strings.Replace(kubernetesServer, "{cluster}", c.name, -1),
+	}
+	if kubernetesContext != "" {
+		overrides["KUBERNETES_CONTEXT"] = strings.Replace(kubernetesContext, "{cluster}", c.name, -1)
+	}
+	if c.region != "" {
+		overrides["AWS_REGION"] = c.region
+	}
+	if c.account != "" {
+		overrides["AWS_ACCOUNT"] = c.account
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if _, ok := overrides[key]; ok || containsString(fleetEnvironmentUnsets, key) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for key, value := range overrides {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
+
+// How many of the last lines a failed roll writes to stderr make it into the
+// fleet summary
+const fleetSummaryTailLines = 5
+
+// prefixWriter writes each complete line it receives to out, prefixed with
+// the name of the cluster, so the logs of parallel rolls can be told apart.
+// It keeps the last keep lines for the summary.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mu     *sync.Mutex
+	buf    []byte
+	keep   int
+	last   []string
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.write(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *prefixWriter) flush() {
+	if len(w.buf) > 0 {
+		w.write(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) write(line []byte) {
+	if w.keep > 0 {
+		w.last = append(w.last, string(line))
+		if len(w.last) > w.keep {
+			w.last = w.last[len(w.last)-w.keep:]
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.out, "[%s] %s", w.prefix, line)
+}
+
+// Returns the last lines written
+func (w *prefixWriter) tail() string {
+	return strings.Join(w.last, "")
+}
+
+// fleetProcesses runs the roller of each cluster as its own process, so that
+// each cluster gets its own state, downtime and report
+type fleetProcesses struct {
+	mu      sync.Mutex
+	outMu   sync.Mutex
+	running map[string]*os.Process
+	aborted bool
+}
+
+func (p *fleetProcesses) rollCluster(c *fleetCluster) error {
+	name := c.name
+	stdout := &prefixWriter{prefix: name, out: os.Stdout, mu: &p.outMu}
+	stderr := &prefixWriter{prefix: name, out: os.Stderr, mu: &p.outMu, keep: fleetSummaryTailLines}
+	defer stdout.flush()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = clusterEnvironment(c)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	p.mu.Lock()
+	if p.aborted {
+		p.mu.Unlock()
+		return fmt.Errorf("the rolling update of the fleet was aborted")
+	}
+	err := cmd.Start()
+	if err == nil {
+		p.running[name] = cmd.Process
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Unable to start the roll of cluster %s\n Error: %s", name, err)
+	}
+
+	err = cmd.Wait()
+
+	p.mu.Lock()
+	delete(p.running, name)
+	p.mu.Unlock()
+
+	stderr.flush()
+	if err != nil && stderr.tail() != "" {
+		return fmt.Errorf("%s, last output:\n%s", err, stderr.tail())
+	}
+	return err
+}
+
+// Passes a signal on to the rolls in progress, which clean up behind them,
+// and prevents the rolls which are not started yet from starting
+func (p *fleetProcesses) signal(sig os.Signal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aborted = true
+	for name, process := range p.running {
+		glog.V(2).Infof("Passing %s on to the roll of cluster %s", sig, name)
+		if err := process.Signal(sig); err != nil {
+			glog.Errorf("Unable to signal the roll of cluster %s: %s", name, err)
+		}
+	}
+}
+
+func fleetSummary(runs []*clusterRun, startTime time.Time) (string, bool) {
+	succeeded := true
+	counts := map[string]int{}
+	var lines string
+	for _, r := range runs {
+		counts[r.status]++
+		if r.status != "success" {
+			succeeded = false
+		}
+		line := fmt.Sprintf("Cluster %s status: %s", r.name, r.status)
+		if r.status != "skipped" {
+			duration := r.finish.Sub(r.start)
+			line = line + fmt.Sprintf(" - duration: %v", duration-(duration%time.Minute))
+		}
+		lines = lines + line + "\n"
+		if r.err != nil {
+			lines = lines + fmt.Sprintf("Cluster %s error: %s\n", r.name, strings.TrimSuffix(r.err.Error(), "\n"))
+		}
+	}
+
+	status := "success"
+	if !succeeded {
+		status = "failure"
+	}
+	duration := time.Since(startTime)
+	summary := fmt.Sprintf("Finished a rolling update of %d clusters: %d succeeded, %d failed, %d skipped.\nOverall status: %s\nOverall duration: %v\n",
+		len(runs), counts["success"], counts["failure"], counts["skipped"], status, duration-(duration%time.Minute))
+	return summary + lines, succeeded
+}
+
+// Rolls each cluster of the fleet and reports the outcome of the whole fleet.
+// Exits with a non-zero status when any cluster wasn't rolled successfully.
+func rollFleet() {
+	switch {
+	case slackToken == "":
+		glog.Fatal("Set the SLACK_WEBHOOK variable to desired webhook")
+	case kubernetesServer == "" && kubeconfigPath == "":
+		glog.Fatal("Set the KUBERNETES_SERVER or KUBECONFIG variable to reach the clusters, {cluster} in KUBERNETES_SERVER and KUBERNETES_CONTEXT being replaced by the name of each cluster")
+	}
+
+	awsClient, err := newClusterAwsClient()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	settings, err := getFleetSettings(awsClient)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	startTime := time.Now()
+	var names []string
+	for _, c := range settings.clusters {
+		names = append(names, c.name)
+	}
+	err = postSlackMessage(fmt.Sprintf("Starting a rolling update of the clusters %s, canary: %q, parallelism: %d",
+		strings.Join(names, ", "), settings.canary, settings.parallelism))
+	if err != nil {
+		glog.Errorf("an error occurred posting to slack.\nError %s", err)
+	}
+
+	processes := &fleetProcesses{running: map[string]*os.Process{}}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			glog.Errorf("Received %s, aborting the rolling update of the fleet", sig)
+			processes.signal(sig)
+		}
+	}()
+
+	runs := settings.run(processes.rollCluster)
+
+	summary, succeeded := fleetSummary(runs, startTime)
+	err = postSlackMessage(summary)
+	if err != nil {
+		glog.Errorf("an error occurred posting to slack.\nError %s", err)
+	}
+	glog.V(4).Infof("Slack Post: %s", summary)
+
+	if !succeeded {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fleetClusters(names ...string) []*fleetCluster {
+	var clusters []*fleetCluster
+	for _, name := range names {
+		clusters = append(clusters, &fleetCluster{name: name})
+	}
+	return clusters
+}
+
+func TestGetFleetSettings(t *testing.T) {
+	rollerClusters = "prod-1, prod-2:us-west-2:123456789012,prod-1"
+	fleetParallelismStr = "3"
+	kubernetesServer = "https://api.{cluster}.example.com"
+	defer func() {
+		rollerClusters = ""
+		fleetParallelismStr = ""
+		kubernetesServer = ""
+	}()
+
+	settings, err := getFleetSettings(newFakeAwsClient())
+	if err != nil {
+		t.Errorf("got error when getting the fleet settings: %s", err)
+	}
+	if len(settings.clusters) != 2 || settings.clusters[0].name != "prod-1" || settings.clusters[1].name != "prod-2" {
+		t.Errorf("got unexpected clusters %+v", settings.clusters)
+	}
+	if settings.clusters[1].region != "us-west-2" || settings.clusters[1].account != "123456789012" {
+		t.Errorf("got unexpected region and account for prod-2: %+v", settings.clusters[1])
+	}
+	if settings.parallelism != 3 || !settings.stopOnFailure {
+		t.Errorf("got unexpected fleet settings: %+v", settings)
+	}
+
+	fleetFailurePolicy = "yolo"
+	defer func() { fleetFailurePolicy = "" }()
+	if _, err := getFleetSettings(newFakeAwsClient()); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	fleetFailurePolicy = ""
+	rollerClusters = "prod-1:us-west-2:123:456"
+	if _, err := getFleetSettings(newFakeAwsClient()); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestGetFleetSettingsSharedKubernetesTarget(t *testing.T) {
+	rollerClusters = "prod-1,prod-2"
+	kubernetesServer = "https://api.example.com"
+	defer func() {
+		rollerClusters = ""
+		kubernetesServer = ""
+	}()
+
+	// Every child process would drain the same kubernetes cluster
+	if _, err := getFleetSettings(newFakeAwsClient()); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	// Unless each cluster is a context of the kubeconfig
+	kubernetesServer = ""
+	kubeconfigPath = "/etc/kubernetes/kubeconfig"
+	defer func() { kubeconfigPath = "" }()
+	if _, err := getFleetSettings(newFakeAwsClient()); err == nil {
+		t.Error("expected error but got nil")
+	}
+	kubernetesContext = "{cluster}-admin"
+	defer func() { kubernetesContext = "" }()
+	if _, err := getFleetSettings(newFakeAwsClient()); err != nil {
+		t.Errorf("got error when getting the fleet settings: %s", err)
+	}
+
+	// A single cluster may share it
+	kubeconfigPath, kubernetesContext = "", ""
+	kubernetesServer = "https://api.example.com"
+	rollerClusters = "prod-1"
+	if _, err := getFleetSettings(newFakeAwsClient()); err != nil {
+		t.Errorf("got error when getting the fleet settings: %s", err)
+	}
+}
+
+func TestFleetRunCanaryFailure(t *testing.T) {
+	settings := &fleetSettings{
+		clusters:      fleetClusters("prod-1", "prod-2", "canary"),
+		canary:        "canary",
+		parallelism:   2,
+		stopOnFailure: false,
+	}
+
+	var rolled []string
+	runs := settings.run(func(c *fleetCluster) error {
+		rolled = append(rolled, c.name)
+		return fmt.Errorf("boom")
+	})
+
+	if len(rolled) != 1 || rolled[0] != "canary" {
+		t.Errorf("expected only the canary to be rolled, got %v", rolled)
+	}
+	if len(runs) != 3 || runs[0].name != "canary" || runs[0].status != "failure" {
+		t.Errorf("expected the canary to come first and fail, got %+v", runs[0])
+	}
+	for _, r := range runs[1:] {
+		if r.status != "skipped" {
+			t.Errorf("expected cluster %s to be skipped, got %s", r.name, r.status)
+		}
+	}
+}
+
+func TestFleetRunStopOnFailure(t *testing.T) {
+	settings := &fleetSettings{
+		clusters:      fleetClusters("prod-1", "prod-2", "prod-3"),
+		parallelism:   1,
+		stopOnFailure: true,
+	}
+
+	runs := settings.run(func(c *fleetCluster) error {
+		if c.name == "prod-2" {
+			return fmt.Errorf("boom")
+		}
+		return nil
+	})
+
+	expected := []string{"success", "failure", "skipped"}
+	for i, r := range runs {
+		if r.status != expected[i] {
+			t.Errorf("expected cluster %s to have status %s, got %s", r.name, expected[i], r.status)
+		}
+	}
+
+	summary, succeeded := fleetSummary(runs, runs[0].start)
+	if succeeded {
+		t.Error("expected the fleet to have failed")
+	}
+	if !strings.Contains(summary, "1 succeeded, 1 failed, 1 skipped") {
+		t.Errorf("got unexpected summary %s", summary)
+	}
+	if !strings.Contains(summary, "Cluster prod-2 error: boom\n") {
+		t.Errorf("expected the error of prod-2 in the summary, got %s", summary)
+	}
+}
+
+func TestFleetRunParallelism(t *testing.T) {
+	settings := &fleetSettings{
+		clusters:      fleetClusters("prod-1", "prod-2", "prod-3", "prod-4", "prod-5"),
+		parallelism:   2,
+		stopOnFailure: false,
+	}
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	runs := settings.run(func(c *fleetCluster) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	if peak != 2 {
+		t.Errorf("expected 2 clusters rolled at once, got %d", peak)
+	}
+	for _, r := range runs {
+		if r.status != "success" {
+			t.Errorf("expected cluster %s to succeed, got %s", r.name, r.status)
+		}
+	}
+}
+
+func TestClusterEnvironment(t *testing.T) {
+	os.Setenv("ROLLER_CLUSTERS", "prod-1,prod-2")
+	defer os.Unsetenv("ROLLER_CLUSTERS")
+	kubernetesServer = "https://api.{cluster}.example.com"
+	defer func() { kubernetesServer = "" }()
+
+	env := strings.Join(clusterEnvironment(&fleetCluster{name: "prod-2", region: "us-west-2"}), "\n")
+	if !strings.Contains(env, "CLUSTER=prod-2") || !strings.Contains(env, "KUBERNETES_SERVER=https://api.prod-2.example.com") {
+		t.Errorf("expected the cluster and its kubernetes server to be set, got %s", env)
+	}
+	if !strings.Contains(env, "AWS_REGION=us-west-2") || strings.Contains(env, "AWS_ACCOUNT=") {
+		t.Errorf("expected only the region of the cluster to be set, got %s", env)
+	}
+	if strings.Contains(env, "ROLLER_CLUSTERS=") {
+		t.Error("expected the fleet settings to be removed from the environment")
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &prefixWriter{prefix: "prod-1", out: &out, mu: &sync.Mutex{}}
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\nlast"))
+	w.flush()
+
+	expected := "[prod-1] first line\n[prod-1] second line\n[prod-1] last\n"
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+	if w.tail() != "" {
+		t.Errorf("expected no lines to be kept, got %q", w.tail())
+	}
+
+	// Only the last lines are kept for the summary
+	w = &prefixWriter{prefix: "prod-1", out: &out, mu: &sync.Mutex{}, keep: 2}
+	w.Write([]byte("first line\nsecond line\nthird"))
+	w.flush()
+	if w.tail() != "second line\nthird\n" {
+		t.Errorf("expected the last 2 lines, got %q", w.tail())
+	}
+}
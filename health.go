@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// clusterHealthGate decides whether the workloads running in the cluster are
+// healthy enough for the roller to move on to the next batch or termination.
+type clusterHealthGate struct {
+	maxPendingPods       int
+	maxCrashLoopIncrease int
+	timeout              time.Duration
+	maxPause             time.Duration
+	interval             time.Duration
+
+	// The number of pods in CrashLoopBackOff when the roll started, so we only
+	// react to spikes caused by the roll itself
+	mu                sync.Mutex
+	crashLoopBaseline int
+	baselineSet       bool
+}
+
+type clusterHealthStatus struct {
+	pendingPods          int
+	crashLoopPods        int
+	unavailableWorkloads []string
+}
+
+func newClusterHealthGate(maxPendingPods, maxCrashLoopIncrease int, timeout, maxPause time.Duration) *clusterHealthGate {
+	return &clusterHealthGate{
+		maxPendingPods:       maxPendingPods,
+		maxCrashLoopIncrease: maxCrashLoopIncrease,
+		timeout:              timeout,
+		maxPause:             maxPause,
+		interval:             30 * time.Second,
+	}
+}
+
+func getClusterHealthStatus(client kubernetesClient) (*clusterHealthStatus, error) {
+	status := &clusterHealthStatus{}
+
+	pods, err := client.getPods("", meta_v1.ListOptions{})
+	if err != nil {
+		return status, fmt.Errorf("failed to list pods: %s", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodPending {
+			status.pendingPods++
+		}
+		for _, container := range pod.Status.ContainerStatuses {
+			if container.State.Waiting != nil && container.State.Waiting.Reason == "CrashLoopBackOff" {
+				status.crashLoopPods++
+				break
+			}
+		}
+	}
+
+	deployments, err := client.getDeployments("", meta_v1.ListOptions{})
+	if err != nil {
+		return status, fmt.Errorf("failed to list deployments: %s", err)
+	}
+	for _, deployment := range deployments.Items {
+		if deployment.Spec.Replicas == nil {
+			continue
+		}
+		if deployment.Status.AvailableReplicas < *deployment.Spec.Replicas {
+			status.unavailableWorkloads = append(status.unavailableWorkloads,
+				fmt.Sprintf("deployment %s/%s (%d/%d available)", deployment.Namespace, deployment.Name,
+					deployment.Status.AvailableReplicas, *deployment.Spec.Replicas))
+		}
+	}
+
+	statefulSets, err := client.getStatefulSets("", meta_v1.ListOptions{})
+	if err != nil {
+		return status, fmt.Errorf("failed to list statefulsets: %s", err)
+	}
+	for _, statefulSet := range statefulSets.Items {
+		if statefulSet.Spec.Replicas == nil {
+			continue
+		}
+		if statefulSet.Status.ReadyReplicas < *statefulSet.Spec.Replicas {
+			status.unavailableWorkloads = append(status.unavailableWorkloads,
+				fmt.Sprintf("statefulset %s/%s (%d/%d ready)", statefulSet.Namespace, statefulSet.Name,
+					statefulSet.Status.ReadyReplicas, *statefulSet.Spec.Replicas))
+		}
+	}
+
+	return status, nil
+}
+
+// Records the number of pods in CrashLoopBackOff before the roll terminates
+// anything, so crashloops caused by the first batch count against it
+func (g *clusterHealthGate) setBaseline(client kubernetesClient) error {
+	status, err := getClusterHealthStatus(client)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.crashLoopBaseline = status.crashLoopPods
+	g.baselineSet = true
+	g.mu.Unlock()
+	return nil
+}
+
+// Returns the list of reasons why the cluster is not considered healthy. An
+// empty list means the gate is passing.
+func (g *clusterHealthGate) check(client kubernetesClient) []string {
+	var problems []string
+
+	status, err := getClusterHealthStatus(client)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+
+	// Only when the baseline couldn't be taken at the start of the roll
+	g.mu.Lock()
+	if !g.baselineSet {
+		g.crashLoopBaseline = status.crashLoopPods
+		g.baselineSet = true
+	}
+	crashLoopIncrease := status.crashLoopPods - g.crashLoopBaseline
+	g.mu.Unlock()
+
+	if status.pendingPods > g.maxPendingPods {
+		problems = append(problems, fmt.Sprintf("%d pods are pending (max %d)", status.pendingPods, g.maxPendingPods))
+	}
+	if crashLoopIncrease > g.maxCrashLoopIncrease {
+		problems = append(problems, fmt.Sprintf("%d more pods are in CrashLoopBackOff than at the start of the roll (max %d)",
+			crashLoopIncrease, g.maxCrashLoopIncrease))
+	}
+	problems = append(problems, status.unavailableWorkloads...)
+	return problems
+}
+
+// Blocks until the health gate passes. If the gate keeps failing for longer
+// than the timeout, the roll is paused and an alert is sent to slack. The
+// roll resumes if the cluster recovers, and fails once maxPause has elapsed.
+func (g *clusterHealthGate) wait(client kubernetesClient, component string) error {
+	start := time.Now()
+	paused := false
+
+	for {
+		problems := g.check(client)
+		if len(problems) == 0 {
+			if paused {
+				msg := fmt.Sprintf("Cluster %s is healthy again, resuming the roll of component %s", kubernetesCluster, component)
+				if err := postSlackMessage(msg); err != nil {
+					glog.Errorf("an error occurred posting to slack.\nError %s", err)
+				}
+			}
+			glog.V(4).Infof("Cluster health gate passed for component %s", component)
+			return nil
+		}
+
+		waited := time.Since(start)
+		if !paused && waited >= g.timeout {
+			paused = true
+			msg := fmt.Sprintf("Pausing the roll of component %s on cluster %s: workloads have been unhealthy for %v.\n%s",
+				component, kubernetesCluster, waited-(waited%time.Second), problems)
+			glog.Error(msg)
+			if err := postSlackMessage(msg); err != nil {
+				glog.Errorf("an error occurred posting to slack.\nError %s", err)
+			}
+		}
+		if paused && g.maxPause > 0 && waited >= g.timeout+g.maxPause {
+			return fmt.Errorf("cluster workloads still unhealthy after %v: %s", waited-(waited%time.Second), problems)
+		}
+
+		glog.Infof("Waiting for cluster health gate for component %s - %s: %s\n", component, timeStamp(), problems)
+		if err := sleepUnlessAborted(g.interval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8s_testing "k8s.io/client-go/testing"
+)
+
+func fakePod(phase v1.PodPhase, waitingReason string) v1.Pod {
+	pod := v1.Pod{
+		Status: v1.PodStatus{
+			Phase: phase,
+		},
+	}
+	if waitingReason != "" {
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{
+			{
+				State: v1.ContainerState{
+					Waiting: &v1.ContainerStateWaiting{Reason: waitingReason},
+				},
+			},
+		}
+	}
+	return pod
+}
+
+func resetFakeWorkloads() {
+	fakePodList = &v1.PodList{}
+	fakeDeploymentList = &apps_v1.DeploymentList{}
+	fakeStatefulSetList = &apps_v1.StatefulSetList{}
+}
+
+func TestClusterHealthGate_Healthy(t *testing.T) {
+	resetFakeWorkloads()
+	fakePodList.Items = []v1.Pod{
+		fakePod(v1.PodRunning, ""),
+		fakePod(v1.PodPending, ""),
+	}
+	fakeDeploymentList.Items = []apps_v1.Deployment{
+		{
+			Spec:   apps_v1.DeploymentSpec{Replicas: int32p(2)},
+			Status: apps_v1.DeploymentStatus{AvailableReplicas: 2},
+		},
+	}
+
+	gate := newClusterHealthGate(1, 0, time.Minute, time.Minute)
+	problems := gate.check(newFakeClient())
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %s", problems)
+	}
+}
+
+func TestClusterHealthGate_TooManyPending(t *testing.T) {
+	resetFakeWorkloads()
+	fakePodList.Items = []v1.Pod{
+		fakePod(v1.PodPending, ""),
+		fakePod(v1.PodPending, ""),
+	}
+
+	gate := newClusterHealthGate(1, 0, time.Minute, time.Minute)
+	problems := gate.check(newFakeClient())
+	if len(problems) != 1 {
+		t.Errorf("expected 1 problem, got %s", problems)
+	}
+}
+
+func TestClusterHealthGate_UnavailableWorkloads(t *testing.T) {
+	resetFakeWorkloads()
+	fakeDeploymentList.Items = []apps_v1.Deployment{
+		{
+			Spec:   apps_v1.DeploymentSpec{Replicas: int32p(3)},
+			Status: apps_v1.DeploymentStatus{AvailableReplicas: 1},
+		},
+	}
+	fakeStatefulSetList.Items = []apps_v1.StatefulSet{
+		{
+			Spec:   apps_v1.StatefulSetSpec{Replicas: int32p(3)},
+			Status: apps_v1.StatefulSetStatus{ReadyReplicas: 2},
+		},
+	}
+
+	gate := newClusterHealthGate(0, 0, time.Minute, time.Minute)
+	problems := gate.check(newFakeClient())
+	if len(problems) != 2 {
+		t.Errorf("expected 2 problems, got %s", problems)
+	}
+}
+
+func TestClusterHealthGate_CrashLoopSpike(t *testing.T) {
+	resetFakeWorkloads()
+	fakePodList.Items = []v1.Pod{
+		fakePod(v1.PodRunning, "CrashLoopBackOff"),
+	}
+
+	gate := newClusterHealthGate(0, 1, time.Minute, time.Minute)
+	if err := gate.setBaseline(newFakeClient()); err != nil {
+		t.Fatalf("failed to set the baseline: %s", err)
+	}
+
+	// Pods already crashing at the start of the roll are not held against it
+	problems := gate.check(newFakeClient())
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %s", problems)
+	}
+
+	fakePodList.Items = append(fakePodList.Items,
+		fakePod(v1.PodRunning, "CrashLoopBackOff"),
+		fakePod(v1.PodRunning, "CrashLoopBackOff"),
+	)
+	problems = gate.check(newFakeClient())
+	if len(problems) != 1 {
+		t.Errorf("expected 1 problem, got %s", problems)
+	}
+	resetFakeWorkloads()
+}
+
+func TestClusterHealthGate_BaselineBeforeFirstCheck(t *testing.T) {
+	resetFakeWorkloads()
+	gate := newClusterHealthGate(0, 0, time.Minute, time.Minute)
+	if err := gate.setBaseline(newFakeClient()); err != nil {
+		t.Fatalf("failed to set the baseline: %s", err)
+	}
+
+	// Crashloops caused by the first batch show up on the first check
+	fakePodList.Items = []v1.Pod{
+		fakePod(v1.PodRunning, "CrashLoopBackOff"),
+	}
+	problems := gate.check(newFakeClient())
+	if len(problems) != 1 {
+		t.Errorf("expected 1 problem, got %s", problems)
+	}
+	resetFakeWorkloads()
+}
+
+// Captures the messages posted to slack until the returned function is called
+func fakeSlack() (*[]string, func()) {
+	var mu sync.Mutex
+	messages := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg slackMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		mu.Lock()
+		messages = append(messages, msg.Text)
+		mu.Unlock()
+	}))
+	previous := slackToken
+	slackToken = server.URL
+	return &messages, func() {
+		server.Close()
+		slackToken = previous
+	}
+}
+
+func TestClusterHealthGate_WaitPausesAndResumes(t *testing.T) {
+	resetFakeWorkloads()
+	messages, done := fakeSlack()
+	defer done()
+
+	fakePodList.Items = []v1.Pod{fakePod(v1.PodPending, "")}
+	clientset := newFakeClientset()
+	client := &kubernetesClientConfig{clientset: clientset}
+	gate := newClusterHealthGate(0, 0, 0, time.Minute)
+	gate.interval = time.Millisecond
+
+	// The pending pod goes away once the roll is paused
+	checks := 0
+	clientset.PrependReactor("list", "pods", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		checks++
+		if checks < 3 {
+			return false, nil, nil
+		}
+		return true, &v1.PodList{}, nil
+	})
+
+	if err := gate.wait(client, "k8s-node"); err != nil {
+		t.Errorf("expected the gate to pass once the cluster recovered, got %s", err)
+	}
+	if len(*messages) != 2 || !strings.HasPrefix((*messages)[0], "Pausing the roll") ||
+		!strings.Contains((*messages)[1], "healthy again") {
+		t.Errorf("expected a pause and a resume alert, got %q", *messages)
+	}
+	resetFakeWorkloads()
+}
+
+func TestClusterHealthGate_WaitTimeout(t *testing.T) {
+	resetFakeWorkloads()
+	messages, done := fakeSlack()
+	defer done()
+
+	fakePodList.Items = []v1.Pod{fakePod(v1.PodPending, "")}
+	gate := newClusterHealthGate(0, 0, time.Millisecond, 5*time.Millisecond)
+	gate.interval = time.Millisecond
+
+	err := gate.wait(newFakeClient(), "k8s-node")
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+	if len(*messages) != 1 || !strings.HasPrefix((*messages)[0], "Pausing the roll") {
+		t.Errorf("expected a single pause alert, got %q", *messages)
+	}
+	resetFakeWorkloads()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/golang/glog"
+)
+
+var (
+	// How often we check on the instance refreshes in progress
+	instanceRefreshPollInterval = 30 * time.Second
+
+	// The instance refreshes in progress, by ASG, so they can be cancelled when the roller is aborted
+	activeInstanceRefreshes     = make(map[string]string)
+	activeInstanceRefreshesLock sync.Mutex
+)
+
+// Replaces the instances of a component with the native instance refresh of EC2 Auto Scaling, one ASG at a
+// time. A terminating lifecycle hook holds each old instance until the roller has cordoned and drained its
+// node behind the cluster health gate. Note that a refresh replaces every instance of the ASG.
+func replaceInstancesWithInstanceRefresh(awsClient *awsClient, component, ansibleVersion string, settings *instanceRefreshSettings, wg *sync.WaitGroup) error {
+	glog.V(4).Infof("Starting process to refresh the instances of %s", component)
+
+	defer wg.Done()
+
+	// The refresh needs the Launch and Terminate processes
+	scalingProcesses := []*string{
+		aws.String("AZRebalance"),
+	}
+	myComponent, _, err := replaceInstancesPrepare(awsClient, component, scalingProcesses)
+
+	// Whatever happens next, put the ASGs back the way we found them
+	defer restoreASGs(awsClient, myComponent)
+
+	if err != nil {
+		err = fmt.Errorf("an error occurred while preparing for instance replacement for %s\n Error: %s", myComponent.name, err)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+
+	// The refresh relies on the terminating hook to drain the old nodes, if the component has any
+	err = addLifecycleHooks(awsClient, myComponent, lifecycleHooksEnabled(component))
+	if err != nil {
+		myComponent.err = err
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+
+	addASGsToComponent(awsClient, myComponent)
+	for _, myASG := range myComponent.asgStatus {
+		err = refreshASGInstances(awsClient, myComponent, myASG, ansibleVersion, settings)
+		if err != nil {
+			myASG.err = err
+			myComponent.err = err
+			return err
+		}
+		myASG.status = true
+	}
+
+	myComponent.status = true
+	myComponent.finish = time.Now()
+
+	glog.V(4).Infof("Completed instance refresh for component %s", myComponent.name)
+	return nil
+}
+
+func refreshASGInstances(awsClient *awsClient, myComponent *componentType, myASG *asgType, ansibleVersion string, settings *instanceRefreshSettings) error {
+	count, err := awsClient.autoscaling.getDesiredCount(myASG.name)
+	if err != nil {
+		err = fmt.Errorf("got error when trying to get the desired count for ASG %s: %s. ", myASG.name, err)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+	myASG.desiredCount = int(count)
+
+	startTime := time.Now()
+	instanceRefreshID, err := awsClient.autoscaling.startInstanceRefresh(myASG.name, settings.minHealthyPercentage,
+		settings.instanceWarmup, settings.checkpoints, settings.checkpointDelay)
+	if err != nil {
+		err = fmt.Errorf("an error occurred starting an instance refresh on ASG %s\n Error: %s", myASG.name, err)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+	glog.V(2).Infof("Started instance refresh %s on ASG %s", instanceRefreshID, myASG.name)
+
+	activeInstanceRefreshesLock.Lock()
+	activeInstanceRefreshes[myASG.name] = instanceRefreshID
+	activeInstanceRefreshesLock.Unlock()
+	defer func() {
+		activeInstanceRefreshesLock.Lock()
+		delete(activeInstanceRefreshes, myASG.name)
+		activeInstanceRefreshesLock.Unlock()
+	}()
+
+	kubernetesClient, err := newClient(kubernetesConfig)
+	if err != nil {
+		return err
+	}
+	handled := make(map[string]bool)
+	// The refresh replaces all the instances of the ASG, not only those we
+	// selected, and counts down the ones it has left to replace
+	toUpdate := 0
+
+	for {
+		if myComponent.hasLifecycleHook(drainLifecycleHookName) {
+			err = completeTerminatingInstances(awsClient, kubernetesClient, myComponent, myASG.name, handled)
+			if err != nil {
+				cancelInstanceRefresh(awsClient, myASG.name)
+				return err
+			}
+		}
+		if myComponent.hasLifecycleHook(verifyLifecycleHookName) {
+			err = completeLaunchingInstances(awsClient, myComponent, myASG.name)
+			if err != nil {
+				cancelInstanceRefresh(awsClient, myASG.name)
+				return err
+			}
+		}
+
+		instanceRefresh, err := awsClient.autoscaling.getInstanceRefresh(myASG.name, instanceRefreshID)
+		if err != nil {
+			cancelInstanceRefresh(awsClient, myASG.name)
+			return fmt.Errorf("an error occurred describing instance refresh %s on ASG %s\n Error: %s", instanceRefreshID, myASG.name, err)
+		}
+
+		remaining := int(aws.Int64Value(instanceRefresh.InstancesToUpdate))
+		if remaining > toUpdate {
+			toUpdate = remaining
+		}
+		myASG.replaced = toUpdate - remaining
+
+		status := aws.StringValue(instanceRefresh.Status)
+		if status == "Successful" {
+			break
+		}
+		if status != "Pending" && status != "InProgress" && status != "Cancelling" {
+			return fmt.Errorf("instance refresh %s on ASG %s ended with status %s: %s", instanceRefreshID, myASG.name,
+				status, aws.StringValue(instanceRefresh.StatusReason))
+		}
+
+		if time.Since(startTime) > settings.timeout {
+			cancelInstanceRefresh(awsClient, myASG.name)
+			return fmt.Errorf("timed out after %s waiting for instance refresh %s on ASG %s", settings.timeout, instanceRefreshID, myASG.name)
+		}
+
+		glog.Infof("Instance refresh %s on ASG %s is %s, %d%% complete - %s\n", instanceRefreshID, myASG.name, status,
+			aws.Int64Value(instanceRefresh.PercentageComplete), timeStamp())
+		if err = sleepUnlessAborted(instanceRefreshPollInterval); err != nil {
+			cancelInstanceRefresh(awsClient, myASG.name)
+			return err
+		}
+	}
+
+	// Verify the instances launched by the refresh are valid
+	_, err = findAndVerifyReplacementInstances(awsClient, myComponent, myASG.name, ansibleVersion, myASG.desiredCount, startTime)
+	if err != nil {
+		return err
+	}
+	if toUpdate > 0 {
+		myASG.replaced = toUpdate
+	} else {
+		myASG.replaced = myASG.desiredCount
+	}
+
+	glog.V(2).Infof("Instance refresh %s on ASG %s is complete", instanceRefreshID, myASG.name)
+	return nil
+}
+
+func cancelInstanceRefresh(awsClient *awsClient, asg string) {
+	glog.V(2).Infof("Cancelling the instance refresh on ASG %s", asg)
+	_, err := awsClient.autoscaling.cancelInstanceRefresh(asg)
+	if err != nil {
+		glog.Errorf("an error occurred cancelling the instance refresh on ASG %s\n Error: %s", asg, err)
+	}
+}
+
+// Cancels all the instance refreshes in progress, used when the roller is aborted
+func cancelActiveInstanceRefreshes(awsClient *awsClient) {
+	activeInstanceRefreshesLock.Lock()
+	defer activeInstanceRefreshesLock.Unlock()
+	for asg := range activeInstanceRefreshes {
+		cancelInstanceRefresh(awsClient, asg)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestRefreshASGInstances(t *testing.T) {
+	asg := "infra-k8s-worker"
+	myComponent, restore := setFakeCluster(t, map[string]int{asg: 2})
+	defer restore()
+	defer func(interval time.Duration) { instanceRefreshPollInterval = interval }(instanceRefreshPollInterval)
+	instanceRefreshPollInterval = 0
+	fakeStartedInstanceRefreshes, fakeCancelledInstanceRefreshes, fakeCompletedLifecycleActions = nil, nil, nil
+
+	// The refresh holds the first old instance in our terminating hook, and has already launched the new ones
+	myComponent.lifecycleHooks = []string{drainLifecycleHookName}
+	group := fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups[0]
+	group.Instances[0].LifecycleState = aws.String("Terminating:Wait")
+	for _, instanceID := range []string{"i-new-0", "i-new-1"} {
+		fakeEc2Instances = append(fakeEc2Instances, &ec2.Instance{
+			InstanceId: aws.String(instanceID),
+			LaunchTime: aws.Time(time.Now().Add(time.Hour)),
+			Tags: []*ec2.Tag{
+				fakeClusterTag(),
+				{Key: aws.String(tags.componentKey), Value: aws.String(myComponent.name)},
+				{Key: aws.String(tags.asgKey), Value: aws.String(asg)},
+				{Key: aws.String(tags.healthKey), Value: aws.String(tags.healthyValue)},
+			},
+		})
+	}
+	fakeInstanceRefreshes = []*autoscaling.InstanceRefresh{
+		{Status: aws.String("Pending"), InstancesToUpdate: aws.Int64(2)},
+		{Status: aws.String("InProgress"), InstancesToUpdate: aws.Int64(1)},
+		{Status: aws.String("Successful"), InstancesToUpdate: aws.Int64(0)},
+	}
+	defer func() { fakeInstanceRefreshes = nil }()
+
+	// Only one of the instances was selected, but the refresh replaces both
+	myASG := &asgType{name: asg, instances: []string{"i-infra-k8s-worker-old-0"}}
+	settings := &instanceRefreshSettings{minHealthyPercentage: 90, timeout: time.Minute}
+	err := refreshASGInstances(newFakeAwsClient(), myComponent, myASG, "new", settings)
+	if err != nil {
+		t.Fatalf("got error when refreshing the instances: %s", err)
+	}
+
+	if len(fakeStartedInstanceRefreshes) != 1 || *fakeStartedInstanceRefreshes[0].AutoScalingGroupName != asg {
+		t.Errorf("expected a single instance refresh started on %s, got %v", asg, fakeStartedInstanceRefreshes)
+	}
+	if *fakeStartedInstanceRefreshes[0].Preferences.MinHealthyPercentage != 90 {
+		t.Errorf("expected a min healthy percentage of 90, got %d", *fakeStartedInstanceRefreshes[0].Preferences.MinHealthyPercentage)
+	}
+	if len(fakeCompletedLifecycleActions) != 1 || *fakeCompletedLifecycleActions[0].InstanceId != "i-infra-k8s-worker-old-0" {
+		t.Errorf("expected the terminating instance to be drained and let go once, got %v", fakeCompletedLifecycleActions)
+	}
+	if myASG.desiredCount != 2 || myASG.replaced != 2 {
+		t.Errorf("expected 2 of 2 instances replaced, got %d of %d", myASG.replaced, myASG.desiredCount)
+	}
+	if len(fakeCancelledInstanceRefreshes) != 0 {
+		t.Errorf("expected the instance refresh not to be cancelled, got %v", fakeCancelledInstanceRefreshes)
+	}
+	if len(activeInstanceRefreshes) != 0 {
+		t.Errorf("expected no active instance refresh left, got %v", activeInstanceRefreshes)
+	}
+}
+
+func TestRefreshASGInstancesCancelsOnFailure(t *testing.T) {
+	asg := "infra-k8s-worker"
+	myComponent, restore := setFakeCluster(t, map[string]int{asg: 2})
+	defer restore()
+	defer func(interval time.Duration) { instanceRefreshPollInterval = interval }(instanceRefreshPollInterval)
+	instanceRefreshPollInterval = 0
+	fakeStartedInstanceRefreshes, fakeCancelledInstanceRefreshes = nil, nil
+	defer func() { fakeInstanceRefreshes = nil }()
+
+	// A refresh which never completes is cancelled once it times out
+	fakeInstanceRefreshes = []*autoscaling.InstanceRefresh{
+		{Status: aws.String("InProgress"), InstancesToUpdate: aws.Int64(2)},
+		{Status: aws.String("InProgress"), InstancesToUpdate: aws.Int64(1)},
+	}
+	myASG := &asgType{name: asg}
+	err := refreshASGInstances(newFakeAwsClient(), myComponent, myASG, "new", &instanceRefreshSettings{timeout: 10 * time.Millisecond})
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+	if len(fakeCancelledInstanceRefreshes) != 1 || *fakeCancelledInstanceRefreshes[0].AutoScalingGroupName != asg {
+		t.Errorf("expected the instance refresh on %s to be cancelled, got %v", asg, fakeCancelledInstanceRefreshes)
+	}
+	if myASG.replaced != 1 {
+		t.Errorf("expected the progress of the refresh to be tracked, got %d replaced", myASG.replaced)
+	}
+
+	// So is a refresh we lose track of
+	fakeInstanceRefreshes, fakeCancelledInstanceRefreshes = nil, nil
+	fakeDescribeInstanceRefreshesOutput = &autoscaling.DescribeInstanceRefreshesOutput{}
+	err = refreshASGInstances(newFakeAwsClient(), myComponent, &asgType{name: asg}, "new", &instanceRefreshSettings{timeout: time.Minute})
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+	if len(fakeCancelledInstanceRefreshes) != 1 {
+		t.Errorf("expected the instance refresh to be cancelled, got %v", fakeCancelledInstanceRefreshes)
+	}
+
+	// A refresh which failed on its own is not
+	fakeInstanceRefreshes, fakeCancelledInstanceRefreshes = []*autoscaling.InstanceRefresh{
+		{Status: aws.String("Failed"), StatusReason: aws.String("instances failed to launch")},
+	}, nil
+	err = refreshASGInstances(newFakeAwsClient(), myComponent, &asgType{name: asg}, "new", &instanceRefreshSettings{timeout: time.Minute})
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+	if len(fakeCancelledInstanceRefreshes) != 0 {
+		t.Errorf("expected the failed instance refresh not to be cancelled, got %v", fakeCancelledInstanceRefreshes)
+	}
+	if len(activeInstanceRefreshes) != 0 {
+		t.Errorf("expected no active instance refresh left, got %v", activeInstanceRefreshes)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// inventoryInstance is an instance of the cluster along with its kubernetes node
+type inventoryInstance struct {
+	InstanceID       string    `json:"instance_id"`
+	Component        string    `json:"component"`
+	ASG              string    `json:"asg"`
+	Version          string    `json:"version"`
+	Health           string    `json:"health"`
+	LaunchTime       time.Time `json:"launch_time"`
+	AvailabilityZone string    `json:"availability_zone"`
+	InstanceType     string    `json:"instance_type"`
+	NodeName         string    `json:"node_name"`
+	NodeStatus       string    `json:"node_status"`
+}
+
+// inventorySnapshot is the inventory of a cluster at a point in time
+type inventorySnapshot struct {
+	Cluster   string               `json:"cluster"`
+	Time      time.Time            `json:"time"`
+	Instances []*inventoryInstance `json:"instances"`
+}
+
+type byComponentAndASG []*inventoryInstance
+
+func (a byComponentAndASG) Len() int      { return len(a) }
+func (a byComponentAndASG) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byComponentAndASG) Less(i, j int) bool {
+	if a[i].Component != a[j].Component {
+		return a[i].Component < a[j].Component
+	}
+	if a[i].ASG != a[j].ASG {
+		return a[i].ASG < a[j].ASG
+	}
+	return a[i].InstanceID < a[j].InstanceID
+}
+
+// Returns the running instances of the cluster
+func describeClusterInstances(awsClient *awsClient) ([]*ec2.Instance, error) {
+	params := &ec2.DescribeInstancesInput{}
+	params.Filters = []*ec2.Filter{
+		tags.clusterFilter(),
+		awsClient.ec2.newEC2Filter("instance-state-name", "running"),
+	}
+	return awsClient.ec2.describeInstances(params)
+}
+
+// Returns the status of a node the way kubectl shows it
+func nodeStatus(node v1.Node) string {
+	status := "NotReady"
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady && condition.Status == v1.ConditionTrue {
+			status = "Ready"
+		}
+	}
+	if node.Spec.Unschedulable {
+		status = status + ",SchedulingDisabled"
+	}
+	return status
+}
+
+// Builds the inventory of the instances of the cluster, matching them with
+// their kubernetes nodes
+func buildInventory(awsClient *awsClient, instances []*ec2.Instance, nodes []v1.Node, components []string) *inventorySnapshot {
+	nodesByInstance := make(map[string]v1.Node)
+	for _, node := range nodes {
+		if instanceID := nodeInstanceID(node); instanceID != "" {
+			nodesByInstance[instanceID] = node
+		}
+	}
+
+	snapshot := &inventorySnapshot{Cluster: kubernetesCluster, Time: time.Now().UTC()}
+	for _, instance := range instances {
+		item := &inventoryInstance{
+			InstanceID:   aws.StringValue(instance.InstanceId),
+			Component:    "unknown",
+			ASG:          awsClient.ec2.getTagValue(instance, tags.asgKey),
+			Version:      awsClient.ec2.getTagValue(instance, tags.versionKey),
+			Health:       awsClient.ec2.getTagValue(instance, tags.healthKey),
+			LaunchTime:   aws.TimeValue(instance.LaunchTime).UTC(),
+			InstanceType: aws.StringValue(instance.InstanceType),
+		}
+		if instance.Placement != nil {
+			item.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+		}
+		for _, component := range components {
+			if tags.isComponent(instance, component) {
+				item.Component = component
+				break
+			}
+		}
+		if node, ok := nodesByInstance[item.InstanceID]; ok {
+			item.NodeName = node.Name
+			item.NodeStatus = nodeStatus(node)
+		}
+		snapshot.Instances = append(snapshot.Instances, item)
+	}
+	sort.Sort(byComponentAndASG(snapshot.Instances))
+	return snapshot
+}
+
+func inventoryRow(i *inventoryInstance) []string {
+	return []string{
+		i.Component, i.ASG, i.InstanceID, i.Version, i.Health, i.LaunchTime.Format(time.RFC3339),
+		i.AvailabilityZone, i.InstanceType, i.NodeName, i.NodeStatus,
+	}
+}
+
+var inventoryHeader = []string{
+	"COMPONENT", "ASG", "INSTANCE", "VERSION", "HEALTH", "LAUNCH TIME",
+	"AZ", "TYPE", "NODE", "NODE STATUS",
+}
+
+// Writes the inventory as a table, JSON or CSV
+func (s *inventorySnapshot) write(out io.Writer, format string) error {
+	switch format {
+	case "table":
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(inventoryHeader, "\t"))
+		for _, i := range s.Instances {
+			fmt.Fprintln(w, strings.Join(inventoryRow(i), "\t"))
+		}
+		return w.Flush()
+	case "json":
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write(inventoryHeader)
+		for _, i := range s.Instances {
+			w.Write(inventoryRow(i))
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fmt.Errorf("unknown output format %q, expected one of table, json or csv", format)
+}
+
+func readInventorySnapshot(path string) (*inventorySnapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &inventorySnapshot{}
+	if err := json.Unmarshal(b, snapshot); err != nil {
+		return nil, fmt.Errorf("unable to parse the inventory snapshot %s: %s", path, err)
+	}
+	return snapshot, nil
+}
+
+// Returns the differences between two snapshots: the instances which were
+// added or removed, and the fields which changed on the others
+func diffInventories(before, after *inventorySnapshot) []string {
+	var diff []string
+	describe := func(i *inventoryInstance) string {
+		return fmt.Sprintf("%s %s %s version=%s health=%s node=%s", i.InstanceID, i.Component, i.ASG, i.Version, i.Health, i.NodeName)
+	}
+
+	previous := make(map[string]*inventoryInstance)
+	for _, i := range before.Instances {
+		previous[i.InstanceID] = i
+	}
+	current := make(map[string]*inventoryInstance)
+	for _, i := range after.Instances {
+		current[i.InstanceID] = i
+	}
+
+	for _, i := range before.Instances {
+		if _, ok := current[i.InstanceID]; !ok {
+			diff = append(diff, "- "+describe(i))
+		}
+	}
+	for _, i := range after.Instances {
+		old, ok := previous[i.InstanceID]
+		if !ok {
+			diff = append(diff, "+ "+describe(i))
+			continue
+		}
+		oldRow, newRow := inventoryRow(old), inventoryRow(i)
+		var changes []string
+		for f := range newRow {
+			if oldRow[f] != newRow[f] {
+				changes = append(changes, fmt.Sprintf("%s: %q -> %q", strings.ToLower(inventoryHeader[f]), oldRow[f], newRow[f]))
+			}
+		}
+		if len(changes) > 0 {
+			diff = append(diff, fmt.Sprintf("~ %s %s", i.InstanceID, strings.Join(changes, ", ")))
+		}
+	}
+	return diff
+}
+
+// Runs the inventory command, which prints the inventory of the cluster or,
+// with -diff, the differences between two saved JSON snapshots
+func runInventory(args []string) {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	format := flags.String("output", "table", "output format: table, json or csv")
+	diff := flags.Bool("diff", false, "compare the two JSON snapshots given as arguments")
+	flags.Parse(args)
+
+	if *diff {
+		if flags.NArg() != 2 {
+			glog.Fatal("Usage: roller inventory -diff <before.json> <after.json>")
+		}
+		before, err := readInventorySnapshot(flags.Arg(0))
+		if err != nil {
+			glog.Fatal(err)
+		}
+		after, err := readInventorySnapshot(flags.Arg(1))
+		if err != nil {
+			glog.Fatal(err)
+		}
+		changes := diffInventories(before, after)
+		fmt.Printf("Changes to cluster %s between %s and %s: %d\n", after.Cluster,
+			before.Time.Format(time.RFC3339), after.Time.Format(time.RFC3339), len(changes))
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		return
+	}
+
+	switch {
+	case cluster == "":
+		glog.Fatal("Set the CLUSTER variable to the name of the target kubernetes cluster")
+	case awsRegion == "":
+		glog.Fatal("Set the AWS_REGION variable to the name of the desired AWS region")
+	case awsAccount == "" && awsProfile == "":
+		glog.Fatal("Set one of the variables AWS_ACCOUNT or AWS_PROFILE")
+	}
+
+	awsClient, err := newClusterAwsClient()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	instances, err := describeClusterInstances(awsClient)
+	if err != nil {
+		glog.Fatalf("An error occurred getting the EC2 inventory: %s.\n", err)
+	}
+
+	// The nodes are only listed when the cluster can be reached
+	var nodes []v1.Node
+	var nodeList *v1.NodeList
+	client, err := newClient(kubernetesConfig)
+	if err == nil {
+		nodeList, err = client.getNodes(meta_v1.ListOptions{})
+	}
+	if err != nil {
+		glog.Errorf("an error occurred listing the kubernetes nodes.\nError %s", err)
+	} else {
+		nodes = nodeList.Items
+	}
+
+	components := defaultComponents
+	if rollerComponents != "" {
+		components = strings.Split(rollerComponents, ",")
+	}
+	snapshot := buildInventory(awsClient, instances, nodes, components)
+	if err := snapshot.write(os.Stdout, *format); err != nil {
+		glog.Fatal(err)
+	}
+}
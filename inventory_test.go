@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"k8s.io/api/core/v1"
+)
+
+func fakeInventoryInstance(id, component, version, health string) *ec2.Instance {
+	return &ec2.Instance{
+		InstanceId:   aws.String(id),
+		InstanceType: aws.String("m5.large"),
+		LaunchTime:   aws.Time(time.Date(2018, 1, 12, 9, 0, 0, 0, time.UTC)),
+		Placement:    &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("ServiceComponent"), Value: aws.String(component)},
+			{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String(component + "-asg")},
+			{Key: aws.String("version"), Value: aws.String(version)},
+			{Key: aws.String("healthy"), Value: aws.String(health)},
+		},
+	}
+}
+
+func TestBuildInventory(t *testing.T) {
+	instances := []*ec2.Instance{
+		fakeInventoryInstance("i-2", "k8s-node", "abc", "True"),
+		fakeInventoryInstance("i-1", "etcd", "abc", "True"),
+	}
+	node := v1.Node{}
+	node.Name = "ip-10-0-0-1"
+	node.Labels = map[string]string{"instance-id": "i-2"}
+	node.Spec.Unschedulable = true
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	snapshot := buildInventory(newFakeAwsClient(), instances, []v1.Node{node}, defaultComponents)
+	if len(snapshot.Instances) != 2 || snapshot.Instances[0].InstanceID != "i-1" {
+		t.Errorf("expected the instances to be sorted by component, got %+v", snapshot.Instances)
+	}
+	nodeInstance := snapshot.Instances[1]
+	if nodeInstance.Component != "k8s-node" || nodeInstance.ASG != "k8s-node-asg" || nodeInstance.AvailabilityZone != "us-east-1a" {
+		t.Errorf("got unexpected inventory instance %+v", nodeInstance)
+	}
+	if nodeInstance.NodeName != "ip-10-0-0-1" || nodeInstance.NodeStatus != "Ready,SchedulingDisabled" {
+		t.Errorf("got unexpected node %s with status %s", nodeInstance.NodeName, nodeInstance.NodeStatus)
+	}
+
+	var out bytes.Buffer
+	if err := snapshot.write(&out, "json"); err != nil {
+		t.Errorf("got error when writing the inventory as json: %s", err)
+	}
+	decoded := &inventorySnapshot{}
+	if err := json.Unmarshal(out.Bytes(), decoded); err != nil || len(decoded.Instances) != 2 {
+		t.Errorf("expected the json inventory to be read back, got %s", err)
+	}
+
+	out.Reset()
+	if err := snapshot.write(&out, "csv"); err != nil {
+		t.Errorf("got error when writing the inventory as csv: %s", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 {
+		t.Errorf("expected a header and 2 csv lines, got %d", len(lines))
+	}
+
+	if err := snapshot.write(&out, "yaml"); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestDiffInventories(t *testing.T) {
+	before := &inventorySnapshot{Instances: []*inventoryInstance{
+		{InstanceID: "i-1", Component: "k8s-node", Version: "abc", Health: "True"},
+		{InstanceID: "i-2", Component: "k8s-node", Version: "abc", Health: "True"},
+	}}
+	after := &inventorySnapshot{Instances: []*inventoryInstance{
+		{InstanceID: "i-2", Component: "k8s-node", Version: "abc", Health: "False"},
+		{InstanceID: "i-3", Component: "k8s-node", Version: "def", Health: "True"},
+	}}
+
+	diff := diffInventories(before, after)
+	if len(diff) != 3 {
+		t.Errorf("expected 3 changes, got %v", diff)
+	}
+	if !strings.HasPrefix(diff[0], "- i-1") || !strings.HasPrefix(diff[2], "+ i-3") {
+		t.Errorf("expected i-1 to be removed and i-3 added, got %v", diff)
+	}
+	if diff[1] != `~ i-2 health: "True" -> "False"` {
+		t.Errorf("got unexpected change %s", diff[1])
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/glog"
+)
+
+// asgJournal records the changes the roller makes to the ASGs of a component, so that they can all be
+// reversed when the roll of the component ends, whichever way it ends.
+type asgJournal struct {
+	mu   sync.Mutex
+	asgs map[string]*asgRecord
+	// The ASGs in the order we first changed them
+	order []string
+}
+
+// asgRecord is what an ASG looked like before the roller changed it
+type asgRecord struct {
+	desiredCount *int64
+	maxSize      *int64
+	// The comma-separated subnets of the ASG
+	subnets *string
+	// The launch template of the mixed instances policy of the ASG, with its instance type overrides
+	launchTemplate *autoscaling.LaunchTemplate
+	// The processes we suspended and haven't resumed yet
+	suspended map[string]bool
+	// The lifecycle hooks we added and haven't removed yet
+	hooks []string
+}
+
+func newASGJournal() *asgJournal {
+	return &asgJournal{
+		asgs: make(map[string]*asgRecord),
+	}
+}
+
+func (j *asgJournal) record(asg string, entry string) *asgRecord {
+	glog.V(4).Infof("ASG %s: %s", asg, entry)
+	if _, ok := j.asgs[asg]; !ok {
+		j.asgs[asg] = &asgRecord{suspended: make(map[string]bool)}
+		j.order = append(j.order, asg)
+	}
+	return j.asgs[asg]
+}
+
+func (j *asgJournal) setDesiredCount(awsClient *awsClient, asg string, desiredCount int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if r, ok := j.asgs[asg]; !ok || r.desiredCount == nil {
+		original, err := awsClient.autoscaling.getDesiredCount(asg)
+		if err != nil {
+			return err
+		}
+		j.record(asg, fmt.Sprintf("desired count was %d", original)).desiredCount = aws.Int64(original)
+	}
+	j.record(asg, fmt.Sprintf("set desired count to %d", desiredCount))
+	_, err := awsClient.autoscaling.setDesiredCount(asg, desiredCount)
+	return err
+}
+
+func (j *asgJournal) setMaxSize(awsClient *awsClient, asg string, maxSize int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if r, ok := j.asgs[asg]; !ok || r.maxSize == nil {
+		original, err := awsClient.autoscaling.getMaxSize(asg)
+		if err != nil {
+			return err
+		}
+		j.record(asg, fmt.Sprintf("max size was %d", original)).maxSize = aws.Int64(original)
+	}
+	j.record(asg, fmt.Sprintf("set max size to %d", maxSize))
+	_, err := awsClient.autoscaling.setMaxSize(asg, maxSize)
+	return err
+}
+
+func (j *asgJournal) setSubnets(awsClient *awsClient, asg string, subnets string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if r, ok := j.asgs[asg]; !ok || r.subnets == nil {
+		group, err := awsClient.autoscaling.getASG(asg)
+		if err != nil {
+			return err
+		}
+		j.record(asg, fmt.Sprintf("subnets were %s", aws.StringValue(group.VPCZoneIdentifier))).subnets = group.VPCZoneIdentifier
+	}
+	j.record(asg, fmt.Sprintf("set subnets to %s", subnets))
+	_, err := awsClient.autoscaling.setSubnets(asg, subnets)
+	return err
+}
+
+// Keeps only the given instance type overrides in the mixed instances policy of the ASG
+func (j *asgJournal) setInstanceTypeOverrides(awsClient *awsClient, asg string, overrides []*autoscaling.LaunchTemplateOverrides) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	group, err := awsClient.autoscaling.getASG(asg)
+	if err != nil {
+		return err
+	}
+	if group.MixedInstancesPolicy == nil || group.MixedInstancesPolicy.LaunchTemplate == nil {
+		return fmt.Errorf("ASG %s has no mixed instances policy", asg)
+	}
+	current := group.MixedInstancesPolicy.LaunchTemplate
+	if r, ok := j.asgs[asg]; !ok || r.launchTemplate == nil {
+		j.record(asg, fmt.Sprintf("instance type overrides were %s", current.Overrides)).launchTemplate = current
+	}
+	j.record(asg, fmt.Sprintf("set instance type overrides to %s", overrides))
+	_, err = awsClient.autoscaling.setMixedInstancesLaunchTemplate(asg, &autoscaling.LaunchTemplate{
+		LaunchTemplateSpecification: current.LaunchTemplateSpecification,
+		Overrides:                   overrides,
+	})
+	return err
+}
+
+func (j *asgJournal) manageProcesses(awsClient *awsClient, asg string, scalingProcesses []*string, action string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	processes := aws.StringValueSlice(scalingProcesses)
+	r := j.record(asg, fmt.Sprintf("%s processes %v", action, processes))
+	_, err := awsClient.autoscaling.manageASGProcesses(asg, scalingProcesses, action)
+	if err != nil {
+		return err
+	}
+	for _, process := range processes {
+		if action == "suspend" {
+			r.suspended[process] = true
+		} else {
+			delete(r.suspended, process)
+		}
+	}
+	return nil
+}
+
+func (j *asgJournal) putLifecycleHook(awsClient *awsClient, asg string, hookName string, transition string, defaultResult string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	r := j.record(asg, fmt.Sprintf("add lifecycle hook %s", hookName))
+	_, err := awsClient.autoscaling.putLifecycleHook(asg, hookName, transition, lifecycleHookTimeout, defaultResult)
+	if err != nil {
+		return err
+	}
+	r.hooks = append(r.hooks, hookName)
+	return nil
+}
+
+// Puts the ASGs back the way they were before the roll. Lifecycle hooks are removed first, except for a
+// terminating hook still holding instances whose node couldn't be drained, then the desired
+// count, the max size, the subnets and the instance types are restored, and the suspended processes resumed
+// last so the ASGs don't act on an intermediate state. Returns the changes which couldn't be reversed.
+func (j *asgJournal) restore(awsClient *awsClient) []error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var errs []error
+	for _, asg := range j.order {
+		r := j.asgs[asg]
+
+		var kept []string
+		for _, hookName := range r.hooks {
+			// Deleting the terminating hook would let the instances it holds go with their node undrained,
+			// so it is left to time out instead
+			if hookName == drainLifecycleHookName {
+				held, err := awsClient.autoscaling.getInstancesInLifecycleState(asg, "Terminating:Wait")
+				if err != nil {
+					errs = append(errs, fmt.Errorf("unable to check for instances held by lifecycle hook %s on ASG %s, keeping it: %s", hookName, asg, err))
+					kept = append(kept, hookName)
+					continue
+				}
+				if len(held) > 0 {
+					errs = append(errs, fmt.Errorf("kept lifecycle hook %s on ASG %s, instances %s are held in Terminating:Wait until it times out after %d seconds",
+						hookName, asg, held, lifecycleHookTimeout))
+					kept = append(kept, hookName)
+					continue
+				}
+			}
+			glog.V(4).Infof("Removing lifecycle hook %s from ASG %s\n", hookName, asg)
+			if _, err := awsClient.autoscaling.deleteLifecycleHook(asg, hookName); err != nil {
+				errs = append(errs, fmt.Errorf("unable to remove lifecycle hook %s from ASG %s: %s", hookName, asg, err))
+			}
+		}
+		r.hooks = kept
+
+		if r.desiredCount != nil {
+			current, err := awsClient.autoscaling.getDesiredCount(asg)
+			if err != nil || current != *r.desiredCount {
+				glog.V(4).Infof("Restoring the desired count of ASG %s to %d\n", asg, *r.desiredCount)
+				if _, err = awsClient.autoscaling.setDesiredCount(asg, *r.desiredCount); err != nil {
+					errs = append(errs, fmt.Errorf("unable to restore the desired count of ASG %s to %d: %s", asg, *r.desiredCount, err))
+				}
+			}
+		}
+
+		if r.maxSize != nil {
+			current, err := awsClient.autoscaling.getMaxSize(asg)
+			if err != nil || current != *r.maxSize {
+				glog.V(4).Infof("Restoring the max size of ASG %s to %d\n", asg, *r.maxSize)
+				if _, err = awsClient.autoscaling.setMaxSize(asg, *r.maxSize); err != nil {
+					errs = append(errs, fmt.Errorf("unable to restore the max size of ASG %s to %d: %s", asg, *r.maxSize, err))
+				}
+			}
+		}
+
+		if r.subnets != nil {
+			glog.V(4).Infof("Restoring the subnets of ASG %s to %s\n", asg, *r.subnets)
+			if _, err := awsClient.autoscaling.setSubnets(asg, *r.subnets); err != nil {
+				errs = append(errs, fmt.Errorf("unable to restore the subnets of ASG %s to %s: %s", asg, *r.subnets, err))
+			} else {
+				r.subnets = nil
+			}
+		}
+
+		if r.launchTemplate != nil {
+			glog.V(4).Infof("Restoring the instance type overrides of ASG %s\n", asg)
+			if _, err := awsClient.autoscaling.setMixedInstancesLaunchTemplate(asg, r.launchTemplate); err != nil {
+				errs = append(errs, fmt.Errorf("unable to restore the instance type overrides of ASG %s: %s", asg, err))
+			} else {
+				r.launchTemplate = nil
+			}
+		}
+
+		if len(r.suspended) > 0 {
+			var processes []string
+			for process := range r.suspended {
+				processes = append(processes, process)
+			}
+			sort.Strings(processes)
+			glog.V(4).Infof("Resuming autoscaling processes %v for %s\n", processes, asg)
+			if _, err := awsClient.autoscaling.manageASGProcesses(asg, aws.StringSlice(processes), "resume"); err != nil {
+				errs = append(errs, fmt.Errorf("unable to resume processes %v on ASG %s: %s", processes, asg, err))
+			} else {
+				r.suspended = make(map[string]bool)
+			}
+		}
+	}
+	return errs
+}
+
+// Reverses the changes made to the ASGs of the component, and records the outcome for the summary
+func restoreASGs(awsClient *awsClient, myComponent *componentType) {
+	if myComponent.journal == nil {
+		return
+	}
+	errs := myComponent.journal.restore(awsClient)
+	myComponent.lifecycleHooks = nil
+	myComponent.restoreErrs = append(myComponent.restoreErrs, errs...)
+	for _, err := range errs {
+		glog.Errorf("an error occurred restoring the ASGs of component %s\n Error: %s", myComponent.name, err)
+	}
+	if len(errs) > 0 {
+		myComponent.status = false
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestJournalRestore(t *testing.T) {
+	asg := "infra-k8s-worker"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String(asg),
+				DesiredCapacity:      aws.Int64(10),
+				MaxSize:              aws.Int64(12),
+			},
+		},
+	}
+	awsClient := newFakeAwsClient()
+	journal := newASGJournal()
+
+	// A surge interrupted half way
+	if err := journal.manageProcesses(awsClient, asg, aws.StringSlice([]string{"AZRebalance", "Terminate"}), "suspend"); err != nil {
+		t.Errorf("got error when suspending processes: %s", err)
+	}
+	if err := journal.setMaxSize(awsClient, asg, 20); err != nil {
+		t.Errorf("got error when setting the max size: %s", err)
+	}
+	if err := journal.setDesiredCount(awsClient, asg, 15); err != nil {
+		t.Errorf("got error when setting the desired count: %s", err)
+	}
+	if err := journal.setDesiredCount(awsClient, asg, 20); err != nil {
+		t.Errorf("got error when setting the desired count: %s", err)
+	}
+	if err := journal.manageProcesses(awsClient, asg, aws.StringSlice([]string{"Terminate"}), "resume"); err != nil {
+		t.Errorf("got error when resuming processes: %s", err)
+	}
+
+	if errs := journal.restore(awsClient); len(errs) != 0 {
+		t.Errorf("got errors when restoring: %v", errs)
+	}
+	group := fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups[0]
+	if *group.DesiredCapacity != 10 || *group.MaxSize != 12 {
+		t.Errorf("expected desired count 10 and max size 12, got %d and %d", *group.DesiredCapacity, *group.MaxSize)
+	}
+	if suspended := journal.asgs[asg].suspended; len(suspended) != 0 {
+		t.Errorf("expected all the processes to be resumed, %v remain", suspended)
+	}
+}
+
+func TestJournalRestoreKeepsHookHoldingInstances(t *testing.T) {
+	asg := "infra-k8s-worker"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String(asg),
+				DesiredCapacity:      aws.Int64(2),
+				MaxSize:              aws.Int64(4),
+				Instances: []*autoscaling.Instance{
+					{InstanceId: aws.String("i-undrained"), LifecycleState: aws.String("Terminating:Wait")},
+				},
+			},
+		},
+	}
+	defer func() { fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{} }()
+	fakeLifecycleHooks = make(map[string]*autoscaling.PutLifecycleHookInput)
+	awsClient := newFakeAwsClient()
+	journal := newASGJournal()
+
+	if err := journal.putLifecycleHook(awsClient, asg, drainLifecycleHookName, terminatingTransition, "CONTINUE"); err != nil {
+		t.Errorf("got error when adding the terminating hook: %s", err)
+	}
+	if err := journal.putLifecycleHook(awsClient, asg, verifyLifecycleHookName, launchingTransition, "ABANDON"); err != nil {
+		t.Errorf("got error when adding the launching hook: %s", err)
+	}
+
+	// The instance whose node couldn't be drained stays held until the hook times out
+	if errs := journal.restore(awsClient); len(errs) != 1 {
+		t.Errorf("expected the kept hook to be reported, got %v", errs)
+	}
+	if _, ok := fakeLifecycleHooks[asg+"/"+drainLifecycleHookName]; !ok || len(fakeLifecycleHooks) != 1 {
+		t.Errorf("expected only the terminating hook to be kept, got %v", fakeLifecycleHooks)
+	}
+
+	// It is removed once nothing is held anymore
+	fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups[0].Instances = nil
+	if errs := journal.restore(awsClient); len(errs) != 0 {
+		t.Errorf("got errors when restoring: %v", errs)
+	}
+	if len(fakeLifecycleHooks) != 0 {
+		t.Errorf("expected the hooks to be removed, got %v", fakeLifecycleHooks)
+	}
+}
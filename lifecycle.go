@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// The lifecycle hooks the roller registers on the ASGs it rolls
+	drainLifecycleHookName  = "kubernetes-updater-drain"
+	verifyLifecycleHookName = "kubernetes-updater-verify"
+	terminatingTransition   = "autoscaling:EC2_INSTANCE_TERMINATING"
+	launchingTransition     = "autoscaling:EC2_INSTANCE_LAUNCHING"
+)
+
+var (
+	// How long the ASG waits on our lifecycle hooks before applying their default result
+	lifecycleHookTimeout = int64(3600)
+	// How often we look for instances held by our lifecycle hooks
+	lifecyclePollInterval = 15 * time.Second
+)
+
+type lifecycleHook struct {
+	name       string
+	transition string
+	// What the ASG does with the instance when the hook times out
+	defaultResult string
+}
+
+// Registers our lifecycle hooks on the ASGs of the component for the duration of the roll. They are removed
+// along with the other changes recorded in the journal of the component. The terminating
+// hook holds old instances until their node is drained, so it is only registered for the components
+// running kubernetes nodes. The launching hook, if asked for, keeps new instances out of service until
+// they pass our health checks, and abandons them if they never do.
+func addLifecycleHooks(awsClient *awsClient, myComponent *componentType, launching bool) error {
+	// The terminating hook is always registered first
+	var hooks []lifecycleHook
+	if runsKubernetesNode(myComponent.name) {
+		hooks = append(hooks, lifecycleHook{drainLifecycleHookName, terminatingTransition, "CONTINUE"})
+	}
+	if launching {
+		hooks = append(hooks, lifecycleHook{verifyLifecycleHookName, launchingTransition, "ABANDON"})
+	}
+
+	for _, hook := range hooks {
+		for _, asg := range myComponent.asgs {
+			glog.V(4).Infof("Adding lifecycle hook %s to ASG %s\n", hook.name, asg)
+			err := myComponent.journal.putLifecycleHook(awsClient, asg, hook.name, hook.transition, hook.defaultResult)
+			if err != nil {
+				return fmt.Errorf("an error occurred adding lifecycle hook %s to ASG %s\n Error: %s", hook.name, asg, err)
+			}
+		}
+		myComponent.lifecycleHooks = append(myComponent.lifecycleHooks, hook.name)
+	}
+	return nil
+}
+
+func (c *componentType) hasLifecycleHook(hookName string) bool {
+	for _, name := range c.lifecycleHooks {
+		if name == hookName {
+			return true
+		}
+	}
+	return false
+}
+
+// Cordons and drains the kubernetes node of an instance held by our terminating hook, then lets the ASG
+// terminate it.
+func drainAndCompleteLifecycleAction(awsClient *awsClient, kubernetesClient kubernetesClient, asg string, instanceID string) error {
+	glog.V(2).Infof("Instance %s of ASG %s is terminating, draining its kubernetes node", instanceID, asg)
+
+	// On failure the instance stays in Terminating:Wait, until the hook times out if nobody steps in
+	instanceList := []string{instanceID}
+	err := cordonKubernetesNodes(kubernetesClient, instanceList)
+	if err != nil {
+		return fmt.Errorf("an error occurred attempting to cordon kubernetes nodes %s\n Error: %s", instanceList, err)
+	}
+	err = drainKubernetesNodes(kubernetesClient, instanceList)
+	if err != nil {
+		return fmt.Errorf("an error occurred attempting to drain kubernetes nodes %s\n Error: %s", instanceList, err)
+	}
+
+	_, err = awsClient.autoscaling.completeLifecycleAction(asg, drainLifecycleHookName, instanceID, "CONTINUE")
+	if err != nil {
+		return fmt.Errorf("an error occurred completing the lifecycle action of instance %s\n Error: %s", instanceID, err)
+	}
+	return nil
+}
+
+// Drains the nodes of the instances of the ASG held by our terminating hook, once the cluster health gate
+// passes. Instances in handled are skipped.
+func completeTerminatingInstances(awsClient *awsClient, kubernetesClient kubernetesClient, myComponent *componentType, asg string, handled map[string]bool) error {
+	instances, err := awsClient.autoscaling.getInstancesInLifecycleState(asg, "Terminating:Wait")
+	if err != nil {
+		return fmt.Errorf("an error occurred listing the terminating instances of ASG %s\n Error: %s", asg, err)
+	}
+
+	for _, instanceID := range instances {
+		if handled[instanceID] {
+			continue
+		}
+
+		err = waitForClusterHealth(myComponent)
+		if err != nil {
+			return err
+		}
+
+		err = drainAndCompleteLifecycleAction(awsClient, kubernetesClient, asg, instanceID)
+		if err != nil {
+			return err
+		}
+		handled[instanceID] = true
+	}
+	return nil
+}
+
+// Lets the instances of the ASG held by our launching hook go in service once they are healthy
+func completeLaunchingInstances(awsClient *awsClient, myComponent *componentType, asg string) error {
+	instances, err := awsClient.autoscaling.getInstancesInLifecycleState(asg, "Pending:Wait")
+	if err != nil {
+		return fmt.Errorf("an error occurred listing the launching instances of ASG %s\n Error: %s", asg, err)
+	}
+
+	health, err := awsClient.ec2.getInstancesHealth(instances)
+	if err != nil {
+		return err
+	}
+	for _, instanceID := range instances {
+		if health[instanceID] != tags.healthyValue {
+			continue
+		}
+		glog.V(2).Infof("Component %s instance %s is healthy, letting ASG %s put it in service", myComponent.name, instanceID, asg)
+		_, err = awsClient.autoscaling.completeLifecycleAction(asg, verifyLifecycleHookName, instanceID, "CONTINUE")
+		if err != nil {
+			return fmt.Errorf("an error occurred completing the lifecycle action of instance %s\n Error: %s", instanceID, err)
+		}
+	}
+	return nil
+}
+
+// Terminates an instance through its ASG so that our terminating hook holds it, drains its kubernetes node
+// and lets the termination proceed. With decrement, the desired count of the ASG goes down by one.
+func terminateInstanceWithLifecycleHook(awsClient *awsClient, kubernetesClient kubernetesClient, asg string, instanceID string, decrement bool) error {
+	_, err := awsClient.autoscaling.terminateInstanceInASG(instanceID, decrement)
+	if err != nil {
+		return fmt.Errorf("an error occurred terminating instance %s in ASG %s\n Error: %s", instanceID, asg, err)
+	}
+
+	for loop := 0; loop < 20; loop++ {
+		instances, err := awsClient.autoscaling.getInstancesInLifecycleState(asg, "Terminating:Wait")
+		if err != nil {
+			return fmt.Errorf("an error occurred listing the terminating instances of ASG %s\n Error: %s", asg, err)
+		}
+		for _, terminating := range instances {
+			if terminating == instanceID {
+				return drainAndCompleteLifecycleAction(awsClient, kubernetesClient, asg, instanceID)
+			}
+		}
+		glog.V(4).Infof("Waiting for instance %s to be held by lifecycle hook %s - %s", instanceID, drainLifecycleHookName, timeStamp())
+		if err := sleepUnlessAborted(lifecyclePollInterval); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("instance %s of ASG %s never reached Terminating:Wait", instanceID, asg)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func newFakeAwsClient() *awsClient {
+	return &awsClient{
+		ec2:           newAWSEc2Controller(newFakeAWSEc2Client()),
+		autoscaling:   newAWSAutoscalingController(newFakeAWSAutoscalingClient()),
+		serviceQuotas: newAWSServiceQuotasController(newFakeAWSServiceQuotasClient()),
+	}
+}
+
+func TestAddAndRemoveLifecycleHooks(t *testing.T) {
+	myComponent := &componentType{name: "k8s-node", asgs: []string{"infra-k8s-worker-a", "infra-k8s-worker-b"}, journal: newASGJournal()}
+	awsClient := newFakeAwsClient()
+
+	err := addLifecycleHooks(awsClient, myComponent, false)
+	if err != nil {
+		t.Errorf("got error when adding lifecycle hooks: %s", err)
+	}
+	if !myComponent.hasLifecycleHook(drainLifecycleHookName) || myComponent.hasLifecycleHook(verifyLifecycleHookName) {
+		t.Errorf("expected only the terminating hook to be registered, got %v", myComponent.lifecycleHooks)
+	}
+	if len(fakeLifecycleHooks) != 2 {
+		t.Errorf("expected the terminating hook on both ASGs, got %d hooks", len(fakeLifecycleHooks))
+	}
+	restoreASGs(awsClient, myComponent)
+
+	err = addLifecycleHooks(awsClient, myComponent, true)
+	if err != nil {
+		t.Errorf("got error when adding lifecycle hooks: %s", err)
+	}
+	hook, ok := fakeLifecycleHooks["infra-k8s-worker-a/"+verifyLifecycleHookName]
+	if !ok || *hook.LifecycleTransition != launchingTransition || *hook.DefaultResult != "ABANDON" {
+		t.Errorf("expected a launching hook abandoning unverified instances, got %v", hook)
+	}
+	if len(fakeLifecycleHooks) != 4 {
+		t.Errorf("expected both hooks on both ASGs, got %d hooks", len(fakeLifecycleHooks))
+	}
+
+	restoreASGs(awsClient, myComponent)
+	if len(fakeLifecycleHooks) != 0 || len(myComponent.lifecycleHooks) != 0 {
+		t.Errorf("expected all the hooks to be removed, %d remain", len(fakeLifecycleHooks))
+	}
+}
+
+func TestAddLifecycleHooksWithoutNodes(t *testing.T) {
+	myComponent := &componentType{name: "etcd", asgs: []string{"infra-etcd"}, journal: newASGJournal()}
+	awsClient := newFakeAwsClient()
+	defer restoreASGs(awsClient, myComponent)
+
+	// The instance refresh asks for the hooks of etcd too
+	err := addLifecycleHooks(awsClient, myComponent, false)
+	if err != nil {
+		t.Errorf("got error when adding lifecycle hooks: %s", err)
+	}
+	if len(myComponent.lifecycleHooks) != 0 || len(fakeLifecycleHooks) != 0 {
+		t.Errorf("expected no terminating hook for etcd, got %v", myComponent.lifecycleHooks)
+	}
+}
+
+func TestCompleteLaunchingInstancesSkipsUnhealthy(t *testing.T) {
+	fakeCompletedLifecycleActions = nil
+
+	asgName := "infra-k8s-worker"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: &asgName,
+				Instances: []*autoscaling.Instance{
+					{
+						InstanceId:     aws.String("i-fake-instanceid"),
+						LifecycleState: aws.String("Pending:Wait"),
+					},
+				},
+			},
+		},
+	}
+
+	// The fake instance has no healthy tag yet
+	err := completeLaunchingInstances(newFakeAwsClient(), &componentType{name: "k8s-node"}, asgName)
+	if err != nil {
+		t.Errorf("got error when completing launching instances: %s", err)
+	}
+	if len(fakeCompletedLifecycleActions) != 0 {
+		t.Errorf("expected no completed lifecycle action, got %v", fakeCompletedLifecycleActions)
+	}
+}
+
+func TestCompleteTerminatingInstances(t *testing.T) {
+	state = &rollerState{}
+	resetFakeWorkloads()
+	drainPollInterval = time.Millisecond
+	fakeCompletedLifecycleActions = nil
+
+	asgName := "infra-k8s-worker"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: &asgName,
+				Instances: []*autoscaling.Instance{
+					{
+						InstanceId:     aws.String("i-fake-instanceid"),
+						LifecycleState: aws.String("Terminating:Wait"),
+					},
+				},
+			},
+		},
+	}
+
+	handled := make(map[string]bool)
+	myComponent := &componentType{name: "k8s-node"}
+	err := completeTerminatingInstances(newFakeAwsClient(), newFakeClient(), myComponent, asgName, handled)
+	if err != nil {
+		t.Errorf("got error when completing terminating instances: %s", err)
+	}
+	if len(fakeCompletedLifecycleActions) != 1 || !handled["i-fake-instanceid"] {
+		t.Errorf("expected the lifecycle action of i-fake-instanceid to be completed, got %v", fakeCompletedLifecycleActions)
+	}
+
+	// Instances already handled are left alone
+	err = completeTerminatingInstances(newFakeAwsClient(), newFakeClient(), myComponent, asgName, handled)
+	if err != nil {
+		t.Errorf("got error when completing terminating instances: %s", err)
+	}
+	if len(fakeCompletedLifecycleActions) != 1 {
+		t.Errorf("expected a single completed lifecycle action, got %d", len(fakeCompletedLifecycleActions))
+	}
+}
+
+func TestCompleteTerminatingInstancesLeavesUndrainedInstances(t *testing.T) {
+	state = &rollerState{}
+	resetFakeWorkloads()
+	fakeCompletedLifecycleActions = nil
+
+	// No kubernetes node runs on this instance
+	asgName := "infra-k8s-worker"
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: &asgName,
+				Instances: []*autoscaling.Instance{
+					{
+						InstanceId:     aws.String("i-unknown"),
+						LifecycleState: aws.String("Terminating:Wait"),
+					},
+				},
+			},
+		},
+	}
+
+	handled := make(map[string]bool)
+	err := completeTerminatingInstances(newFakeAwsClient(), newFakeClient(), &componentType{name: "k8s-node"}, asgName, handled)
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+	if len(fakeCompletedLifecycleActions) != 0 || handled["i-unknown"] {
+		t.Errorf("expected i-unknown to be left in Terminating:Wait, got %v", fakeCompletedLifecycleActions)
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
-	"k8s.io/client-go/pkg/api/v1"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type kubernetesNode struct {
@@ -13,14 +17,59 @@ type kubernetesNodes struct {
 }
 
 func (k kubernetesNodes) getNodesByLabel(client kubernetesClient, labels map[string]string) (*v1.NodeList, error) {
-	listOptions := v1.ListOptions{
+	listOptions := meta_v1.ListOptions{
 		LabelSelector: keysString(labels),
 	}
 	nodeObject, err := client.getNodes(listOptions)
 	return nodeObject, err
 }
 
-func (k kubernetesNodes) updateNode(client kubernetesClient, node *v1.Node) (*v1.Node, error) {
-	node, err := client.updateNode(node)
+// Returns the node of each instance, listing all the nodes in a single call.
+// Returns an error naming the instances which have no node.
+func (k kubernetesNodes) getNodesByInstanceID(client kubernetesClient, instanceIDs []string) (map[string]v1.Node, error) {
+	nodeList, err := client.getNodes(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %s", err)
+	}
+
+	byInstance := make(map[string]v1.Node)
+	for _, node := range nodeList.Items {
+		if instanceID := nodeInstanceID(node); instanceID != "" {
+			byInstance[instanceID] = node
+		}
+	}
+
+	nodes := make(map[string]v1.Node)
+	var missing []string
+	for _, instanceID := range instanceIDs {
+		if node, ok := byInstance[instanceID]; ok {
+			nodes[instanceID] = node
+		} else {
+			missing = append(missing, instanceID)
+		}
+	}
+	if len(missing) > 0 {
+		return nodes, fmt.Errorf("no kubernetes node found for instances %s", missing)
+	}
+	return nodes, nil
+}
+
+// Marks a node as unschedulable, or as schedulable again when unschedulable
+// is false
+func (k kubernetesNodes) setUnschedulable(client kubernetesClient, name string, unschedulable bool) (*v1.Node, error) {
+	node, err := client.setNodeUnschedulable(name, unschedulable)
 	return node, err
 }
+
+// Returns the ID of the instance of a node, read from its providerID
+// (aws:///<az>/<instance-id>), or else from the instance-id label of our
+// legacy AMIs
+func nodeInstanceID(node v1.Node) string {
+	if strings.HasPrefix(node.Spec.ProviderID, "aws://") {
+		parts := strings.Split(node.Spec.ProviderID, "/")
+		if instanceID := parts[len(parts)-1]; strings.HasPrefix(instanceID, "i-") {
+			return instanceID
+		}
+	}
+	return node.Labels["instance-id"]
+}
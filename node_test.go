@@ -1,6 +1,16 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8s_testing "k8s.io/client-go/testing"
+)
 
 func TestKubernetesNodes_GetNodesByLabel(t *testing.T) {
 	client := newFakeClient()
@@ -20,9 +30,6 @@ func TestKubernetesNodes_GetNodesByLabel(t *testing.T) {
 		if node.ObjectMeta.Name != "fake-service" {
 			t.Errorf("expected fake-service but got %s", node.ObjectMeta.Name)
 		}
-		if node.ObjectMeta.Namespace != "fake-namespace" {
-			t.Errorf("expected fake-namespace but got %s", node.ObjectMeta.Namespace)
-		}
 	}
 }
 
@@ -52,14 +59,107 @@ func TestKubernetesNodes_UpdateNodesByLabel(t *testing.T) {
 	}
 
 	for _, node := range nodeList.Items {
-		node.Spec.Unschedulable = true
-		node := &node
-		updatedNode, err := nodesController.updateNode(client, node)
+		updatedNode, err := nodesController.setUnschedulable(client, node.Name, true)
 		if err != nil {
 			t.Error("failed to update node")
 		}
 		if !updatedNode.Spec.Unschedulable {
 			t.Error("failed to update node")
 		}
+		updatedNode, err = nodesController.setUnschedulable(client, node.Name, false)
+		if err != nil {
+			t.Error("failed to update node")
+		}
+		if updatedNode.Spec.Unschedulable {
+			t.Error("failed to uncordon node")
+		}
+	}
+}
+
+func TestKubernetesNodes_SetUnschedulablePatchesNode(t *testing.T) {
+	clientset := newFakeClientset()
+	var patches []k8s_testing.PatchAction
+	clientset.PrependReactor("patch", "nodes", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		patches = append(patches, action.(k8s_testing.PatchAction))
+		return false, nil, nil
+	})
+	client := &kubernetesClientConfig{clientset: clientset}
+	nodesController := kubernetesNodes{}
+
+	updatedNode, err := nodesController.setUnschedulable(client, fakeNode.Name, true)
+	if err != nil {
+		t.Errorf("failed to update node: %s", err)
+	}
+	if !updatedNode.Spec.Unschedulable {
+		t.Error("expected the node to be cordoned")
+	}
+	if len(patches) != 1 || patches[0].GetPatchType() != types.StrategicMergePatchType ||
+		string(patches[0].GetPatch()) != `{"spec":{"unschedulable":true}}` {
+		t.Errorf("expected a single strategic merge patch of the schedulability, got %v", patches)
+	}
+}
+
+func TestKubernetesNodes_SetUnschedulableConflict(t *testing.T) {
+	clientset := newFakeClientset()
+	clientset.PrependReactor("patch", "nodes", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewConflict(v1.Resource("nodes"), "fake-service", fmt.Errorf("the object has been modified"))
+	})
+	client := &kubernetesClientConfig{clientset: clientset}
+	nodesController := kubernetesNodes{}
+
+	if _, err := nodesController.setUnschedulable(client, fakeNode.Name, true); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestKubernetesNodes_GetNodesByInstanceID(t *testing.T) {
+	client := newFakeClient()
+	nodesController := kubernetesNodes{}
+
+	nodes, err := nodesController.getNodesByInstanceID(client, []string{"i-fake-instanceid", "i-fake-provider-instanceid"})
+	if err != nil {
+		t.Errorf("failed to get nodes by instance ID: %s", err)
+	}
+	if nodes["i-fake-instanceid"].Name != "fake-service" {
+		t.Errorf("expected the node of the label fallback, got %s", nodes["i-fake-instanceid"].Name)
+	}
+	if nodes["i-fake-provider-instanceid"].Name != "fake-provider-node" {
+		t.Errorf("expected the node of the providerID, got %s", nodes["i-fake-provider-instanceid"].Name)
+	}
+
+	if _, err := nodesController.getNodesByInstanceID(client, []string{"i-missing-instanceid"}); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestCordonKubernetesNodes(t *testing.T) {
+	client := newFakeClient()
+	if err := cordonKubernetesNodes(client, []string{"i-fake-provider-instanceid"}); err != nil {
+		t.Errorf("failed to cordon node: %s", err)
+	}
+	if err := cordonKubernetesNodes(client, []string{"i-missing-instanceid"}); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	// An instance without a node doesn't keep the others from being cordoned
+	if err := cordonKubernetesNodes(client, []string{"i-missing-instanceid", "i-fake-instanceid"}); err == nil {
+		t.Error("expected error but got nil")
+	}
+	nodes, _ := client.getNodes(meta_v1.ListOptions{})
+	for _, node := range nodes.Items {
+		if node.Name == "fake-service" && !node.Spec.Unschedulable {
+			t.Error("expected the node of i-fake-instanceid to be cordoned")
+		}
+	}
+}
+
+func TestCordonKubernetesNodesFailure(t *testing.T) {
+	clientset := newFakeClientset()
+	clientset.PrependReactor("patch", "nodes", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("the server is unavailable")
+	})
+	client := &kubernetesClientConfig{clientset: clientset}
+	if err := cordonKubernetesNodes(client, []string{"i-fake-instanceid"}); err == nil {
+		t.Error("expected error but got nil")
 	}
 }
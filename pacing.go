@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// How often we check whether the pods of a terminated node are running elsewhere
+var reschedulingPollInterval = 10 * time.Second
+
+// nodeWorkloadSnapshot records the controllers owning pods on a node before it
+// is terminated, along with the number of Running pods each of them had
+// across the whole cluster at that time.
+type nodeWorkloadSnapshot struct {
+	instanceID string
+	nodeName   string
+	running    map[string]int
+}
+
+// Returns a namespace/kind/name key for the controller owning the pod, or an
+// empty string if the pod is not managed by a controller.
+func podOwnerKey(pod v1.Pod) string {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller != nil && *owner.Controller {
+			return fmt.Sprintf("%s/%s/%s", pod.Namespace, owner.Kind, owner.Name)
+		}
+	}
+	return ""
+}
+
+func isDaemonSetPod(pod v1.Pod) bool {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
+}
+
+func snapshotNodeWorkloads(client kubernetesClient, instanceID string) (*nodeWorkloadSnapshot, error) {
+	nodesController := kubernetesNodes{}
+	nodes, err := nodesController.getNodesByInstanceID(client, []string{instanceID})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &nodeWorkloadSnapshot{
+		instanceID: instanceID,
+		nodeName:   nodes[instanceID].Name,
+		running:    make(map[string]int),
+	}
+
+	pods, err := client.getPods("", meta_v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %s", err)
+	}
+
+	// DaemonSet pods are never rescheduled elsewhere so we don't wait for them
+	for _, pod := range pods.Items {
+		owner := podOwnerKey(pod)
+		if pod.Spec.NodeName == snapshot.nodeName && owner != "" && !isDaemonSetPod(pod) {
+			snapshot.running[owner] = 0
+		}
+	}
+	for _, pod := range pods.Items {
+		owner := podOwnerKey(pod)
+		if count, ok := snapshot.running[owner]; ok && pod.Status.Phase == v1.PodRunning {
+			snapshot.running[owner] = count + 1
+		}
+	}
+	return snapshot, nil
+}
+
+// Returns the controllers which do not yet have as many Running pods outside
+// of the terminated node as they had in the whole cluster before.
+func (s *nodeWorkloadSnapshot) pendingOwners(client kubernetesClient) ([]string, error) {
+	var pending []string
+
+	pods, err := client.getPods("", meta_v1.ListOptions{})
+	if err != nil {
+		return pending, fmt.Errorf("failed to list pods: %s", err)
+	}
+
+	current := make(map[string]int)
+	for _, pod := range pods.Items {
+		owner := podOwnerKey(pod)
+		if _, ok := s.running[owner]; !ok {
+			continue
+		}
+		if pod.Spec.NodeName != s.nodeName && pod.Status.Phase == v1.PodRunning {
+			current[owner]++
+		}
+	}
+
+	for owner, count := range s.running {
+		if current[owner] < count {
+			pending = append(pending, owner)
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+// Waits after a termination. We always wait at least minWait so the ASG and
+// the scheduler notice the instance is gone, then move on as soon as the pods
+// of the terminated node are Running elsewhere. maxWait bounds the whole wait,
+// and is used as a fixed sleep when we have no snapshot of the node. Stops
+// waiting when the roll is aborted.
+func waitForRescheduling(client kubernetesClient, snapshot *nodeWorkloadSnapshot, minWait, maxWait time.Duration) {
+	start := time.Now()
+	if sleepUnlessAborted(minWait) != nil {
+		return
+	}
+
+	if snapshot == nil {
+		if remaining := maxWait - time.Since(start); remaining > 0 {
+			sleepUnlessAborted(remaining)
+		}
+		return
+	}
+
+	for {
+		pending, err := snapshot.pendingOwners(client)
+		if err != nil {
+			glog.Errorf("an error occurred checking the pods of node %s.\nError %s", snapshot.nodeName, err)
+		} else if len(pending) == 0 {
+			glog.V(2).Infof("All pods of node %s (%s) are running elsewhere after %s", snapshot.nodeName, snapshot.instanceID, time.Since(start))
+			return
+		}
+
+		elapsed := time.Since(start)
+		if elapsed >= maxWait {
+			glog.Infof("Gave up waiting after %s for the pods of node %s (%s) to be rescheduled: %s", maxWait, snapshot.nodeName, snapshot.instanceID, pending)
+			return
+		}
+
+		glog.V(4).Infof("Waiting for the pods of node %s to be rescheduled: %s", snapshot.nodeName, pending)
+		interval := reschedulingPollInterval
+		if remaining := maxWait - elapsed; remaining < interval {
+			interval = remaining
+		}
+		if sleepUnlessAborted(interval) != nil {
+			return
+		}
+	}
+}
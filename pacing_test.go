@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func fakeOwnedPod(nodeName, kind, owner string, phase v1.PodPhase) v1.Pod {
+	controller := true
+	return v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace: "fake-namespace",
+			OwnerReferences: []meta_v1.OwnerReference{
+				{Kind: kind, Name: owner, Controller: &controller},
+			},
+		},
+		Spec:   v1.PodSpec{NodeName: nodeName},
+		Status: v1.PodStatus{Phase: phase},
+	}
+}
+
+func TestSnapshotNodeWorkloads(t *testing.T) {
+	resetFakeWorkloads()
+	fakePodList.Items = []v1.Pod{
+		fakeOwnedPod("fake-service", "ReplicaSet", "web", v1.PodRunning),
+		fakeOwnedPod("other-node", "ReplicaSet", "web", v1.PodRunning),
+		fakeOwnedPod("other-node", "ReplicaSet", "api", v1.PodRunning),
+		fakeOwnedPod("fake-service", "DaemonSet", "logs", v1.PodRunning),
+	}
+
+	snapshot, err := snapshotNodeWorkloads(newFakeClient(), "i-fake-instanceid")
+	if err != nil {
+		t.Fatalf("failed to snapshot node workloads: %s", err)
+	}
+	if snapshot.nodeName != "fake-service" {
+		t.Errorf("expected fake-service but got %s", snapshot.nodeName)
+	}
+	if len(snapshot.running) != 1 || snapshot.running["fake-namespace/ReplicaSet/web"] != 2 {
+		t.Errorf("expected only 2 running pods for the web replicaset, got %v", snapshot.running)
+	}
+	resetFakeWorkloads()
+}
+
+func TestSnapshotNodeWorkloadsMissingNode(t *testing.T) {
+	_, err := snapshotNodeWorkloads(newFakeClient(), "i-missing-instanceid")
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestPendingOwners(t *testing.T) {
+	resetFakeWorkloads()
+	snapshot := &nodeWorkloadSnapshot{
+		nodeName: "fake-service",
+		running:  map[string]int{"fake-namespace/ReplicaSet/web": 2},
+	}
+	fakePodList.Items = []v1.Pod{
+		fakeOwnedPod("other-node", "ReplicaSet", "web", v1.PodRunning),
+		fakeOwnedPod("new-node", "ReplicaSet", "web", v1.PodPending),
+	}
+
+	pending, err := snapshot.pendingOwners(newFakeClient())
+	if err != nil {
+		t.Fatalf("failed to get pending owners: %s", err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("expected the web replicaset to be pending, got %s", pending)
+	}
+
+	fakePodList.Items[1].Status.Phase = v1.PodRunning
+	pending, _ = snapshot.pendingOwners(newFakeClient())
+	if len(pending) != 0 {
+		t.Errorf("expected no pending owners, got %s", pending)
+	}
+	resetFakeWorkloads()
+}
+
+func TestWaitForReschedulingMaxWait(t *testing.T) {
+	resetFakeWorkloads()
+	reschedulingPollInterval = time.Millisecond
+	snapshot := &nodeWorkloadSnapshot{
+		nodeName: "fake-service",
+		running:  map[string]int{"fake-namespace/ReplicaSet/web": 1},
+	}
+
+	start := time.Now()
+	waitForRescheduling(newFakeClient(), snapshot, time.Millisecond, 20*time.Millisecond)
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("expected to wait until the max wait period")
+	}
+}
+
+func TestRunTerminationsBudgets(t *testing.T) {
+	instanceList := []string{"i-1", "i-2", "i-3", "i-4", "i-5", "i-6"}
+	zones := map[string]string{
+		"i-1": "us-east-1a", "i-2": "us-east-1a", "i-3": "us-east-1a",
+		"i-4": "us-east-1b", "i-5": "us-east-1b", "i-6": "us-east-1c",
+	}
+
+	var mu sync.Mutex
+	var order []string
+	inFlight, maxInFlight := 0, 0
+	zoneInFlight, maxZoneInFlight := make(map[string]int), make(map[string]int)
+	terminate := func(instanceID string) error {
+		zone := zones[instanceID]
+		mu.Lock()
+		order = append(order, instanceID)
+		inFlight++
+		zoneInFlight[zone]++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		if zoneInFlight[zone] > maxZoneInFlight[zone] {
+			maxZoneInFlight[zone] = zoneInFlight[zone]
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		zoneInFlight[zone]--
+		mu.Unlock()
+		return nil
+	}
+
+	healthChecks := 0
+	failures := runTerminations(instanceList, zones, 3, 2, func() error {
+		healthChecks++
+		return nil
+	}, terminate)
+	if len(failures) != 0 {
+		t.Errorf("expected no failures, got %s", failures)
+	}
+	if len(order) != len(instanceList) {
+		t.Errorf("expected all instances to be terminated, got %s", order)
+	}
+	if maxInFlight > 3 {
+		t.Errorf("expected at most 3 terminations at a time, got %d", maxInFlight)
+	}
+	for zone, count := range maxZoneInFlight {
+		if count > 2 {
+			t.Errorf("expected at most 2 terminations at a time in %s, got %d", zone, count)
+		}
+	}
+	if healthChecks != len(instanceList)-1 {
+		t.Errorf("expected a health check before each termination but the first, got %d", healthChecks)
+	}
+}
+
+func TestRunTerminationsInOrder(t *testing.T) {
+	instanceList := []string{"i-3", "i-1", "i-2"}
+	var terminated []string
+	failures := runTerminations(instanceList, map[string]string{}, 1, 0, func() error { return nil },
+		func(instanceID string) error {
+			terminated = append(terminated, instanceID)
+			return nil
+		})
+	if len(failures) != 0 {
+		t.Errorf("expected no failures, got %s", failures)
+	}
+	if !reflect.DeepEqual(terminated, instanceList) {
+		t.Errorf("expected the instances to be terminated in order, got %s", terminated)
+	}
+}
+
+func TestRunTerminationsStopsAfterFailure(t *testing.T) {
+	instanceList := []string{"i-1", "i-2", "i-3"}
+	var terminated []string
+	failures := runTerminations(instanceList, map[string]string{}, 1, 0, func() error { return nil },
+		func(instanceID string) error {
+			terminated = append(terminated, instanceID)
+			if instanceID == "i-1" {
+				return fmt.Errorf("termination failed")
+			}
+			return nil
+		})
+	if !reflect.DeepEqual(terminated, []string{"i-1"}) {
+		t.Errorf("expected only i-1 to be terminated, got %s", terminated)
+	}
+	if len(failures) != 3 {
+		t.Errorf("expected the remaining instances to be skipped, got %s", failures)
+	}
+}
+
+func TestRunTerminationsStopsWhenAborted(t *testing.T) {
+	withRollContext(t)
+
+	instanceList := []string{"i-1", "i-2", "i-3"}
+	var terminated []string
+	failures := runTerminations(instanceList, map[string]string{}, 1, 0, func() error { return nil },
+		func(instanceID string) error {
+			terminated = append(terminated, instanceID)
+			abortRoll()
+			return nil
+		})
+	if !reflect.DeepEqual(terminated, []string{"i-1"}) {
+		t.Errorf("expected only i-1 to be terminated, got %s", terminated)
+	}
+	if len(failures) != 2 || failures["i-2"] != errRollAborted || failures["i-3"] != errRollAborted {
+		t.Errorf("expected the remaining instances to be skipped, got %s", failures)
+	}
+}
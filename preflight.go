@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+// Running On-Demand Standard (A, C, D, H, I, M, R, T, Z) instances, in vCPUs
+const onDemandStandardQuotaCode = "L-1216C47A"
+
+// The instance families counted against the standard quota, by the prefix of
+// their instance types before the generation. The other families, such as
+// inf, dl, trn, mac or hpc, have quotas of their own.
+var standardInstanceFamilies = map[string]bool{
+	"a": true, "c": true, "d": true, "h": true, "i": true, "im": true, "is": true,
+	"m": true, "r": true, "t": true, "z": true,
+}
+
+func isStandardInstanceType(instanceType string) bool {
+	family := instanceType
+	if i := strings.IndexAny(instanceType, "0123456789"); i >= 0 {
+		family = instanceType[:i]
+	}
+	return standardInstanceFamilies[family]
+}
+
+func instanceVCPUs(instance *ec2.Instance) int {
+	if instance.CpuOptions == nil {
+		return 0
+	}
+	return int(aws.Int64Value(instance.CpuOptions.CoreCount) * aws.Int64Value(instance.CpuOptions.ThreadsPerCore))
+}
+
+// Checks that the on-demand vCPU quota of the region allows count more instances like the given one
+func checkVCPUQuota(awsClient *awsClient, instance *ec2.Instance, count int) error {
+	vcpus := instanceVCPUs(instance)
+	if vcpus == 0 || !isStandardInstanceType(aws.StringValue(instance.InstanceType)) {
+		glog.V(4).Infof("Not checking the vCPU quota for instance type %s", aws.StringValue(instance.InstanceType))
+		return nil
+	}
+
+	quota, err := awsClient.serviceQuotas.getQuotaValue("ec2", onDemandStandardQuotaCode)
+	if err != nil {
+		glog.Errorf("unable to get the on-demand vCPU quota, not checking it.\nError %s", err)
+		return nil
+	}
+
+	params := &ec2.DescribeInstancesInput{}
+	params.Filters = []*ec2.Filter{
+		awsClient.ec2.newEC2Filter("instance-state-name", "running"),
+	}
+	running, err := awsClient.ec2.describeInstances(params)
+	if err != nil {
+		glog.Errorf("unable to list the running instances, not checking the vCPU quota.\nError %s", err)
+		return nil
+	}
+	used := 0
+	for _, r := range running {
+		if !awsClient.ec2.isSpotInstance(r) && isStandardInstanceType(aws.StringValue(r.InstanceType)) {
+			used += instanceVCPUs(r)
+		}
+	}
+
+	needed := count * vcpus
+	if float64(used+needed) > quota {
+		return fmt.Errorf("%d more vCPUs are needed for %d %s instances but only %d of the %.0f on-demand vCPUs allowed in the region are free. "+
+			"Request a quota increase or lower the max surge", needed, count, aws.StringValue(instance.InstanceType), int(quota)-used, quota)
+	}
+	return nil
+}
+
+// Checks that an ASG of the component can grow by surge instances before we start surging it, so we fail
+// early rather than waiting for replacements which never come. When the max size of the ASG is too small
+// and raising it is allowed, it is raised until the ASGs of the component are restored.
+func preflightSurge(awsClient *awsClient, myComponent *componentType, myASG *asgType, surge int, settings *surgeSettings) error {
+	group, err := awsClient.autoscaling.getASG(myASG.name)
+	if err != nil {
+		return fmt.Errorf("got error when trying to describe ASG %s: %s. ", myASG.name, err)
+	}
+
+	// Every new instance needs an IP address in one of the subnets of the ASG
+	if subnets := aws.StringValue(group.VPCZoneIdentifier); subnets != "" {
+		available, err := awsClient.ec2.getAvailableIPs(strings.Split(subnets, ","))
+		if err != nil {
+			glog.Errorf("unable to get the free IP addresses of ASG %s, not checking them.\nError %s", myASG.name, err)
+		} else if available < surge {
+			return fmt.Errorf("the subnets %s of ASG %s only have %d free IP addresses for %d new instances. "+
+				"Free some addresses or lower the max surge", subnets, myASG.name, available, surge)
+		}
+	}
+
+	// Spot and mixed capacity doesn't count against the on-demand quota in a predictable way
+	if group.MixedInstancesPolicy == nil {
+		for _, instance := range myComponent.instances {
+			if awsClient.ec2.getTagValue(instance, tags.asgKey) == myASG.name {
+				if err = checkVCPUQuota(awsClient, instance, surge); err != nil {
+					return fmt.Errorf("ASG %s cannot surge: %s", myASG.name, err)
+				}
+				break
+			}
+		}
+	}
+
+	maxSize := aws.Int64Value(group.MaxSize)
+	needed := int64(myASG.desiredCount + surge)
+	if maxSize >= needed {
+		return nil
+	}
+	if !settings.raiseMaxSize {
+		return fmt.Errorf("the max size (%d) of ASG %s cannot accommodate a surge of %d instances over the desired count (%d). "+
+			"Raise it, lower the max surge or set ROLLER_RAISE_MAX_SIZE=true. ", maxSize, myASG.name, surge, myASG.desiredCount)
+	}
+
+	glog.V(2).Infof("Raising the max size of ASG %s from %d to %d for the roll", myASG.name, maxSize, needed)
+	err = myComponent.journal.setMaxSize(awsClient, myASG.name, needed)
+	if err != nil {
+		return fmt.Errorf("got error when trying to raise the max size of ASG %s: %s. ", myASG.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func setFakePreflightASG(asg string, maxSize int64, availableIPs int64) {
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String(asg),
+				MaxSize:              aws.Int64(maxSize),
+				VPCZoneIdentifier:    aws.String("subnet-a,subnet-b"),
+			},
+		},
+	}
+	fakeDescribeSubnetsOutput = &ec2.DescribeSubnetsOutput{
+		Subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-a"), AvailableIpAddressCount: aws.Int64(availableIPs / 2)},
+			{SubnetId: aws.String("subnet-b"), AvailableIpAddressCount: aws.Int64(availableIPs - availableIPs/2)},
+		},
+	}
+}
+
+func TestPreflightSurgeMaxSize(t *testing.T) {
+	asg := "infra-k8s-worker"
+	myASG := &asgType{name: asg, desiredCount: 10}
+	myComponent := &componentType{name: "k8s-node"}
+	setFakePreflightASG(asg, 15, 100)
+
+	if err := preflightSurge(newFakeAwsClient(), myComponent, myASG, 10, &surgeSettings{}); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	fakeUpdatedAutoScalingGroups = nil
+	myComponent.journal = newASGJournal()
+	err := preflightSurge(newFakeAwsClient(), myComponent, myASG, 10, &surgeSettings{raiseMaxSize: true})
+	if err != nil {
+		t.Errorf("got error when checking the surge: %s", err)
+	}
+	restoreASGs(newFakeAwsClient(), myComponent)
+	if len(fakeUpdatedAutoScalingGroups) != 2 || *fakeUpdatedAutoScalingGroups[0].MaxSize != 20 || *fakeUpdatedAutoScalingGroups[1].MaxSize != 15 {
+		t.Errorf("expected the max size to be raised to 20 then restored to 15, got %v", fakeUpdatedAutoScalingGroups)
+	}
+}
+
+func TestPreflightSurgeSubnetIPs(t *testing.T) {
+	asg := "infra-k8s-worker"
+	myASG := &asgType{name: asg, desiredCount: 10}
+	setFakePreflightASG(asg, 20, 5)
+
+	if err := preflightSurge(newFakeAwsClient(), &componentType{name: "k8s-node"}, myASG, 10, &surgeSettings{}); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestIsStandardInstanceType(t *testing.T) {
+	cases := map[string]bool{
+		"m5.large":       true,
+		"c5n.xlarge":     true,
+		"t3a.micro":      true,
+		"i4i.large":      true,
+		"im4gn.large":    true,
+		"d3en.xlarge":    true,
+		"inf1.xlarge":    false,
+		"dl1.24xlarge":   false,
+		"trn1.2xlarge":   false,
+		"mac1.metal":     false,
+		"hpc6a.48xlarge": false,
+		"p3.2xlarge":     false,
+		"x1e.xlarge":     false,
+		"":               false,
+	}
+	for instanceType, expected := range cases {
+		if standard := isStandardInstanceType(instanceType); standard != expected {
+			t.Errorf("expected standard %t for %s, got %t", expected, instanceType, standard)
+		}
+	}
+}
+
+func TestCheckVCPUQuota(t *testing.T) {
+	instance := fakeEc2Instance()
+	instance.InstanceType = aws.String("m5.large")
+	instance.CpuOptions = &ec2.CpuOptions{CoreCount: aws.Int64(1), ThreadsPerCore: aws.Int64(2)}
+
+	if err := checkVCPUQuota(newFakeAwsClient(), instance, 10); err != nil {
+		t.Errorf("got error when checking the vCPU quota: %s", err)
+	}
+	if err := checkVCPUQuota(newFakeAwsClient(), instance, 600); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	// Other families have their own quotas
+	instance.InstanceType = aws.String("p3.2xlarge")
+	if err := checkVCPUQuota(newFakeAwsClient(), instance, 600); err != nil {
+		t.Errorf("got error when checking the vCPU quota: %s", err)
+	}
+}
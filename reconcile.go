@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	deleteStaleNodes       = os.Getenv("ROLLER_DELETE_STALE_NODES")
+	maxUnjoinedStr         = os.Getenv("ROLLER_MAX_UNJOINED_INSTANCES")
+	reconcileNodesDisabled = os.Getenv("ROLLER_SKIP_NODE_RECONCILIATION")
+	// The components whose instances register as kubernetes nodes
+	nodeComponents = []string{"k8s-master", "k8s-node"}
+	// Instances launched more recently than this may not have joined yet
+	nodeJoinGracePeriod = 10 * time.Minute
+)
+
+// Whether the instances of the component register as kubernetes nodes
+func runsKubernetesNode(component string) bool {
+	return containsString(nodeComponents, component)
+}
+
+// Returns the number or percentage of the instances which may not have joined
+// the cluster for the roll to go ahead
+func getMaxUnjoined() string {
+	if maxUnjoinedStr != "" {
+		return maxUnjoinedStr
+	}
+	return "10%"
+}
+
+// nodeReconciliation lists the mismatches between the EC2 instances of the
+// cluster and its kubernetes nodes
+type nodeReconciliation struct {
+	nodeInstances int
+	unjoined      []string
+	stale         []string
+	// The instance IDs of the stale nodes, by node name
+	staleInstances map[string]string
+	unlabeled      []string
+	cordoned       []string
+}
+
+// Matches the instances of the components which run kubernetes with the nodes,
+// through the providerID or instance-id label of the nodes
+func reconcileNodes(instances []*ec2.Instance, nodes []v1.Node) *nodeReconciliation {
+	r := &nodeReconciliation{staleInstances: make(map[string]string)}
+
+	running := make(map[string]bool)
+	for _, instance := range instances {
+		running[aws.StringValue(instance.InstanceId)] = true
+	}
+
+	joined := make(map[string]bool)
+	for _, node := range nodes {
+		if node.Spec.Unschedulable {
+			r.cordoned = append(r.cordoned, node.Name)
+		}
+		instanceID := nodeInstanceID(node)
+		if instanceID == "" {
+			r.unlabeled = append(r.unlabeled, node.Name)
+			continue
+		}
+		if !running[instanceID] {
+			r.stale = append(r.stale, node.Name)
+			r.staleInstances[node.Name] = instanceID
+			continue
+		}
+		joined[instanceID] = true
+	}
+
+	for _, instance := range instances {
+		isNode := false
+		for _, component := range nodeComponents {
+			if tags.isComponent(instance, component) {
+				isNode = true
+			}
+		}
+		if !isNode {
+			continue
+		}
+		r.nodeInstances++
+		instanceID := aws.StringValue(instance.InstanceId)
+		if !joined[instanceID] && time.Since(aws.TimeValue(instance.LaunchTime)) > nodeJoinGracePeriod {
+			r.unjoined = append(r.unjoined, instanceID)
+		}
+	}
+	return r
+}
+
+// Returns the report of the mismatches, empty when there are none
+func (r *nodeReconciliation) String() string {
+	var report string
+	if len(r.unjoined) > 0 {
+		report = report + fmt.Sprintf("Instances without a kubernetes node: %s\n", r.unjoined)
+	}
+	if len(r.stale) > 0 {
+		report = report + fmt.Sprintf("Kubernetes nodes without a running instance: %s\n", r.stale)
+	}
+	if len(r.unlabeled) > 0 {
+		report = report + fmt.Sprintf("Kubernetes nodes without an AWS providerID or instance-id label, which the roller can't cordon: %s\n", r.unlabeled)
+	}
+	if len(r.cordoned) > 0 {
+		report = report + fmt.Sprintf("Kubernetes nodes already cordoned: %s\n", r.cordoned)
+	}
+	return report
+}
+
+// Reconciles the instances of the cluster with its nodes before rolling,
+// reporting the mismatches to slack and deleting the stale nodes when asked
+// to, once EC2 confirms their instances are gone. Returns an error when too
+// many instances never joined the cluster, since rolling would make matters
+// worse.
+func checkNodeReconciliation(client kubernetesClient, ec2Controller *awsEc2Controller, instances []*ec2.Instance) error {
+	nodeList, err := client.getNodes(meta_v1.ListOptions{})
+	if err != nil {
+		glog.Errorf("an error occurred listing the kubernetes nodes, skipping their reconciliation.\nError %s", err)
+		return nil
+	}
+
+	r := reconcileNodes(instances, nodeList.Items)
+	report := r.String()
+	if report == "" {
+		glog.V(2).Infof("All the instances of cluster %s match a kubernetes node", kubernetesCluster)
+		return nil
+	}
+	glog.Infof("Cluster %s nodes reconciliation:\n%s", kubernetesCluster, report)
+
+	if deleteStaleNodes == "true" && len(r.stale) > 0 {
+		report = report + deleteNodesOfGoneInstances(client, ec2Controller, r)
+	}
+
+	allowed, err := resolveIntOrPercent(getMaxUnjoined(), r.nodeInstances)
+	if err != nil {
+		return fmt.Errorf("unable to parse ROLLER_MAX_UNJOINED_INSTANCES: %s", err)
+	}
+
+	if err := postSlackMessage(fmt.Sprintf("Cluster %s nodes reconciliation:\n%s", kubernetesCluster, report)); err != nil {
+		glog.Errorf("an error occurred posting to slack.\nError %s", err)
+	}
+
+	if len(r.unjoined) > allowed {
+		return fmt.Errorf("%d instances of cluster %s never joined it, more than the %d allowed by ROLLER_MAX_UNJOINED_INSTANCES, refusing to roll",
+			len(r.unjoined), kubernetesCluster, allowed)
+	}
+	return nil
+}
+
+// Deletes the stale nodes whose instances are terminated or no longer exist,
+// keeping those whose instances are merely out of the inventory of the
+// cluster, for instance stopped or untagged. Returns the report of the
+// deletions.
+func deleteNodesOfGoneInstances(client kubernetesClient, ec2Controller *awsEc2Controller, r *nodeReconciliation) string {
+	var instanceIDs []string
+	for _, name := range r.stale {
+		instanceIDs = append(instanceIDs, r.staleInstances[name])
+	}
+	gone, err := ec2Controller.goneInstances(instanceIDs)
+	if err != nil {
+		glog.Errorf("an error occurred describing the instances of the stale kubernetes nodes, keeping them.\nError %s", err)
+		return ""
+	}
+
+	var report string
+	for _, name := range r.stale {
+		if !containsString(gone, r.staleInstances[name]) {
+			glog.Infof("Keeping stale kubernetes node %s, its instance %s still exists outside of the cluster inventory", name, r.staleInstances[name])
+			report = report + fmt.Sprintf("Kept stale kubernetes node %s, its instance %s still exists\n", name, r.staleInstances[name])
+			continue
+		}
+		glog.V(2).Infof("Deleting stale kubernetes node %s", name)
+		if err := client.deleteNode(name); err != nil {
+			glog.Errorf("an error occurred deleting the kubernetes node %s.\nError %s", name, err)
+			continue
+		}
+		report = report + fmt.Sprintf("Deleted stale kubernetes node %s\n", name)
+	}
+	return report
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func fakeReconcileInstance(id, component string, launched time.Duration) *ec2.Instance {
+	return &ec2.Instance{
+		InstanceId: aws.String(id),
+		LaunchTime: aws.Time(time.Now().Add(-launched)),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("ServiceComponent"), Value: aws.String(component)},
+		},
+	}
+}
+
+func fakeReconcileNode(name, instanceID string, unschedulable bool) v1.Node {
+	node := v1.Node{}
+	node.Name = name
+	if instanceID != "" {
+		node.Labels = map[string]string{"instance-id": instanceID}
+	}
+	node.Spec.Unschedulable = unschedulable
+	return node
+}
+
+func TestReconcileNodes(t *testing.T) {
+	instances := []*ec2.Instance{
+		fakeReconcileInstance("i-joined", "k8s-node", time.Hour),
+		fakeReconcileInstance("i-unjoined", "k8s-node", time.Hour),
+		fakeReconcileInstance("i-booting", "k8s-node", time.Minute),
+		fakeReconcileInstance("i-etcd", "etcd", time.Hour),
+	}
+	nodes := []v1.Node{
+		fakeReconcileNode("joined", "i-joined", true),
+		fakeReconcileNode("stale", "i-gone", false),
+		fakeReconcileNode("unlabeled", "", false),
+	}
+
+	r := reconcileNodes(instances, nodes)
+	if r.nodeInstances != 3 {
+		t.Errorf("expected 3 instances running kubernetes, got %d", r.nodeInstances)
+	}
+	if len(r.unjoined) != 1 || r.unjoined[0] != "i-unjoined" {
+		t.Errorf("expected i-unjoined to be unjoined, got %v", r.unjoined)
+	}
+	if len(r.stale) != 1 || r.stale[0] != "stale" {
+		t.Errorf("expected the stale node, got %v", r.stale)
+	}
+	if len(r.unlabeled) != 1 || len(r.cordoned) != 1 || r.cordoned[0] != "joined" {
+		t.Errorf("got unexpected unlabeled %v and cordoned %v nodes", r.unlabeled, r.cordoned)
+	}
+}
+
+func TestCheckNodeReconciliation(t *testing.T) {
+	instances := []*ec2.Instance{
+		fakeReconcileInstance("i-fake-instanceid", "k8s-node", time.Hour),
+		fakeReconcileInstance("i-unjoined", "k8s-node", time.Hour),
+	}
+	client := newFakeClient()
+	ec2Controller := newFakeAwsClient().ec2
+
+	// i-unjoined has no node, and the node of i-fake-provider-instanceid is stale
+	maxUnjoinedStr = "0"
+	defer func() { maxUnjoinedStr = "" }()
+	if err := checkNodeReconciliation(client, ec2Controller, instances); err == nil {
+		t.Error("expected the roll to be refused but got nil")
+	}
+
+	// The stale node is kept while its instance exists outside of the inventory
+	stopped := fakeReconcileInstance("i-fake-provider-instanceid", "k8s-node", time.Hour)
+	stopped.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameStopped)}
+	fakeEc2Instances = []*ec2.Instance{stopped}
+	defer func() { fakeEc2Instances = nil }()
+	maxUnjoinedStr = "50%"
+	deleteStaleNodes = "true"
+	defer func() { deleteStaleNodes = "" }()
+	if err := checkNodeReconciliation(client, ec2Controller, instances); err != nil {
+		t.Errorf("expected the roll to go ahead, got %s", err)
+	}
+	nodes, _ := client.getNodes(meta_v1.ListOptions{})
+	if len(nodes.Items) != 2 {
+		t.Errorf("expected the stale node of the stopped instance to be kept, got %v", nodes.Items)
+	}
+
+	// And deleted once the instance is terminated
+	stopped.State.Name = aws.String(ec2.InstanceStateNameTerminated)
+	if err := checkNodeReconciliation(client, ec2Controller, instances); err != nil {
+		t.Errorf("expected the roll to go ahead, got %s", err)
+	}
+	nodes, _ = client.getNodes(meta_v1.ListOptions{})
+	if len(nodes.Items) != 1 || nodes.Items[0].Name != "fake-service" {
+		t.Errorf("expected only the stale node to be deleted, got %v", nodes.Items)
+	}
+}
@@ -9,11 +9,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/api/core/v1"
 
 	"strconv"
 
@@ -35,6 +37,15 @@ var (
 	kubernetesUsername       = os.Getenv("KUBERNETES_USERNAME")
 	kubernetesPassword       = os.Getenv("KUBERNETES_PASSWORD")
 	terminationWaitPeriodStr = os.Getenv("TERMINATION_WAIT_PERIOD_SECONDS")
+	terminationMinWaitStr    = os.Getenv("TERMINATION_MIN_WAIT_PERIOD_SECONDS")
+	drainTimeoutStr          = os.Getenv("ROLLER_DRAIN_TIMEOUT_SECONDS")
+	lifecycleHookTimeoutStr  = os.Getenv("ROLLER_LIFECYCLE_HOOK_TIMEOUT_SECONDS")
+	maxUnavailablePerAZStr   = os.Getenv("ROLLER_MAX_UNAVAILABLE_PER_AZ")
+	healthGateEnabled        = os.Getenv("ROLLER_HEALTH_GATE")
+	healthGateMaxPendingStr  = os.Getenv("ROLLER_HEALTH_GATE_MAX_PENDING_PODS")
+	healthGateMaxCrashStr    = os.Getenv("ROLLER_HEALTH_GATE_MAX_CRASHLOOP_INCREASE")
+	healthGateTimeoutStr     = os.Getenv("ROLLER_HEALTH_GATE_TIMEOUT_SECONDS")
+	healthGateMaxPauseStr    = os.Getenv("ROLLER_HEALTH_GATE_MAX_PAUSE_SECONDS")
 	state                    *rollerState
 	kubernetesCluster        string
 	targetComponents         []string
@@ -49,12 +60,17 @@ var (
 	clusterTerminatorServiceNamespace = "kube-system"
 	provisionAttemptCounter           = make(map[string]int)
 	terminationWaitPeriod             = time.Duration(180 * time.Second)
+	terminationMinWaitPeriod          = time.Duration(30 * time.Second)
+	spotBackfillAttempts              = 3
+	maxUnavailablePerAZ               = 0
 	apiKey                            = os.Getenv("DATADOG_API_KEY")
 	appKey                            = os.Getenv("DATADOG_APP_KEY")
-)
 
-const (
-	remainingThreshold = 10
+	// The validated ROLLER_MAX_UNAVAILABLE setting of each component
+	maxUnavailable = make(map[string]string)
+
+	// Guards state.components, which the components add themselves to as they start
+	componentsLock sync.Mutex
 )
 
 type componentType struct {
@@ -64,7 +80,41 @@ type componentType struct {
 	status    bool
 	instances []*ec2.Instance
 	asgs      []string
+	asgStatus []*asgType
 	err       error
+	// The lifecycle hooks the roller registered on the ASGs of the component
+	lifecycleHooks []string
+	// Why each instance was selected for replacement, by instance ID
+	reasons map[string]string
+	// The changes made to the ASGs of the component, and the ones which couldn't be reversed
+	journal     *asgJournal
+	restoreErrs []error
+	// The on-demand/spot split of the component before and after the roll
+	capacityBefore *capacityComposition
+	capacityAfter  *capacityComposition
+}
+
+// capacityComposition counts the instances of a component by capacity type
+type capacityComposition struct {
+	onDemand int
+	spot     int
+}
+
+func (c *capacityComposition) String() string {
+	if c == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d on-demand, %d spot", c.onDemand, c.spot)
+}
+
+// asgType tracks the replacement of the instances of a single ASG of a component
+type asgType struct {
+	name         string
+	desiredCount int
+	instances    []string
+	replaced     int
+	status       bool
+	err          error
 }
 
 type rollerState struct {
@@ -76,6 +126,7 @@ type rollerState struct {
 	clusterTerminator clusterTerminatorState
 	downtimeID        int
 	dd                *ddClientConfig
+	healthGate        *clusterHealthGate
 }
 
 type clusterAutoscalerState struct {
@@ -94,9 +145,17 @@ func timeStamp() string {
 	return time.Now().Format(time.RFC822)
 }
 
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
 func (s *rollerState) SlackPost() error {
+	return postSlackMessage(s.SlackText)
+}
+
+func postSlackMessage(text string) error {
 	client := &http.Client{}
-	b, err := json.Marshal(s)
+	b, err := json.Marshal(&slackMessage{Text: text})
 	if err != nil {
 		return err
 	}
@@ -122,23 +181,32 @@ func (s *rollerState) SlackPost() error {
 	return err
 }
 
-func (s *rollerState) Summary() error {
-	var summary string
-	status := "success"
-
+// Returns whether all the components and the cluster autoscaler were
+// handled successfully
+func (s *rollerState) succeeded() bool {
+	if rollContext.Err() != nil {
+		return false
+	}
 	for _, c := range s.components {
 		if !c.status {
-			status = "failure"
-			break
+			return false
 		}
 	}
+	return s.clusterAutoscaler.status != "failure"
+}
 
-	if s.clusterAutoscaler.status == "failure" {
+func (s *rollerState) Summary() error {
+	var summary string
+	status := "success"
+	if !s.succeeded() {
 		status = "failure"
 	}
 
 	duration := time.Since(s.startTime)
 	summary = fmt.Sprintf("Finished a rolling update on cluster %s with the components %+v as the target components.\nOverall status: %s\nOverall duration: %v\n", kubernetesCluster, targetComponents, status, duration-(duration%time.Minute))
+	if rollContext.Err() != nil {
+		summary = summary + "The rolling update was aborted\n"
+	}
 
 	for _, c := range s.components {
 		var status string
@@ -150,9 +218,31 @@ func (s *rollerState) Summary() error {
 		}
 
 		cs := fmt.Sprintf("Component %s status: %s - duration: %v\n", c.name, status, duration-(duration%time.Minute))
+		if (c.capacityBefore != nil && c.capacityBefore.spot > 0) || (c.capacityAfter != nil && c.capacityAfter.spot > 0) {
+			cs = cs + fmt.Sprintf("Component %s capacity before: %s - after: %s\n", c.name, c.capacityBefore, c.capacityAfter)
+		}
 		if c.err != nil {
 			cs = cs + fmt.Sprintf("Component %s error: %s\n", c.name, c.err)
 		}
+		for _, a := range c.asgStatus {
+			asgStatus := "not started"
+			if a.status {
+				asgStatus = "success"
+			} else if a.err != nil {
+				asgStatus = "failure"
+			}
+			cs = cs + fmt.Sprintf("  ASG %s status: %s - replaced %d/%d instances\n", a.name, asgStatus, a.replaced, len(a.instances))
+		}
+		if len(c.restoreErrs) > 0 {
+			cs = cs + fmt.Sprintf("Component %s ASG restore: failure - %s\n", c.name, c.restoreErrs)
+		} else if c.journal != nil && len(c.journal.asgs) > 0 {
+			cs = cs + fmt.Sprintf("Component %s ASG restore: success\n", c.name)
+		}
+		for _, instance := range c.instances {
+			if reason, ok := c.reasons[*instance.InstanceId]; ok {
+				cs = cs + fmt.Sprintf("  Instance %s: %s\n", *instance.InstanceId, reason)
+			}
+		}
 
 		summary = summary + cs
 	}
@@ -166,12 +256,15 @@ func (s *rollerState) Summary() error {
 
 func setReplicas(deployment, namespace string, replicas int32) error {
 	glog.V(4).Infof("Setting replicas to %d for deployment %s", replicas, deployment)
-	client := newClient(kubernetesServer, kubernetesUsername, kubernetesPassword)
+	client, err := newClient(kubernetesConfig)
+	if err != nil {
+		return err
+	}
 	deploymentController := kubernetesDeployment{
 		service:   deployment,
 		namespace: namespace,
 	}
-	_, err := setReplicasForDeployment(client, deploymentController, replicas)
+	_, err = setReplicasForDeployment(client, deploymentController, replicas)
 	return err
 }
 
@@ -233,30 +326,54 @@ func enableClusterTerminator(*rollerState) {
 
 func addComponentToState(awsClient *awsClient, component string, state *rollerState) (*componentType, error) {
 	myComponent := &componentType{
-		name:  component,
-		start: time.Now(),
+		name:    component,
+		start:   time.Now(),
+		journal: newASGJournal(),
 	}
 
-	// Get list of instances by filter on tag ServiceComponent == component
-	//	params.Filters = append(params.Filters, newEC2Filter("tag:ServiceComponent", "k8s-master"))
-	instances, err := awsClient.ec2.instancesMatchingTagValue("ServiceComponent", component, state.inventory)
+	// Get list of instances by filter on the component tag
+	instances, err := awsClient.ec2.instancesOfComponent(component, state.inventory)
+	if err != nil {
+		return myComponent, err
+	}
+
+	myComponent.capacityBefore = awsClient.ec2.getCapacityComposition(instances)
+
+	instances, myComponent.reasons, err = selectInstances(awsClient, component, instances)
 	if err != nil {
 		return myComponent, err
 	}
 	myComponent.instances = instances
 
-	asgs, err := awsClient.ec2.getUniqueTagValues("aws:autoscaling:groupName", instances)
+	asgs, err := awsClient.ec2.getUniqueTagValues(tags.asgKey, instances)
 	if err != nil {
 		return myComponent, err
 	}
 	myComponent.asgs = asgs
 
+	componentsLock.Lock()
 	state.components = append(state.components, myComponent)
+	componentsLock.Unlock()
 	return myComponent, nil
 }
 
+// Tracks the progress of each ASG of the component along with the instances belonging to it
+func addASGsToComponent(awsClient *awsClient, myComponent *componentType) {
+	for _, asg := range myComponent.asgs {
+		myASG := &asgType{
+			name: asg,
+		}
+		for _, instance := range myComponent.instances {
+			if awsClient.ec2.getTagValue(instance, tags.asgKey) == asg {
+				myASG.instances = append(myASG.instances, *instance.InstanceId)
+			}
+		}
+		myComponent.asgStatus = append(myComponent.asgStatus, myASG)
+	}
+}
+
 func validateEtcdInstances(awsClient *awsClient, component *componentType) error {
-	instances, err := awsClient.ec2.instancesMatchingTagValue("healthy", "True", component.instances)
+	instances, err := awsClient.ec2.instancesMatchingTagValue(tags.healthKey, tags.healthyValue, component.instances)
 	if err != nil {
 		return err
 	}
@@ -293,7 +410,7 @@ func replaceInstancesPrepare(awsClient *awsClient, component string, scalingProc
 
 	for _, asg := range myComponent.asgs {
 		glog.V(4).Infof("Suspending autoscaling processes for %s\n", asg)
-		_, err := awsClient.autoscaling.manageASGProcesses(asg, scalingProcesses, "suspend")
+		err := myComponent.journal.manageProcesses(awsClient, asg, scalingProcesses, "suspend")
 		if err != nil {
 			return myComponent, instanceList, fmt.Errorf("an error occurred while suspending processes on %s\n Error: %s", asg, err)
 		}
@@ -302,52 +419,132 @@ func replaceInstancesPrepare(awsClient *awsClient, component string, scalingProc
 	return myComponent, instanceList, nil
 }
 
-func resumeASGProcesses(awsClient *awsClient, scalingProcesses []*string, component *componentType) {
-	for _, asg := range component.asgs {
-		glog.V(4).Infof("Resuming autoscaling processes for %s\n", asg)
-		_, err := awsClient.autoscaling.manageASGProcesses(asg, scalingProcesses, "resume")
-		if err != nil {
-			glog.Errorf("an error occurred while resuming processes on %s\n Error: %s", asg, err)
-			component.status = false
+// Blocks until the cluster workloads pass the health gate, when it is enabled
+func waitForClusterHealth(myComponent *componentType) error {
+	if state.healthGate == nil {
+		return nil
+	}
+	kubernetesClient, err := newClient(kubernetesConfig)
+	if err == nil {
+		err = state.healthGate.wait(kubernetesClient, myComponent.name)
+	}
+	if err != nil {
+		err = fmt.Errorf("the cluster health gate failed for component %s\n Error: %s", myComponent.name, err)
+		glog.V(4).Infof("%s", err)
+	}
+	return err
+}
+
+// Returns the instances of the list which have a kubernetes node, the only ones
+// to cordon and drain. The instances which never joined the cluster are
+// replaced all the same: the nodes reconciliation has already refused to roll
+// when there are more of them than ROLLER_MAX_UNJOINED_INSTANCES allows.
+func instancesWithNodes(kubernetesClient kubernetesClient, component string, instanceList []string) ([]string, error) {
+	if !runsKubernetesNode(component) {
+		return nil, nil
+	}
+
+	nodes, err := kubernetesNodes{}.getNodesByInstanceID(kubernetesClient, instanceList)
+	if nodes == nil {
+		return nil, fmt.Errorf("unable to find the kubernetes nodes of instances %s: %s", instanceList, err)
+	}
+	if err != nil {
+		glog.Infof("Replacing the instances of %s without cordoning them: %s", component, err)
+	}
+
+	var nodeInstances []string
+	for _, instanceID := range instanceList {
+		if _, ok := nodes[instanceID]; ok {
+			nodeInstances = append(nodeInstances, instanceID)
 		}
 	}
+	return nodeInstances, nil
 }
 
+// Cordons the nodes of the given instances. The instances without a node don't
+// keep the others from being cordoned, and are reported in the error once they
+// are.
 func cordonKubernetesNodes(kubernetesClient kubernetesClient, instanceList []string) error {
 	nodesController := kubernetesNodes{}
-	labels := make(map[string]string)
 	var nodeListToCordon []v1.Node
 
 	glog.V(4).Infof("Fetching kubernetes nodes for instance IDs: %s\n", instanceList)
+	nodes, missingErr := nodesController.getNodesByInstanceID(kubernetesClient, instanceList)
+	if nodes == nil {
+		return fmt.Errorf("failed to cordon nodes: %s", missingErr)
+	}
 	for _, instanceID := range instanceList {
-		labels["instance-id"] = instanceID
-		nodeList, err := nodesController.getNodesByLabel(kubernetesClient, labels)
-		if err != nil {
-			return fmt.Errorf("failed to populate node by label: %s", err)
+		if node, ok := nodes[instanceID]; ok {
+			nodeListToCordon = append(nodeListToCordon, node)
 		}
-		nodeListToCordon = append(nodeListToCordon, nodeList.Items...)
 	}
 
 	nodesFail := make(map[string]error)
 	for _, node := range nodeListToCordon {
 		glog.V(4).Infof("Cordoning kubernetes node: %s\n", node.Name)
-		node.Spec.Unschedulable = true
-		node := &node
-		updatedNode, err := nodesController.updateNode(kubernetesClient, node)
+		updatedNode, err := nodesController.setUnschedulable(kubernetesClient, node.Name, true)
 		if err != nil {
 			nodesFail[node.Name] = err
+			continue
 		}
 		if !updatedNode.Spec.Unschedulable {
 			nodesFail[node.Name] = fmt.Errorf("failed for unknown reason")
 		}
 	}
 
-	if len(nodesFail) > 0 {
+	switch {
+	case len(nodesFail) > 0 && missingErr != nil:
+		return fmt.Errorf("failed to cordon nodes: %s, and %s", nodesFail, missingErr)
+	case len(nodesFail) > 0:
 		return fmt.Errorf("failed to cordon nodes: %s", nodesFail)
+	case missingErr != nil:
+		return fmt.Errorf("failed to cordon nodes: %s", missingErr)
 	}
 	return nil
 }
 
+// Replaces the instances of a component with the strategy configured for it
+func replaceInstances(awsClient *awsClient, component, ansibleVersion string, wg *sync.WaitGroup) error {
+	// The nodes wait for the masters, which may have been aborted in the meantime
+	if rollContext.Err() != nil {
+		wg.Done()
+		return fmt.Errorf("not rolling %s: %s", component, errRollAborted)
+	}
+
+	strategy, err := getStrategy(component)
+	if err != nil {
+		wg.Done()
+		return err
+	}
+	glog.V(2).Infof("Replacing %s instances with the %s strategy", component, strategy)
+
+	switch strategy {
+	case strategyVerifyAndTerminate:
+		settings, err := getSurgeSettings(component)
+		if err != nil {
+			wg.Done()
+			return err
+		}
+		return replaceInstancesVerifyAndTerminate(awsClient, component, ansibleVersion, settings, wg)
+	case strategyWave:
+		// Waves are surges limited to the wave size, draining the old nodes
+		settings, err := getWaveSettings(component)
+		if err != nil {
+			wg.Done()
+			return err
+		}
+		return replaceInstancesVerifyAndTerminate(awsClient, component, ansibleVersion, settings, wg)
+	case strategyInstanceRefresh:
+		settings, err := getInstanceRefreshSettings(component)
+		if err != nil {
+			wg.Done()
+			return err
+		}
+		return replaceInstancesWithInstanceRefresh(awsClient, component, ansibleVersion, settings, wg)
+	}
+	return replaceInstancesTerminateAndVerify(awsClient, component, ansibleVersion, wg)
+}
+
 // Terminates and checks one or more instances at a time, in a "rolling" fashion. Differs from
 // replaceInstancesVerifyAndTerminate() in that it terminates the instances before verifying replacements.
 // Useful for small ASGs or when there is an upper limit to the number of instances you can have in the an ASG.
@@ -364,26 +561,52 @@ func replaceInstancesTerminateAndVerify(awsClient *awsClient, component, ansible
 	}
 
 	myComponent, _, err := replaceInstancesPrepare(awsClient, component, scalingProcesses)
+
+	// Whatever happens next, put the ASGs back the way we found them
+	defer restoreASGs(awsClient, myComponent)
+
 	if err != nil {
 		err = fmt.Errorf("an error occurred while preparing for instance replacement for %s\n Error: %s", myComponent.name, err)
 		glog.V(4).Infof("%s", err)
 		return err
 	}
 
-	// Defer resume autoscaling activities
-	defer resumeASGProcesses(awsClient, scalingProcesses, myComponent)
+	if lifecycleHooksEnabled(component) {
+		err = addLifecycleHooks(awsClient, myComponent, true)
+		if err != nil {
+			myComponent.err = err
+			glog.V(4).Infof("%s", err)
+			return err
+		}
+	}
+
+	kubernetesClient, err := newClient(kubernetesConfig)
+	if err != nil {
+		myComponent.err = err
+		glog.V(4).Infof("%s", err)
+		return err
+	}
 
 	glog.V(4).Infof("Starting instance termination verify loop for component %s", myComponent.name)
 	for _, n := range myComponent.instances {
 		terminateTime := time.Now()
-		r, err := awsClient.ec2.terminateInstance(*n.InstanceId)
-		if err != nil {
-			err = fmt.Errorf("an error occurred while terminating %s instance %s\n Error: %s\n Response: %s", myComponent.name, *n.InstanceId, err, r)
-			glog.V(4).Infof("%s", err)
-			return err
+		asg := awsClient.ec2.getTagValue(n, tags.asgKey)
+		if asg != "" && myComponent.hasLifecycleHook(drainLifecycleHookName) {
+			err = terminateInstanceWithLifecycleHook(awsClient, kubernetesClient, asg, *n.InstanceId, false)
+			if err != nil {
+				glog.V(4).Infof("%s", err)
+				return err
+			}
+		} else {
+			r, err := awsClient.ec2.terminateInstance(*n.InstanceId)
+			if err != nil {
+				err = fmt.Errorf("an error occurred while terminating %s instance %s\n Error: %s\n Response: %s", myComponent.name, *n.InstanceId, err, r)
+				glog.V(4).Infof("%s", err)
+				return err
+			}
 		}
 
-		_, err = findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, newInstanceRollingCount, terminateTime)
+		_, err = findAndVerifyReplacementInstances(awsClient, myComponent, asg, ansibleVersion, newInstanceRollingCount, terminateTime)
 		if err != nil {
 			return err
 		}
@@ -399,7 +622,8 @@ func replaceInstancesTerminateAndVerify(awsClient *awsClient, component, ansible
 // Spins up new replacement instances, verifies them, and then terminates the old instances. Differs from
 // replaceInstancesTerminateAndVerify() in that it verifies replacements before terminating the old instances.
 // Useful for large ASGs when there is no upper limit to the number of instances you can have in the ASG.
-func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string, ansibleVersion string, wg *sync.WaitGroup) error {
+// Each ASG of the component is replaced independently, and the component only succeeds when all of them do.
+func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string, ansibleVersion string, settings *surgeSettings, wg *sync.WaitGroup) error {
 	glog.V(4).Infof("Starting process to start new instances and terminate existing for %s", component)
 
 	defer wg.Done()
@@ -408,193 +632,466 @@ func replaceInstancesVerifyAndTerminate(awsClient *awsClient, component string,
 		aws.String("AZRebalance"),
 		aws.String("Terminate"),
 	}
-	myComponent, instanceList, err := replaceInstancesPrepare(awsClient, component, scalingProcesses)
+	if settings.decrement {
+		scalingProcesses = []*string{
+			aws.String("AZRebalance"),
+		}
+	}
+	myComponent, _, err := replaceInstancesPrepare(awsClient, component, scalingProcesses)
+
+	// Whatever happens next, put the ASGs back the way we found them
+	defer restoreASGs(awsClient, myComponent)
+
 	if err != nil {
 		err = fmt.Errorf("an error occurred while preparing for instance replacement for %s\n Error: %s", myComponent.name, err)
 		glog.V(4).Infof("%s", err)
 		return err
 	}
 
-	// Defer resume autoscaling activities
-	scalingProcesses = []*string{
-		aws.String("AZRebalance"),
-		aws.String("Terminate"),
-		aws.String("Launch"),
+	if lifecycleHooksEnabled(component) {
+		err = addLifecycleHooks(awsClient, myComponent, true)
+		if err != nil {
+			myComponent.err = err
+			glog.V(4).Infof("%s", err)
+			return err
+		}
 	}
-	defer resumeASGProcesses(awsClient, scalingProcesses, myComponent)
-
-	var desiredCount int
 
-	// Ensure the total current instance count is the same as the desired count of the ASG
-	for _, asg := range myComponent.asgs {
-		count, err := awsClient.autoscaling.getDesiredCount(asg)
-		desiredCount = int(count)
-		glog.V(4).Infof("Starting desired count for ASG %s is %d", asg, desiredCount)
+	// Each ASG is surged and replaced on its own, starting from its own desired count and instances
+	addASGsToComponent(awsClient, myComponent)
+	for _, myASG := range myComponent.asgStatus {
+		err = replaceASGInstances(awsClient, myComponent, myASG, settings)
 		if err != nil {
-			err = fmt.Errorf("got error when trying to get the desired count for ASG %s: %s. ", asg, err)
-			glog.V(4).Infof("%s", err)
+			myASG.err = err
+			myComponent.err = err
 			return err
 		}
-		if len(instanceList) != desiredCount {
-			err := fmt.Errorf("the desired count (%d) in the ASG %s does not match the number of instances in the instance list: %s. ", desiredCount, asg, instanceList)
-			glog.V(4).Infof("%s", err)
+		myASG.status = true
+	}
+
+	myComponent.status = true
+	myComponent.finish = time.Now()
+
+	glog.V(4).Infof("Completed normal instance verify and termination loop for component %s", myComponent.name)
+	return nil
+}
+
+// Surges a single ASG of the component and replaces its instances, in several waves when its max surge is
+// below its desired count.
+func replaceASGInstances(awsClient *awsClient, myComponent *componentType, myASG *asgType, settings *surgeSettings) error {
+	count, err := awsClient.autoscaling.getDesiredCount(myASG.name)
+	if err != nil {
+		err = fmt.Errorf("got error when trying to get the desired count for ASG %s: %s. ", myASG.name, err)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+	myASG.desiredCount = int(count)
+	glog.V(4).Infof("Starting desired count for ASG %s is %d", myASG.name, myASG.desiredCount)
+
+	// Ensure the current instance count is the same as the desired count of the ASG. Only some of the
+	// instances may have been selected for replacement.
+	instanceCount, err := awsClient.autoscaling.getInstanceCount(myASG.name)
+	if err != nil {
+		err = fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n Error: %s", myASG.name, err)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+	if instanceCount != myASG.desiredCount {
+		err = fmt.Errorf("the desired count (%d) in the ASG %s does not match the number of instances in the ASG (%d). ", myASG.desiredCount, myASG.name, instanceCount)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+
+	surge := settings.surgeCount(myASG.desiredCount)
+
+	// Ensure the ASG is allowed to grow enough before touching anything
+	err = preflightSurge(awsClient, myComponent, myASG, surge, settings)
+	if err != nil {
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+
+	for start := 0; start < len(myASG.instances); start += surge {
+		end := start + surge
+		if end > len(myASG.instances) {
+			end = len(myASG.instances)
+		}
+		glog.V(2).Infof("Replacing instances %d to %d out of %d in ASG %s", start+1, end, len(myASG.instances), myASG.name)
+
+		err = surgeAndReplaceInstances(awsClient, myComponent, myASG, myASG.instances[start:end], settings)
+		if err != nil {
 			return err
 		}
+		myASG.replaced = end
+
+		// Put the processes back the way replaceInstancesPrepare() left them for the next wave
+		if end < len(myASG.instances) && !settings.decrement {
+			err = myComponent.journal.manageProcesses(awsClient, myASG.name, []*string{aws.String("Launch")}, "resume")
+			if err != nil {
+				return fmt.Errorf("an error occurred while resuming processes on %s\n Error: %s", myASG.name, err)
+			}
+			err = myComponent.journal.manageProcesses(awsClient, myASG.name, []*string{aws.String("Terminate")}, "suspend")
+			if err != nil {
+				return fmt.Errorf("an error occurred while suspending processes on %s\n Error: %s", myASG.name, err)
+			}
+		}
 	}
 
-	// 5 seemed like a decent number to batch up our nodes.  This will create a larger number of ending nodes but the autoscaler will bring us back down.
-	desiredCountStep := 5
+	glog.V(2).Infof("Replaced all %d instances of ASG %s", len(myASG.instances), myASG.name)
+	return nil
+}
+
+// Grows the ASG by the number of old instances in batches, verifies the new instances, then cordons and
+// terminates the old instances and sets the desired count of the ASG back to what it was.
+func surgeAndReplaceInstances(awsClient *awsClient, myComponent *componentType, myASG *asgType, instanceList []string, settings *surgeSettings) error {
+	var err error
+
+	// Look the nodes up before surging, so that failing to list them doesn't leave the ASG surged
+	kubernetesClient, err := newClient(kubernetesConfig)
+	if err != nil {
+		return err
+	}
+	nodeInstances, err := instancesWithNodes(kubernetesClient, myComponent.name, instanceList)
+	if err != nil {
+		return err
+	}
 
-	desiredCountTarget := desiredCount * 2
+	desiredCount := myASG.desiredCount
+	desiredCountTarget := desiredCount + len(instanceList)
 	temporaryDesiredCount := desiredCount
 	var findNewCount int
 
-	for remaining := desiredCountTarget - temporaryDesiredCount; remaining != 0; {
+	for temporaryDesiredCount < desiredCountTarget {
 
 		// Ensure that someone named Derek didn't enable the autoscaler while we are rolling the cluster
 		disableClusterAutoscaler(state)
 
-		remaining = desiredCountTarget - temporaryDesiredCount
+		remaining := desiredCountTarget - temporaryDesiredCount
 		glog.V(4).Infof("Remaining nodes %d", remaining)
 
-		if remaining <= remainingThreshold {
+		if remaining <= settings.finalBatchThreshold || remaining <= settings.batchSize {
 			temporaryDesiredCount = desiredCountTarget
 			findNewCount = remaining
 		} else {
-			temporaryDesiredCount = temporaryDesiredCount + desiredCountStep
-			findNewCount = desiredCountStep
+			temporaryDesiredCount = temporaryDesiredCount + settings.batchSize
+			findNewCount = settings.batchSize
 		}
 
 		glog.V(4).Infof("desiredCount is %d, desiredCountTarget is %d and temporaryDesiredCount is %d", desiredCount, desiredCountTarget, temporaryDesiredCount)
 
 		creationTime := time.Now()
-		for _, asg := range myComponent.asgs {
-			glog.V(4).Infof("Setting desired count for ASG %s to %d", asg, temporaryDesiredCount)
-			_, err = awsClient.autoscaling.setDesiredCount(asg, int64(temporaryDesiredCount))
-			if err != nil {
-				err = fmt.Errorf("got error when trying to set the desired count for ASG %s: %s. ", asg, err)
-				glog.V(4).Infof("%s", err)
-				return err
-			}
+		glog.V(4).Infof("Setting desired count for ASG %s to %d", myASG.name, temporaryDesiredCount)
+		err = myComponent.journal.setDesiredCount(awsClient, myASG.name, int64(temporaryDesiredCount))
+		if err != nil {
+			err = fmt.Errorf("got error when trying to set the desired count for ASG %s: %s. ", myASG.name, err)
+			glog.V(4).Infof("%s", err)
+			return err
 		}
 
 		// Verify the new ec2 instances are created and that they are valid
-		newInstances, err := findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, findNewCount, creationTime)
+		newInstances, err := findAndVerifyReplacementInstances(awsClient, myComponent, myASG.name, ansibleVersion, findNewCount, creationTime)
 		glog.V(4).Infof("newInstances are %v", newInstances)
 		if err != nil {
 			return err
 		}
+
+		err = waitForClusterHealth(myComponent)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Mark all the old kubernetes nodes as unschedulable. This is necessary because during the following
 	// termination step, we do not want pods to be rescheduled on the old nodes
-	glog.V(4).Infof("Starting kubernetes cordon process for %s", myComponent.name)
-	kubernetesClient := newClient(kubernetesServer, kubernetesUsername, kubernetesPassword)
-	err = cordonKubernetesNodes(kubernetesClient, instanceList)
-	if err != nil {
-		err = fmt.Errorf("an error occurred attempting to cordon kubernetes nodes %s\n Error: %s", instanceList, err)
-		glog.V(4).Infof("%s", err)
-	}
+	if len(nodeInstances) > 0 {
+		glog.V(4).Infof("Starting kubernetes cordon process for %s", myComponent.name)
+		err = cordonKubernetesNodes(kubernetesClient, nodeInstances)
+		if err != nil {
+			return fmt.Errorf("an error occurred attempting to cordon kubernetes nodes %s\n Error: %s", nodeInstances, err)
+		}
 
-	// Suspend the launch process so the ASG doesn't backfill the instances we're about to terminate
-	scalingProcesses = []*string{
-		aws.String("Launch"),
+		if settings.drain {
+			glog.V(4).Infof("Starting kubernetes drain process for %s", myComponent.name)
+			err = drainKubernetesNodes(kubernetesClient, nodeInstances)
+			if err != nil {
+				return fmt.Errorf("an error occurred attempting to drain kubernetes nodes %s\n Error: %s", nodeInstances, err)
+			}
+		}
 	}
-	for _, asg := range myComponent.asgs {
-		_, err := awsClient.autoscaling.manageASGProcesses(asg, scalingProcesses, "suspend")
+
+	// When the terminations decrement the desired count the ASG never tries to backfill them, so there is
+	// no need to juggle its processes
+	if !settings.decrement {
+		// Suspend the launch process so the ASG doesn't backfill the instances we're about to terminate
+		err = myComponent.journal.manageProcesses(awsClient, myASG.name, []*string{aws.String("Launch")}, "suspend")
 		if err != nil {
-			return fmt.Errorf("an error occurred while suspending processes on %s\n Error: %s", asg, err)
+			return fmt.Errorf("an error occurred while suspending processes on %s\n Error: %s", myASG.name, err)
 		}
-	}
 
-	// We have to unlock the Terminate process otherwise the instances will never be evicted from the ASG
-	scalingProcesses = []*string{
-		aws.String("Terminate"),
+		// We have to unlock the Terminate process otherwise the instances will never be evicted from the ASG
+		err = myComponent.journal.manageProcesses(awsClient, myASG.name, []*string{aws.String("Terminate")}, "resume")
+		if err != nil {
+			return fmt.Errorf("an error occurred while resuming processes on %s\n Error: %s", myASG.name, err)
+		}
 	}
-	resumeASGProcesses(awsClient, scalingProcesses, myComponent)
 
-	// Terminate the original instances one at a time and sleep for sleepSeconds in between
-	err = terminateInstances(awsClient, instanceList, myComponent, terminationWaitPeriod)
+	// Terminate the original instances, waiting for their pods to be rescheduled in between
+	err = terminateInstances(awsClient, instanceList, myComponent, terminationMinWaitPeriod, terminationWaitPeriod, settings.decrement, settings.drain)
 	if err != nil {
 		return err
 	}
 
-	for _, asg := range myComponent.asgs {
-		asgOk := false
-		for loop := 0; loop < 30; loop++ {
-			instanceCount, err := awsClient.autoscaling.getInstanceCount(asg)
-			if err != nil {
-				err = fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n Error: %s", asg, err)
-				glog.V(4).Infof("%s", err)
-				return err
-			}
-			if instanceCount != desiredCount {
-				glog.V(4).Infof("Waiting for all nodes to terminate. Previous desired count for ASG %s must match the number"+
-					"of instances in the ASG", asg)
-				time.Sleep(30 * time.Second)
-				continue
-			}
-			glog.V(4).Infof("All old nodes in ASG %s have terminated", asg)
-			asgOk = true
-			break
-		}
-		if !asgOk {
-			err = fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n "+
-				"Error: Timed out waiting for instances to be removed from ASG", asg)
+	asgOk := false
+	for loop := 0; loop < 30; loop++ {
+		instanceCount, err := awsClient.autoscaling.getInstanceCount(myASG.name)
+		if err != nil {
+			err = fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n Error: %s", myASG.name, err)
 			glog.V(4).Infof("%s", err)
 			return err
 		}
+		if instanceCount != desiredCount {
+			glog.V(4).Infof("Waiting for all nodes to terminate. Previous desired count for ASG %s must match the number"+
+				"of instances in the ASG", myASG.name)
+			if err = sleepUnlessAborted(30 * time.Second); err != nil {
+				return err
+			}
+			continue
+		}
+		glog.V(4).Infof("All old nodes in ASG %s have terminated", myASG.name)
+		asgOk = true
+		break
+	}
+	if !asgOk {
+		err = fmt.Errorf("an error occurred attempting to validate number of instances in ASG %s\n "+
+			"Error: Timed out waiting for instances to be removed from ASG", myASG.name)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+
+	// Each termination already took one off the desired count
+	if settings.decrement {
+		return nil
 	}
 
 	// Set desired count back to what it was originally
-	for _, asg := range myComponent.asgs {
-		glog.V(4).Infof("Setting desired count for ASG %s to %d", asg, desiredCount)
-		_, err = awsClient.autoscaling.setDesiredCount(asg, int64(desiredCount))
-		if err != nil {
-			err = fmt.Errorf("got error when trying to set the desired count for ASG %s: %s. ", asg, err)
-			glog.V(4).Infof("%s", err)
-			return err
+	glog.V(4).Infof("Setting desired count for ASG %s to %d", myASG.name, desiredCount)
+	err = myComponent.journal.setDesiredCount(awsClient, myASG.name, int64(desiredCount))
+	if err != nil {
+		err = fmt.Errorf("got error when trying to set the desired count for ASG %s: %s. ", myASG.name, err)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
+	return nil
+}
+
+// Terminates the instances, up to ROLLER_MAX_UNAVAILABLE at a time overall and ROLLER_MAX_UNAVAILABLE_PER_AZ
+// at a time within an availability zone. After each termination the slot is only released once the pods of
+// the terminated node are Running elsewhere, waiting for at least minWait and at most maxWait.
+func terminateInstances(awsClient *awsClient, instanceList []string, myComponent *componentType, minWait, maxWait time.Duration, decrement, drained bool) error {
+	// The setting was validated at startup, only percentages depend on the number of instances
+	limit, err := resolveIntOrPercent(maxUnavailable[myComponent.name], len(instanceList))
+	if err != nil || limit < 1 {
+		limit = 1
+	}
+	glog.V(2).Infof("Starting instance termination for %s nodes, %d at a time", myComponent.name, limit)
+
+	kubernetesClient, err := newClient(kubernetesConfig)
+	if err != nil {
+		return err
+	}
+
+	zones := make(map[string]string)
+	for _, instance := range myComponent.instances {
+		if instance.Placement != nil {
+			zones[*instance.InstanceId] = aws.StringValue(instance.Placement.AvailabilityZone)
 		}
 	}
 
-	myComponent.status = true
-	myComponent.finish = time.Now()
+	instancesFail := runTerminations(instanceList, zones, limit, maxUnavailablePerAZ,
+		func() error {
+			return waitForClusterHealth(myComponent)
+		},
+		func(instanceID string) error {
+			return terminateInstanceAndWait(awsClient, kubernetesClient, instanceID, myComponent, minWait, maxWait, decrement, drained)
+		})
 
-	glog.V(4).Infof("Completed normal instance verify and termination loop for component %s", myComponent.name)
+	if len(instancesFail) > 0 {
+		err := fmt.Errorf("failed to terminate %d/%d %s instances: %s", len(instancesFail), len(instanceList), myComponent.name, instancesFail)
+		glog.V(4).Infof("%s", err)
+		return err
+	}
 	return nil
 }
 
-func terminateInstances(awsClient *awsClient, instanceList []string, myComponent *componentType, sleepSeconds time.Duration) error {
-	glog.V(2).Infof("Starting instance termination for %s nodes", myComponent.name)
-	for _, instanceID := range instanceList {
+// Runs terminate on the instances in the order of instanceList, which the selection of the instances to
+// replace relies on, with at most limit of them in flight overall and perAZ of them within an availability
+// zone when perAZ is set. Waits for the cluster health before each termination but the first, and skips the
+// remaining instances after a failure. Returns the errors by instance.
+func runTerminations(instanceList []string, zones map[string]string, limit, perAZ int, waitForHealth func() error, terminate func(instanceID string) error) map[string]error {
+	budget := make(chan struct{}, limit)
+	zoneBudgets := make(map[string]chan struct{})
+	if perAZ > 0 {
+		for _, instanceID := range instanceList {
+			if _, ok := zoneBudgets[zones[instanceID]]; !ok {
+				zoneBudgets[zones[instanceID]] = make(chan struct{}, perAZ)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	instancesFail := make(map[string]error)
+
+	for i, instanceID := range instanceList {
+		zoneBudget, zoned := zoneBudgets[zones[instanceID]]
+		if zoned {
+			zoneBudget <- struct{}{}
+		}
+		budget <- struct{}{}
+		release := func() {
+			<-budget
+			if zoned {
+				<-zoneBudget
+			}
+		}
+
+		mu.Lock()
+		abort := len(instancesFail) > 0
+		mu.Unlock()
+
+		var err error
+		if rollContext.Err() != nil {
+			err = errRollAborted
+		} else if abort {
+			err = fmt.Errorf("skipped after a previous failure")
+		} else if i > 0 {
+			err = waitForHealth()
+		}
+		if err != nil {
+			mu.Lock()
+			instancesFail[instanceID] = err
+			mu.Unlock()
+			release()
+			continue
+		}
+
+		wg.Add(1)
+		go func(instanceID string, release func()) {
+			defer wg.Done()
+			defer release()
+			if err := terminate(instanceID); err != nil {
+				mu.Lock()
+				instancesFail[instanceID] = err
+				mu.Unlock()
+			}
+		}(instanceID, release)
+	}
+	wg.Wait()
+	return instancesFail
+}
+
+// Terminates an instance and waits for its pods to be rescheduled. With decrement, the instance is terminated
+// through its ASG and the desired count of the ASG is decremented, so that it is not replaced. The pods of a
+// node which was neither drained nor drained by our terminating hook are only evicted by the node controller
+// minutes after the termination, so we wait for the maximum period for those.
+func terminateInstanceAndWait(awsClient *awsClient, kubernetesClient kubernetesClient, instanceID string, myComponent *componentType, minWait, maxWait time.Duration, decrement, drained bool) error {
+	asg := instanceASG(awsClient, myComponent, instanceID)
+	hooked := asg != "" && myComponent.hasLifecycleHook(drainLifecycleHookName)
+
+	var snapshot *nodeWorkloadSnapshot
+	var err error
+	if drained || hooked {
+		snapshot, err = snapshotNodeWorkloads(kubernetesClient, instanceID)
+		if err != nil {
+			glog.V(4).Infof("Unable to find the pods running on %s, will wait %s after termination. Error: %s", instanceID, maxWait, err)
+		}
+	}
+
+	// When our terminating hook is registered the node is drained before the instance goes away, so there
+	// is no point in waiting for the ASG to notice the termination
+	if hooked {
+		err = terminateInstanceWithLifecycleHook(awsClient, kubernetesClient, asg, instanceID, decrement)
+		if err != nil {
+			glog.V(4).Infof("%s", err)
+			return err
+		}
+		minWait = 0
+	} else if decrement {
+		response, err := awsClient.autoscaling.terminateInstanceInASG(instanceID, true)
+		if err != nil {
+			err = fmt.Errorf("an error occurred while terminating %s instance %s\n Error: %s\n Response: %s", myComponent.name, instanceID, err, response)
+			glog.V(4).Infof("%s", err)
+			return err
+		}
+	} else {
 		response, err := awsClient.ec2.terminateInstance(instanceID)
 		if err != nil {
 			err = fmt.Errorf("an error occurred while terminating %s instance %s\n Error: %s\n Response: %s", myComponent.name, instanceID, err, response)
 			glog.V(4).Infof("%s", err)
 			return err
 		}
-		glog.V(2).Infof("Waiting %s for %s to terminate", sleepSeconds, instanceID)
-		time.Sleep(sleepSeconds)
 	}
+	glog.V(2).Infof("Waiting between %s and %s for %s to terminate", minWait, maxWait, instanceID)
+	waitForRescheduling(kubernetesClient, snapshot, minWait, maxWait)
 	return nil
 }
 
-func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *componentType, ansibleVersion string, desiredCount int, creationTime time.Time) ([]string, error) {
+// Returns the ASG of one of the instances of the component, or an empty string if it is unknown
+func instanceASG(awsClient *awsClient, myComponent *componentType, instanceID string) string {
+	for _, instance := range myComponent.instances {
+		if aws.StringValue(instance.InstanceId) == instanceID {
+			return awsClient.ec2.getTagValue(instance, tags.asgKey)
+		}
+	}
+	return ""
+}
+
+// Waits for desiredCount new instances of the component launched after creationTime, in the given ASG
+// unless it is empty, and verifies that they become healthy.
+func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *componentType, asg string, ansibleVersion string, desiredCount int, creationTime time.Time) ([]string, error) {
 	if _, ok := provisionAttemptCounter[myComponent.name]; ok {
 		provisionAttemptCounter[myComponent.name]++
 	} else {
 		provisionAttemptCounter[myComponent.name] = 1
 	}
 
-	// Wait for all new nodes to come up before continuing
-	newInstances, err := awsClient.ec2.findReplacementInstances(myComponent, ansibleVersion, desiredCount, creationTime)
+	var newInstances, instances, interrupted []string
+
+	watcher, err := newLaunchFailureWatcher(awsClient, myComponent, asg, creationTime)
 	if err != nil {
-		err = fmt.Errorf("an error occurred finding the replacement instances for component %s\n Error: %s", myComponent.name, err)
-		glog.V(4).Infof("%s", err)
 		return newInstances, err
 	}
 
-	instances, err := awsClient.ec2.verifyReplacementInstances(myComponent, newInstances)
+	// Wait for all new nodes to come up before continuing. New spot instances interrupted on the way are
+	// backfilled by the ASG. The instances already verified are kept, and we only look for and verify as many
+	// backfills, launched after the interruption, as there were interrupted instances.
+	count, since := desiredCount, creationTime
+	for attempt := 0; ; attempt++ {
+		var found []string
+		found, err = awsClient.ec2.findReplacementInstances(myComponent, asg, ansibleVersion, count, since, watcher)
+		newInstances = append(newInstances, found...)
+		if err != nil {
+			err = fmt.Errorf("an error occurred finding the replacement instances for component %s\n Error: %s", myComponent.name, err)
+			glog.V(4).Infof("%s", err)
+			return newInstances, err
+		}
+
+		verifyStart := time.Now()
+		instances, interrupted, err = awsClient.ec2.verifyReplacementInstances(myComponent, found)
+		for _, instance := range interrupted {
+			newInstances = removeString(newInstances, instance)
+		}
+		if len(interrupted) == 0 || (err != nil && len(instances) > 0) {
+			break
+		}
+		if attempt >= spotBackfillAttempts {
+			err = fmt.Errorf("spot instances %s of component %s were interrupted and we gave up waiting for their backfill", interrupted, myComponent.name)
+			glog.Error(err)
+			return interrupted, err
+		}
+		glog.Infof("New %s instances %s were interrupted, waiting for the ASG to backfill them", myComponent.name, interrupted)
+		count, since = len(interrupted), verifyStart
+	}
 	if err != nil {
 		if len(instances) > 0 {
 			startingInstanceCount := len(newInstances)
@@ -627,8 +1124,8 @@ func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *compon
 				}
 				glog.Infof("Failed to find valid replacement %s instances. Trying again", myComponent.name)
 				now := time.Now()
-				terminateInstances(awsClient, instances, myComponent, time.Duration(30*time.Second))
-				findAndVerifyReplacementInstances(awsClient, myComponent, ansibleVersion, len(instances), now)
+				terminateInstances(awsClient, instances, myComponent, time.Duration(30*time.Second), time.Duration(30*time.Second), false, false)
+				findAndVerifyReplacementInstances(awsClient, myComponent, asg, ansibleVersion, len(instances), now)
 			}
 			glog.Errorf("%s", err)
 			return instances, err
@@ -639,6 +1136,15 @@ func findAndVerifyReplacementInstances(awsClient *awsClient, myComponent *compon
 		glog.V(4).Infof("%s", err)
 		return newInstances, err
 	}
+
+	// The new instances are healthy, let them out of our launching hook
+	if asg != "" && myComponent.hasLifecycleHook(verifyLifecycleHookName) {
+		err = completeLaunchingInstances(awsClient, myComponent, asg)
+		if err != nil {
+			glog.V(4).Infof("%s", err)
+			return newInstances, err
+		}
+	}
 	return newInstances, nil
 }
 
@@ -646,8 +1152,6 @@ func main() {
 	flag.Parse()
 	flag.Lookup("logtostderr").Value.Set("true")
 
-	_ = os.Setenv("AWS_SDK_LOAD_CONFIG", "true")
-
 	if rollerLogLevel != "" {
 		flag.Lookup("v").Value.Set(rollerLogLevel)
 	} else {
@@ -656,7 +1160,29 @@ func main() {
 
 	glog.Info("Log level set to: ", flag.Lookup("v").Value)
 
-	kubernetesCluster = fmt.Sprintf("%s-%s-%s", awsAccount, awsRegion, cluster)
+	schema, err := getTagSchema()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	tags = schema
+	kubernetesCluster = tags.clusterName(awsAccount, awsRegion, cluster)
+
+	// The inventory lists the nodes when the configuration allows it, and the
+	// fleet leaves it to the roller of each cluster
+	kubernetesConfig, err = getKubernetesConfig()
+	if err != nil && flag.Arg(0) != "inventory" && !fleetMode() {
+		glog.Fatal(err)
+	}
+
+	if flag.Arg(0) == "inventory" {
+		runInventory(flag.Args()[1:])
+		return
+	}
+
+	if fleetMode() {
+		rollFleet()
+		return
+	}
 
 	switch {
 	case cluster == "":
@@ -669,12 +1195,6 @@ func main() {
 		glog.Fatal("Set the ANSIBLE_VERSION variable to the desired ansible git sha")
 	case slackToken == "":
 		glog.Fatal("Set the SLACK_WEBHOOK variable to desired webhook")
-	case kubernetesServer == "":
-		glog.Fatal("Set the KUBERNETES_SERVER variable to desired kubernetes server")
-	case kubernetesUsername == "":
-		glog.Fatal("Set the KUBERNETES_USERNAME variable to desired kubernetes username")
-	case kubernetesPassword == "":
-		glog.Fatal("Set the KUBERNETES_PASSWORD variable to desired kubernetes password")
 	case apiKey == "":
 		glog.Fatal("Set the DATADOG_API_KEY")
 	case appKey == "":
@@ -689,6 +1209,61 @@ func main() {
 		terminationWaitPeriod = (time.Duration(waitPeriod) * time.Second)
 	}
 
+	if terminationMinWaitStr != "" {
+		waitPeriod, err := strconv.ParseInt(terminationMinWaitStr, 10, 64)
+		if err != nil {
+			glog.Fatalf("Unable to parse TERMINATION_MIN_WAIT_PERIOD_SECONDS: %s", err)
+		}
+		terminationMinWaitPeriod = (time.Duration(waitPeriod) * time.Second)
+	}
+	if terminationMinWaitPeriod > terminationWaitPeriod {
+		terminationMinWaitPeriod = terminationWaitPeriod
+	}
+
+	if _, err := resolveIntOrPercent(getMaxUnjoined(), 100); err != nil {
+		glog.Fatalf("Unable to parse ROLLER_MAX_UNJOINED_INSTANCES: %s", err)
+	}
+
+	maxPerAZ, err := parseIntSetting("ROLLER_MAX_UNAVAILABLE_PER_AZ", maxUnavailablePerAZStr, 0)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	maxUnavailablePerAZ = maxPerAZ
+
+	drainTimeoutSeconds, err := parseIntSetting("ROLLER_DRAIN_TIMEOUT_SECONDS", drainTimeoutStr, 300)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	drainTimeout = time.Duration(drainTimeoutSeconds) * time.Second
+
+	hookTimeout, err := parseIntSetting("ROLLER_LIFECYCLE_HOOK_TIMEOUT_SECONDS", lifecycleHookTimeoutStr, 3600)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	lifecycleHookTimeout = int64(hookTimeout)
+
+	var healthGate *clusterHealthGate
+	if healthGateEnabled == "true" {
+		maxPending, err := parseIntSetting("ROLLER_HEALTH_GATE_MAX_PENDING_PODS", healthGateMaxPendingStr, 0)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		maxCrashLoopIncrease, err := parseIntSetting("ROLLER_HEALTH_GATE_MAX_CRASHLOOP_INCREASE", healthGateMaxCrashStr, 0)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		timeout, err := parseIntSetting("ROLLER_HEALTH_GATE_TIMEOUT_SECONDS", healthGateTimeoutStr, 600)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		maxPause, err := parseIntSetting("ROLLER_HEALTH_GATE_MAX_PAUSE_SECONDS", healthGateMaxPauseStr, 3600)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		healthGate = newClusterHealthGate(maxPending, maxCrashLoopIncrease,
+			time.Duration(timeout)*time.Second, time.Duration(maxPause)*time.Second)
+	}
+
 	// Are we going to roll all of etcd, k8s-master and k8s-node or just
 	// a subset.
 	if rollerComponents != "" {
@@ -697,18 +1272,57 @@ func main() {
 		targetComponents = defaultComponents
 	}
 
-	awsClient := newAwsClient()
-	params := &ec2.DescribeInstancesInput{}
-	params.Filters = []*ec2.Filter{
-		awsClient.ec2.newEC2Filter("tag:KubernetesCluster", kubernetesCluster),
-		awsClient.ec2.newEC2Filter("instance-state-name", "running"),
+	for _, component := range targetComponents {
+		if _, err := getStrategy(component); err != nil {
+			glog.Fatal(err)
+		}
+		if _, err := getSurgeSettings(component); err != nil {
+			glog.Fatal(err)
+		}
+		if _, err := getWaveSettings(component); err != nil {
+			glog.Fatal(err)
+		}
+		if _, err := getInstanceRefreshSettings(component); err != nil {
+			glog.Fatal(err)
+		}
+		if value, err := getMaxUnavailable(component); err != nil {
+			glog.Fatal(err)
+		} else {
+			maxUnavailable[component] = value
+		}
+		if _, _, err := getLaunchFailurePolicy(component); err != nil {
+			glog.Fatal(err)
+		}
+		if mode, err := getSelectionMode(component); err != nil {
+			glog.Fatal(err)
+		} else if mode == selectionAge {
+			if _, err := getMaxInstanceAge(component); err != nil {
+				glog.Fatal(err)
+			}
+		}
 	}
-	inv, err := awsClient.ec2.describeInstancesNotMatchingAnsibleVersion(params, ansibleVersion)
 
+	awsClient, err := newClusterAwsClient()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	// The instances to replace are selected per component
+	inv, err := describeClusterInstances(awsClient)
 	if err != nil {
 		glog.Fatalf("An error occurred getting the EC2 inventory: %s.\n", err)
 	}
 
+	if reconcileNodesDisabled != "true" {
+		kubernetesClient, err := newClient(kubernetesConfig)
+		if err == nil {
+			err = checkNodeReconciliation(kubernetesClient, awsClient.ec2, inv)
+		}
+		if err != nil {
+			postSlackMessage(err.Error())
+			glog.Fatal(err)
+		}
+	}
+
 	state = &rollerState{
 		startTime: time.Now(),
 		inventory: inv,
@@ -716,7 +1330,18 @@ func main() {
 			enabled: false,
 			status:  "success",
 		},
-		dd: newDataDogClient(apiKey, appKey),
+		dd:         newDataDogClient(apiKey, appKey),
+		healthGate: healthGate,
+	}
+
+	if healthGate != nil {
+		kubernetesClient, err := newClient(kubernetesConfig)
+		if err == nil {
+			err = healthGate.setBaseline(kubernetesClient)
+		}
+		if err != nil {
+			glog.Errorf("an error occurred taking the health gate baseline, it will be taken on the first check.\nError %s", err)
+		}
 	}
 
 	// Set downtime in datadog for the cluster
@@ -742,6 +1367,26 @@ func main() {
 		glog.Errorf("an error occurred posting to slack.\nError %s", err)
 	}
 
+	// When we are interrupted, the components stop at their next wait and put their ASGs back on their way
+	// out, and the summary is posted as usual. A second signal doesn't wait for them.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		glog.Errorf("Received %s, aborting the rolling update", sig)
+		abortRoll()
+		cancelActiveInstanceRefreshes(awsClient)
+
+		sig = <-signals
+		glog.Errorf("Received %s again, restoring the ASGs and exiting", sig)
+		componentsLock.Lock()
+		for _, component := range state.components {
+			restoreASGs(awsClient, component)
+		}
+		componentsLock.Unlock()
+		os.Exit(1)
+	}()
+
 	var wg sync.WaitGroup
 	var masterWg sync.WaitGroup
 
@@ -750,7 +1395,7 @@ func main() {
 		if component == "k8s-master" {
 			masterWg.Add(1)
 			go func(component string) {
-				err := replaceInstancesTerminateAndVerify(awsClient, component, ansibleVersion, &masterWg)
+				err := replaceInstances(awsClient, component, ansibleVersion, &masterWg)
 				if err != nil {
 					glog.Error(err)
 				}
@@ -763,15 +1408,11 @@ func main() {
 		if component != "k8s-master" {
 			wg.Add(1)
 			go func(component string) {
-				var err error
-				// Batch replace k8s-worker nodes and replace one at a time for etcd components
 				if component == "k8s-node" {
 					glog.V(2).Info("Waiting for any masters to complete before continuing with nodes")
 					masterWg.Wait()
-					err = replaceInstancesVerifyAndTerminate(awsClient, component, ansibleVersion, &wg)
-				} else {
-					err = replaceInstancesTerminateAndVerify(awsClient, component, ansibleVersion, &wg)
 				}
+				err := replaceInstances(awsClient, component, ansibleVersion, &wg)
 				if err != nil {
 					glog.Error(err)
 				}
@@ -782,6 +1423,19 @@ func main() {
 	wg.Wait()
 	masterWg.Wait()
 
+	// Report how the roll changed the on-demand/spot split of each component
+	for _, component := range state.components {
+		params := &ec2.DescribeInstancesInput{}
+		params.Filters = append(tags.componentFilters(component.name),
+			awsClient.ec2.newEC2Filter("instance-state-name", "running"))
+		instances, err := awsClient.ec2.describeInstances(params)
+		if err != nil {
+			glog.Errorf("an error occurred describing the instances of component %s.\nError %s", component.name, err)
+			continue
+		}
+		component.capacityAfter = awsClient.ec2.getCapacityComposition(instances)
+	}
+
 	if state.clusterAutoscaler.enabled {
 		enableClusterAutoscaler(state)
 		enableClusterTerminator(state)
@@ -798,4 +1452,8 @@ func main() {
 		glog.Errorf("an error occurred psting to slack.\nError %s", err)
 	}
 	glog.V(4).Infof("Slack Post: %s", state.SlackText)
+
+	if !state.succeeded() {
+		os.Exit(1)
+	}
 }
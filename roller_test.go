@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8s_testing "k8s.io/client-go/testing"
+)
+
+// Returns the tag of the instances of the cluster being rolled
+func fakeClusterTag() *ec2.Tag {
+	return &ec2.Tag{Key: aws.String(tags.expand(tags.clusterKey, "")), Value: aws.String(tags.expand(tags.clusterValue, ""))}
+}
+
+// Sets up ASGs of old k8s-node instances with the given desired counts, each
+// instance backed by a kubernetes node, and a fake kubernetes client. Returns
+// the component and a function restoring the fakes.
+func setFakeCluster(t *testing.T, desiredCounts map[string]int) (*componentType, func()) {
+	clientset := newFakeClientset()
+	myComponent := &componentType{name: "k8s-node", journal: newASGJournal()}
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{}
+	fakeEc2Instances = []*ec2.Instance{}
+	fakeSetDesiredCounts = nil
+
+	for asg, desiredCount := range desiredCounts {
+		group := &autoscaling.Group{
+			AutoScalingGroupName: aws.String(asg),
+			DesiredCapacity:      aws.Int64(int64(desiredCount)),
+			MaxSize:              aws.Int64(int64(2 * desiredCount)),
+			// Spot capacity isn't checked against the on-demand vCPU quota
+			MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{},
+		}
+		for i := 0; i < desiredCount; i++ {
+			instanceID := fmt.Sprintf("i-%s-old-%d", asg, i)
+			instance := &ec2.Instance{
+				InstanceId: aws.String(instanceID),
+				LaunchTime: aws.Time(time.Now().Add(-time.Hour)),
+				Placement:  &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+				Tags: []*ec2.Tag{
+					fakeClusterTag(),
+					{Key: aws.String(tags.componentKey), Value: aws.String(myComponent.name)},
+					{Key: aws.String(tags.asgKey), Value: aws.String(asg)},
+					{Key: aws.String(tags.versionKey), Value: aws.String("old")},
+					{Key: aws.String(tags.healthKey), Value: aws.String(tags.healthyValue)},
+				},
+			}
+			group.Instances = append(group.Instances, &autoscaling.Instance{InstanceId: aws.String(instanceID)})
+			fakeEc2Instances = append(fakeEc2Instances, instance)
+			myComponent.instances = append(myComponent.instances, instance)
+
+			node := &v1.Node{
+				ObjectMeta: meta_v1.ObjectMeta{Name: instanceID},
+				Spec:       v1.NodeSpec{ProviderID: "aws:///us-east-1a/" + instanceID},
+			}
+			if _, err := clientset.CoreV1().Nodes().Create(context.TODO(), node, meta_v1.CreateOptions{}); err != nil {
+				t.Fatalf("got error when creating node %s: %s", instanceID, err)
+			}
+		}
+		myComponent.asgs = append(myComponent.asgs, asg)
+		fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups = append(fakeDescribeAutoScalingGroupsOutput.AutoScalingGroups, group)
+	}
+
+	previousClient, previousState := newClient, state
+	previousMinWait, previousMaxWait := terminationMinWaitPeriod, terminationWaitPeriod
+	newClient = func(config *rest.Config) (kubernetesClient, error) {
+		return &kubernetesClientConfig{clientset: clientset}, nil
+	}
+	state = &rollerState{}
+	terminationMinWaitPeriod, terminationWaitPeriod = 0, 0
+
+	return myComponent, func() {
+		newClient, state = previousClient, previousState
+		terminationMinWaitPeriod, terminationWaitPeriod = previousMinWait, previousMaxWait
+		fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{}
+		fakeEc2Instances = nil
+		fakeSetDesiredCounts = nil
+	}
+}
+
+func TestReplaceASGInstancesMultipleASGs(t *testing.T) {
+	myComponent, restore := setFakeCluster(t, map[string]int{"infra-k8s-worker-a": 3, "infra-k8s-worker-b": 1})
+	defer restore()
+	awsClient := newFakeAwsClient()
+	settings := &surgeSettings{batchSize: 10, finalBatchThreshold: 10, maxSurge: "100%"}
+
+	myASGs := []*asgType{
+		{name: "infra-k8s-worker-a", instances: []string{"i-infra-k8s-worker-a-old-0", "i-infra-k8s-worker-a-old-1", "i-infra-k8s-worker-a-old-2"}},
+		{name: "infra-k8s-worker-b", instances: []string{"i-infra-k8s-worker-b-old-0"}},
+	}
+	for _, myASG := range myASGs {
+		if err := replaceASGInstances(awsClient, myComponent, myASG, settings); err != nil {
+			t.Fatalf("got error when replacing the instances of %s: %s", myASG.name, err)
+		}
+	}
+
+	if myASGs[0].desiredCount != 3 || myASGs[0].replaced != 3 {
+		t.Errorf("expected 3 of 3 instances replaced in ASG a, got %d of %d", myASGs[0].replaced, myASGs[0].desiredCount)
+	}
+	if myASGs[1].desiredCount != 1 || myASGs[1].replaced != 1 {
+		t.Errorf("expected 1 of 1 instance replaced in ASG b, got %d of %d", myASGs[1].replaced, myASGs[1].desiredCount)
+	}
+
+	// Each ASG is surged from its own desired count, then set back to it
+	expected := []string{"infra-k8s-worker-a=6", "infra-k8s-worker-a=3", "infra-k8s-worker-b=2", "infra-k8s-worker-b=1"}
+	var calls []string
+	for _, input := range fakeSetDesiredCounts {
+		calls = append(calls, fmt.Sprintf("%s=%d", *input.AutoScalingGroupName, *input.DesiredCapacity))
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("expected the desired counts %s, got %s", expected, calls)
+	}
+
+	for _, instance := range fakeEc2Instances {
+		if fakeHasTag(instance, tags.versionKey, "old") {
+			t.Errorf("expected old instance %s to be terminated", *instance.InstanceId)
+		}
+	}
+	if len(fakeEc2Instances) != 4 {
+		t.Errorf("expected 4 new instances, got %d", len(fakeEc2Instances))
+	}
+}
+
+func TestReplaceASGInstancesWithoutNode(t *testing.T) {
+	asg := "infra-k8s-worker"
+	myComponent, restore := setFakeCluster(t, map[string]int{asg: 2})
+	defer restore()
+	awsClient := newFakeAwsClient()
+	settings := &surgeSettings{batchSize: 10, finalBatchThreshold: 10, maxSurge: "100%", drain: true}
+
+	// The first instance never joined the cluster
+	client, _ := newClient(nil)
+	if err := client.(*kubernetesClientConfig).clientset.CoreV1().Nodes().Delete(context.TODO(), "i-infra-k8s-worker-old-0", meta_v1.DeleteOptions{}); err != nil {
+		t.Fatalf("got error when deleting the node: %s", err)
+	}
+
+	myASG := &asgType{name: asg, instances: []string{"i-infra-k8s-worker-old-0", "i-infra-k8s-worker-old-1"}}
+	if err := replaceASGInstances(awsClient, myComponent, myASG, settings); err != nil {
+		t.Fatalf("got error when replacing the instances: %s", err)
+	}
+	if myASG.replaced != 2 {
+		t.Errorf("expected 2 instances replaced, got %d", myASG.replaced)
+	}
+
+	node, err := client.(*kubernetesClientConfig).clientset.CoreV1().Nodes().Get(context.TODO(), "i-infra-k8s-worker-old-1", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("got error when getting the node: %s", err)
+	}
+	if !node.Spec.Unschedulable {
+		t.Errorf("expected the node of the joined instance to be cordoned")
+	}
+	for _, instance := range fakeEc2Instances {
+		if fakeHasTag(instance, tags.versionKey, "old") {
+			t.Errorf("expected old instance %s to be terminated", *instance.InstanceId)
+		}
+	}
+}
+
+func TestReplaceASGInstancesNodesUnavailable(t *testing.T) {
+	asg := "infra-k8s-worker"
+	myComponent, restore := setFakeCluster(t, map[string]int{asg: 2})
+	defer restore()
+	awsClient := newFakeAwsClient()
+	settings := &surgeSettings{batchSize: 10, finalBatchThreshold: 10, maxSurge: "100%"}
+
+	client, _ := newClient(nil)
+	client.(*kubernetesClientConfig).clientset.(*fake.Clientset).PrependReactor("list", "nodes", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("the server is unavailable")
+	})
+
+	myASG := &asgType{name: asg, instances: []string{"i-infra-k8s-worker-old-0", "i-infra-k8s-worker-old-1"}}
+	if err := replaceASGInstances(awsClient, myComponent, myASG, settings); err == nil {
+		t.Fatalf("expected an error when the nodes can't be listed")
+	}
+	if len(fakeSetDesiredCounts) != 0 {
+		t.Errorf("expected the ASG not to be surged, got %d desired count changes", len(fakeSetDesiredCounts))
+	}
+}
+
+func TestFindAndVerifyReplacementInstancesWaitsForSpotBackfills(t *testing.T) {
+	asg := "infra-k8s-worker"
+	myComponent, restore := setFakeCluster(t, map[string]int{asg: 2})
+	defer restore()
+	defer func() { fakeBeforeDescribeInstances = nil }()
+
+	newSpotInstance := func(instanceID string, launchTime time.Time) *ec2.Instance {
+		return &ec2.Instance{
+			InstanceId:        aws.String(instanceID),
+			InstanceLifecycle: aws.String("spot"),
+			LaunchTime:        aws.Time(launchTime),
+			Tags: []*ec2.Tag{
+				fakeClusterTag(),
+				{Key: aws.String(tags.componentKey), Value: aws.String(myComponent.name)},
+				{Key: aws.String(tags.asgKey), Value: aws.String(asg)},
+				{Key: aws.String(tags.healthKey), Value: aws.String(tags.healthyValue)},
+			},
+		}
+	}
+	creationTime := time.Now().Add(-time.Minute)
+	interrupted := newSpotInstance("i-new-0", creationTime.Add(time.Second))
+	fakeEc2Instances = append(fakeEc2Instances, interrupted, newSpotInstance("i-new-1", creationTime.Add(time.Second)))
+
+	// i-new-0 is reclaimed once found, while it is being verified, and the ASG backfills it
+	fakeDescribeInstancesCalls, fakeDescribedTagsResources = 0, nil
+	fakeBeforeDescribeInstances = func(calls int) {
+		if calls == 1 {
+			interrupted.StateReason = &ec2.StateReason{Code: aws.String("Server.SpotInstanceTermination")}
+			fakeEc2Instances = append(fakeEc2Instances, newSpotInstance("i-new-2", time.Now().Add(time.Second)))
+		}
+	}
+
+	newInstances, err := findAndVerifyReplacementInstances(newFakeAwsClient(), myComponent, asg, "new", 2, creationTime)
+	if err != nil {
+		t.Fatalf("got error when finding and verifying the replacement instances: %s", err)
+	}
+	if len(newInstances) != 2 || !containsString(newInstances, "i-new-1") || !containsString(newInstances, "i-new-2") {
+		t.Errorf("expected i-new-1 and its backfill i-new-2, got %s", newInstances)
+	}
+	// i-new-1 is verified once, and only the backfill is verified after the interruption
+	if fmt.Sprint(fakeDescribedTagsResources) != "[i-new-1 i-new-2]" {
+		t.Errorf("expected the health of i-new-1 then i-new-2 to be checked, got %s", fakeDescribedTagsResources)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+// launchSpec is what an ASG currently launches its instances with
+type launchSpec struct {
+	launchConfiguration   string
+	launchTemplateID      string
+	launchTemplateVersion string
+	imageID               string
+	// Empty when the ASG launches several instance types
+	instanceType string
+}
+
+// Resolves the launch configuration or launch template version an ASG currently uses
+func getASGLaunchSpec(awsClient *awsClient, group *autoscaling.Group) (*launchSpec, error) {
+	spec := &launchSpec{}
+
+	if name := aws.StringValue(group.LaunchConfigurationName); name != "" {
+		launchConfiguration, err := awsClient.autoscaling.getLaunchConfiguration(name)
+		if err != nil {
+			return spec, err
+		}
+		spec.launchConfiguration = name
+		spec.imageID = aws.StringValue(launchConfiguration.ImageId)
+		spec.instanceType = aws.StringValue(launchConfiguration.InstanceType)
+		return spec, nil
+	}
+
+	launchTemplate := group.LaunchTemplate
+	overrides := false
+	if group.MixedInstancesPolicy != nil && group.MixedInstancesPolicy.LaunchTemplate != nil {
+		launchTemplate = group.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+		overrides = len(group.MixedInstancesPolicy.LaunchTemplate.Overrides) > 0
+	}
+	if launchTemplate == nil {
+		return spec, fmt.Errorf("ASG %s has neither a launch configuration nor a launch template", aws.StringValue(group.AutoScalingGroupName))
+	}
+
+	version := aws.StringValue(launchTemplate.Version)
+	if version == "" {
+		version = "$Default"
+	}
+	launchTemplateVersion, err := awsClient.ec2.getLaunchTemplateVersion(aws.StringValue(launchTemplate.LaunchTemplateId),
+		aws.StringValue(launchTemplate.LaunchTemplateName), version)
+	if err != nil {
+		return spec, err
+	}
+	spec.launchTemplateID = aws.StringValue(launchTemplateVersion.LaunchTemplateId)
+	spec.launchTemplateVersion = fmt.Sprintf("%d", aws.Int64Value(launchTemplateVersion.VersionNumber))
+	if launchTemplateVersion.LaunchTemplateData != nil {
+		spec.imageID = aws.StringValue(launchTemplateVersion.LaunchTemplateData.ImageId)
+		if !overrides {
+			spec.instanceType = aws.StringValue(launchTemplateVersion.LaunchTemplateData.InstanceType)
+		}
+	}
+	return spec, nil
+}
+
+// Returns why the instance differs from the launch configuration or launch template of its ASG, or an empty
+// string if it doesn't
+func launchTemplateDrift(spec *launchSpec, asgInstance *autoscaling.Instance, instance *ec2.Instance) string {
+	if spec.launchConfiguration != "" {
+		if current := aws.StringValue(asgInstance.LaunchConfigurationName); current != spec.launchConfiguration {
+			return fmt.Sprintf("launch configuration %q differs from %s", current, spec.launchConfiguration)
+		}
+	} else if asgInstance.LaunchTemplate == nil {
+		return fmt.Sprintf("not launched from launch template %s", spec.launchTemplateID)
+	} else if current := aws.StringValue(asgInstance.LaunchTemplate.LaunchTemplateId); current != spec.launchTemplateID {
+		return fmt.Sprintf("launch template %s differs from %s", current, spec.launchTemplateID)
+	} else if current := aws.StringValue(asgInstance.LaunchTemplate.Version); current != spec.launchTemplateVersion {
+		return fmt.Sprintf("launch template version %s differs from %s", current, spec.launchTemplateVersion)
+	}
+
+	if current := aws.StringValue(instance.InstanceType); spec.instanceType != "" && current != spec.instanceType {
+		return fmt.Sprintf("instance type %s differs from %s", current, spec.instanceType)
+	}
+	return ""
+}
+
+func amiDrift(spec *launchSpec, instance *ec2.Instance) string {
+	if current := aws.StringValue(instance.ImageId); spec.imageID != "" && current != spec.imageID {
+		return fmt.Sprintf("AMI %s differs from %s", current, spec.imageID)
+	}
+	return ""
+}
+
+// byLaunchTime sorts instances oldest first
+type byLaunchTime []*ec2.Instance
+
+func (s byLaunchTime) Len() int      { return len(s) }
+func (s byLaunchTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLaunchTime) Less(i, j int) bool {
+	return aws.TimeValue(s[i].LaunchTime).Before(aws.TimeValue(s[j].LaunchTime))
+}
+
+// Selects the instances of a component to replace according to its selection mode, along with the reason
+// each of them was selected for.
+func selectInstances(awsClient *awsClient, component string, instances []*ec2.Instance) ([]*ec2.Instance, map[string]string, error) {
+	var selected []*ec2.Instance
+	reasons := make(map[string]string)
+
+	mode, err := getSelectionMode(component)
+	if err != nil {
+		return selected, reasons, err
+	}
+
+	var maxAge time.Duration
+	if mode == selectionAge {
+		maxAge, err = getMaxInstanceAge(component)
+		if err != nil {
+			return selected, reasons, err
+		}
+	}
+
+	// Drift is relative to the current launch specification of the ASG of each instance
+	specs := make(map[string]*launchSpec)
+	asgInstances := make(map[string]*autoscaling.Instance)
+	if mode == selectionLaunchTemplate || mode == selectionAMI {
+		asgs, err := awsClient.ec2.getUniqueTagValues(tags.asgKey, instances)
+		if err != nil {
+			return selected, reasons, err
+		}
+		for _, asg := range asgs {
+			group, err := awsClient.autoscaling.getASG(asg)
+			if err != nil {
+				return selected, reasons, err
+			}
+			specs[asg], err = getASGLaunchSpec(awsClient, group)
+			if err != nil {
+				return selected, reasons, fmt.Errorf("unable to get the launch specification of ASG %s: %s", asg, err)
+			}
+			for _, asgInstance := range group.Instances {
+				asgInstances[aws.StringValue(asgInstance.InstanceId)] = asgInstance
+			}
+		}
+	}
+
+	for _, instance := range instances {
+		instanceID := aws.StringValue(instance.InstanceId)
+		var reason string
+
+		switch mode {
+		case selectionTag:
+			if version := awsClient.ec2.getTagValue(instance, tags.versionKey); version != ansibleVersion {
+				reason = fmt.Sprintf("version tag %q differs from %s", version, ansibleVersion)
+			}
+		case selectionLaunchTemplate, selectionAMI:
+			spec, ok := specs[awsClient.ec2.getTagValue(instance, tags.asgKey)]
+			asgInstance, found := asgInstances[instanceID]
+			if !ok || !found {
+				glog.V(4).Infof("Instance %s of component %s is not part of an ASG, leaving it alone", instanceID, component)
+				continue
+			}
+			if mode == selectionLaunchTemplate {
+				reason = launchTemplateDrift(spec, asgInstance, instance)
+			} else {
+				reason = amiDrift(spec, instance)
+			}
+		case selectionAge:
+			if age := time.Since(aws.TimeValue(instance.LaunchTime)); age > maxAge {
+				reason = fmt.Sprintf("launched %d days ago (max %d)", int(age.Hours()/24), int(maxAge.Hours()/24))
+			}
+		case selectionAll:
+			reason = "all instances selected"
+		}
+
+		if reason != "" {
+			selected = append(selected, instance)
+			reasons[instanceID] = reason
+		}
+	}
+
+	// The oldest instances are the most overdue
+	if mode == selectionAge {
+		sort.Stable(byLaunchTime(selected))
+	}
+
+	glog.V(2).Infof("Selected %d/%d instances of component %s by %s", len(selected), len(instances), component, mode)
+	return selected, reasons, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func fakeASGInstance(instanceID, imageID, asg string) *ec2.Instance {
+	return &ec2.Instance{
+		InstanceId:   aws.String(instanceID),
+		ImageId:      aws.String(imageID),
+		InstanceType: aws.String("m5.large"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String(asg)},
+			{Key: aws.String("version"), Value: aws.String("v1")},
+		},
+	}
+}
+
+func setFakeLaunchTemplateASG(asg string) {
+	fakeDescribeAutoScalingGroupsOutput = &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String(asg),
+				LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+					LaunchTemplateId: aws.String("lt-fake"),
+					Version:          aws.String("$Latest"),
+				},
+				Instances: []*autoscaling.Instance{
+					{
+						InstanceId:     aws.String("i-current"),
+						LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-fake"), Version: aws.String("3")},
+					},
+					{
+						InstanceId:     aws.String("i-old"),
+						LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-fake"), Version: aws.String("2")},
+					},
+				},
+			},
+		},
+	}
+	fakeDescribeLaunchTemplateVersionsOutput = &ec2.DescribeLaunchTemplateVersionsOutput{
+		LaunchTemplateVersions: []*ec2.LaunchTemplateVersion{
+			{
+				LaunchTemplateId: aws.String("lt-fake"),
+				VersionNumber:    aws.Int64(3),
+				LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+					ImageId:      aws.String("ami-new"),
+					InstanceType: aws.String("m5.large"),
+				},
+			},
+		},
+	}
+}
+
+func TestSelectInstancesByTag(t *testing.T) {
+	ansibleVersion = "v2"
+	defer func() { ansibleVersion = "" }()
+
+	instances := []*ec2.Instance{fakeASGInstance("i-old", "ami-old", "infra-k8s-worker")}
+	selected, reasons, err := selectInstances(newFakeAwsClient(), "k8s-node", instances)
+	if err != nil {
+		t.Errorf("got error when selecting instances: %s", err)
+	}
+	if len(selected) != 1 || reasons["i-old"] == "" {
+		t.Errorf("expected i-old to be selected, got %v", reasons)
+	}
+}
+
+func TestSelectInstancesByLaunchTemplate(t *testing.T) {
+	os.Setenv("ROLLER_SELECTION", "launch-template")
+	defer os.Unsetenv("ROLLER_SELECTION")
+	setFakeLaunchTemplateASG("infra-k8s-worker")
+
+	instances := []*ec2.Instance{
+		fakeASGInstance("i-current", "ami-new", "infra-k8s-worker"),
+		fakeASGInstance("i-old", "ami-new", "infra-k8s-worker"),
+	}
+	selected, reasons, err := selectInstances(newFakeAwsClient(), "k8s-node", instances)
+	if err != nil {
+		t.Errorf("got error when selecting instances: %s", err)
+	}
+	if len(selected) != 1 || *selected[0].InstanceId != "i-old" {
+		t.Errorf("expected only i-old to be selected, got %v", reasons)
+	}
+	if reasons["i-old"] != "launch template version 2 differs from 3" {
+		t.Errorf("got unexpected reason: %s", reasons["i-old"])
+	}
+}
+
+func TestSelectInstancesByAMI(t *testing.T) {
+	os.Setenv("ROLLER_K8S_NODE_SELECTION", "ami")
+	defer os.Unsetenv("ROLLER_K8S_NODE_SELECTION")
+	setFakeLaunchTemplateASG("infra-k8s-worker")
+
+	instances := []*ec2.Instance{
+		fakeASGInstance("i-current", "ami-old", "infra-k8s-worker"),
+		fakeASGInstance("i-old", "ami-new", "infra-k8s-worker"),
+	}
+	selected, reasons, err := selectInstances(newFakeAwsClient(), "k8s-node", instances)
+	if err != nil {
+		t.Errorf("got error when selecting instances: %s", err)
+	}
+	if len(selected) != 1 || *selected[0].InstanceId != "i-current" {
+		t.Errorf("expected only i-current to be selected, got %v", reasons)
+	}
+}
+
+func TestSelectInstancesByAge(t *testing.T) {
+	os.Setenv("ROLLER_SELECTION", "age")
+	os.Setenv("ROLLER_MAX_INSTANCE_AGE_DAYS", "30")
+	defer os.Unsetenv("ROLLER_SELECTION")
+	defer os.Unsetenv("ROLLER_MAX_INSTANCE_AGE_DAYS")
+
+	day := 24 * time.Hour
+	instances := []*ec2.Instance{
+		fakeASGInstance("i-old", "ami-old", "infra-k8s-worker"),
+		fakeASGInstance("i-new", "ami-old", "infra-k8s-worker"),
+		fakeASGInstance("i-oldest", "ami-old", "infra-k8s-worker"),
+	}
+	instances[0].LaunchTime = aws.Time(time.Now().Add(-31 * day))
+	instances[1].LaunchTime = aws.Time(time.Now().Add(-2 * day))
+	instances[2].LaunchTime = aws.Time(time.Now().Add(-45 * day))
+
+	selected, reasons, err := selectInstances(newFakeAwsClient(), "k8s-node", instances)
+	if err != nil {
+		t.Errorf("got error when selecting instances: %s", err)
+	}
+	if len(selected) != 2 || *selected[0].InstanceId != "i-oldest" || *selected[1].InstanceId != "i-old" {
+		t.Errorf("expected i-oldest then i-old to be selected, got %v", reasons)
+	}
+	if reasons["i-oldest"] != "launched 45 days ago (max 30)" {
+		t.Errorf("got unexpected reason: %s", reasons["i-oldest"])
+	}
+}
+
+func TestGetSelectionModeInvalid(t *testing.T) {
+	os.Setenv("ROLLER_ETCD_SELECTION", "random")
+	defer os.Unsetenv("ROLLER_ETCD_SELECTION")
+
+	if _, err := getSelectionMode("etcd"); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns the value of a setting which can be overridden per component.
+// ROLLER_<COMPONENT>_<NAME> takes precedence over ROLLER_<NAME>, for instance
+// ROLLER_K8S_NODE_MAX_SURGE over ROLLER_MAX_SURGE.
+func componentSetting(component, name string) string {
+	prefix := strings.ToUpper(strings.Replace(component, "-", "_", -1))
+	if value := os.Getenv(fmt.Sprintf("ROLLER_%s_%s", prefix, name)); value != "" {
+		return value
+	}
+	return os.Getenv(fmt.Sprintf("ROLLER_%s", name))
+}
+
+// surgeSettings controls how replaceInstancesVerifyAndTerminate grows the ASGs
+// of a component before terminating the old instances.
+type surgeSettings struct {
+	// The number of new instances requested at a time
+	batchSize int
+	// When that many new instances or fewer remain, they are requested at once
+	finalBatchThreshold int
+	// The maximum number of extra instances, absolute or as a percentage of
+	// the desired count. Below 100% the component is rolled in several waves.
+	maxSurge string
+	// Whether the old nodes are drained before being terminated
+	drain bool
+	// Whether the old instances are terminated through their ASG, decrementing
+	// its desired count, rather than through EC2
+	decrement bool
+	// Whether the max size of the ASGs is raised for the duration of the roll
+	// when it doesn't allow the surge
+	raiseMaxSize bool
+}
+
+func getSurgeSettings(component string) (*surgeSettings, error) {
+	var err error
+	settings := &surgeSettings{
+		maxSurge: componentSetting(component, "MAX_SURGE"),
+	}
+
+	// 5 seemed like a decent number to batch up our nodes.  This will create a larger number of ending nodes but the autoscaler will bring us back down.
+	settings.batchSize, err = parseIntSetting("SURGE_BATCH_SIZE", componentSetting(component, "SURGE_BATCH_SIZE"), 5)
+	if err != nil {
+		return settings, err
+	}
+	if settings.batchSize < 1 {
+		return settings, fmt.Errorf("the surge batch size for %s must be at least 1", component)
+	}
+
+	settings.finalBatchThreshold, err = parseIntSetting("SURGE_FINAL_BATCH_THRESHOLD", componentSetting(component, "SURGE_FINAL_BATCH_THRESHOLD"), 10)
+	if err != nil {
+		return settings, err
+	}
+
+	if settings.maxSurge == "" {
+		settings.maxSurge = "100%"
+	}
+	settings.drain = componentSetting(component, "DRAIN") == "true"
+	settings.decrement = componentSetting(component, "DECREMENT_DESIRED_CAPACITY") == "true"
+	settings.raiseMaxSize = componentSetting(component, "RAISE_MAX_SIZE") == "true"
+	if _, err = resolveIntOrPercent(settings.maxSurge, 100); err != nil {
+		return settings, fmt.Errorf("unable to parse MAX_SURGE for %s: %s", component, err)
+	}
+	return settings, nil
+}
+
+// Returns the number or percentage of the old instances of a component which
+// are terminated at a time, one by default. etcd members are always terminated
+// one at a time so the etcd cluster keeps its quorum.
+func getMaxUnavailable(component string) (string, error) {
+	value := componentSetting(component, "MAX_UNAVAILABLE")
+	if value == "" || component == "etcd" {
+		return "1", nil
+	}
+	if _, err := resolveIntOrPercent(value, 100); err != nil {
+		return value, fmt.Errorf("unable to parse MAX_UNAVAILABLE for %s: %s", component, err)
+	}
+	return value, nil
+}
+
+// Whether the roller registers a launching lifecycle hook on the ASGs of the
+// component, so new instances only go in service once they are healthy. The
+// terminating hook is registered along with it to drain the old nodes. Never
+// for etcd, whose instances have no node to drain.
+func lifecycleHooksEnabled(component string) bool {
+	if !runsKubernetesNode(component) {
+		return false
+	}
+	return componentSetting(component, "LIFECYCLE_HOOKS") == "true"
+}
+
+// Wave mode adds WAVE_SIZE new instances, verifies them, then drains and
+// terminates as many old instances, so the peak capacity of the ASGs is only
+// their desired count plus the wave size.
+func getWaveSettings(component string) (*surgeSettings, error) {
+	settings, err := getSurgeSettings(component)
+	if err != nil {
+		return settings, err
+	}
+
+	settings.maxSurge = componentSetting(component, "WAVE_SIZE")
+	if settings.maxSurge == "" {
+		settings.maxSurge = "5"
+	}
+	if _, err = resolveIntOrPercent(settings.maxSurge, 100); err != nil {
+		return settings, fmt.Errorf("unable to parse WAVE_SIZE for %s: %s", component, err)
+	}
+	settings.drain = true
+	return settings, nil
+}
+
+// Returns the number of extra instances to run at a time for a component
+// whose ASGs have desiredCount instances.
+func (s *surgeSettings) surgeCount(desiredCount int) int {
+	surge, err := resolveIntOrPercent(s.maxSurge, desiredCount)
+	if err != nil || surge > desiredCount {
+		surge = desiredCount
+	}
+	if surge < 1 {
+		surge = 1
+	}
+	return surge
+}
+
+const (
+	strategyTerminateAndVerify = "terminate-and-verify"
+	strategyVerifyAndTerminate = "verify-and-terminate"
+	strategyWave               = "wave"
+	strategyInstanceRefresh    = "instance-refresh"
+)
+
+// Returns the replacement strategy of a component. Workers are surged by
+// default while etcd and masters are replaced one at a time.
+func getStrategy(component string) (string, error) {
+	strategy := componentSetting(component, "STRATEGY")
+	switch strategy {
+	case "":
+		if component == "k8s-node" {
+			return strategyVerifyAndTerminate, nil
+		}
+		return strategyTerminateAndVerify, nil
+	case strategyWave:
+		// Surging etcd would add members to the cluster before the old ones are removed
+		if component == "etcd" {
+			return strategy, fmt.Errorf("strategy %q is not supported for %s", strategy, component)
+		}
+		return strategy, nil
+	case strategyTerminateAndVerify, strategyVerifyAndTerminate, strategyInstanceRefresh:
+		return strategy, nil
+	}
+	return strategy, fmt.Errorf("unknown strategy %q for %s", strategy, component)
+}
+
+const (
+	selectionTag            = "tag"
+	selectionLaunchTemplate = "launch-template"
+	selectionAMI            = "ami"
+	selectionAll            = "all"
+	selectionAge            = "age"
+)
+
+// Returns how the instances of a component are selected for replacement. By
+// default instances whose version tag differs from ANSIBLE_VERSION are rolled.
+func getSelectionMode(component string) (string, error) {
+	mode := componentSetting(component, "SELECTION")
+	switch mode {
+	case "":
+		return selectionTag, nil
+	case selectionTag, selectionLaunchTemplate, selectionAMI, selectionAll, selectionAge:
+		return mode, nil
+	}
+	return mode, fmt.Errorf("unknown selection mode %q for %s", mode, component)
+}
+
+// Returns the age past which the instances of a component are rolled by the
+// age selection mode. Defaults to 30 days.
+func getMaxInstanceAge(component string) (time.Duration, error) {
+	days, err := parseIntSetting("MAX_INSTANCE_AGE_DAYS", componentSetting(component, "MAX_INSTANCE_AGE_DAYS"), 30)
+	if err != nil {
+		return 0, err
+	}
+	if days < 1 {
+		return 0, fmt.Errorf("the max instance age for %s must be at least 1 day", component)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+const (
+	launchFailurePolicyFail  = "fail"
+	launchFailurePolicyRetry = "retry"
+)
+
+// Returns what to do when the ASGs of a component fail to launch a
+// replacement instance, along with the number of failed launches tolerated by
+// the retry policy. By default the ASG retries, steered away from the failing
+// subnet or instance type, and the roll fails once more than 3 launches have
+// failed.
+func getLaunchFailurePolicy(component string) (string, int, error) {
+	policy := componentSetting(component, "LAUNCH_FAILURE_POLICY")
+	if policy == "" {
+		policy = launchFailurePolicyRetry
+	}
+	if policy != launchFailurePolicyFail && policy != launchFailurePolicyRetry {
+		return policy, 0, fmt.Errorf("unknown launch failure policy %q for %s", policy, component)
+	}
+
+	retries, err := parseIntSetting("LAUNCH_FAILURE_RETRIES", componentSetting(component, "LAUNCH_FAILURE_RETRIES"), 3)
+	if err != nil {
+		return policy, retries, err
+	}
+	return policy, retries, nil
+}
+
+// instanceRefreshSettings are the preferences of the instance refreshes
+// started by the instance-refresh strategy.
+type instanceRefreshSettings struct {
+	minHealthyPercentage int64
+	instanceWarmup       int64
+	// Percentages of the refresh at which it pauses for checkpointDelay seconds
+	checkpoints     []int64
+	checkpointDelay int64
+	// How long we wait for the refresh of a single ASG
+	timeout time.Duration
+}
+
+func getInstanceRefreshSettings(component string) (*instanceRefreshSettings, error) {
+	settings := &instanceRefreshSettings{}
+
+	minHealthy, err := parseIntSetting("INSTANCE_REFRESH_MIN_HEALTHY_PERCENTAGE", componentSetting(component, "INSTANCE_REFRESH_MIN_HEALTHY_PERCENTAGE"), 90)
+	if err != nil {
+		return settings, err
+	}
+	if minHealthy < 0 || minHealthy > 100 {
+		return settings, fmt.Errorf("the minimum healthy percentage for %s must be between 0 and 100", component)
+	}
+	settings.minHealthyPercentage = int64(minHealthy)
+
+	warmup, err := parseIntSetting("INSTANCE_REFRESH_WARMUP_SECONDS", componentSetting(component, "INSTANCE_REFRESH_WARMUP_SECONDS"), 0)
+	if err != nil {
+		return settings, err
+	}
+	settings.instanceWarmup = int64(warmup)
+
+	checkpoints := componentSetting(component, "INSTANCE_REFRESH_CHECKPOINTS")
+	if checkpoints != "" {
+		previous := int64(0)
+		for _, value := range strings.Split(checkpoints, ",") {
+			checkpoint, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil || checkpoint <= previous || checkpoint > 100 {
+				return settings, fmt.Errorf("the instance refresh checkpoints for %s must be increasing percentages: %s", component, checkpoints)
+			}
+			settings.checkpoints = append(settings.checkpoints, checkpoint)
+			previous = checkpoint
+		}
+	}
+
+	delay, err := parseIntSetting("INSTANCE_REFRESH_CHECKPOINT_DELAY_SECONDS", componentSetting(component, "INSTANCE_REFRESH_CHECKPOINT_DELAY_SECONDS"), 600)
+	if err != nil {
+		return settings, err
+	}
+	settings.checkpointDelay = int64(delay)
+
+	timeout, err := parseIntSetting("INSTANCE_REFRESH_TIMEOUT_SECONDS", componentSetting(component, "INSTANCE_REFRESH_TIMEOUT_SECONDS"), 10800)
+	if err != nil {
+		return settings, err
+	}
+	settings.timeout = time.Duration(timeout) * time.Second
+	return settings, nil
+}
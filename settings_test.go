@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestComponentSetting(t *testing.T) {
+	os.Setenv("ROLLER_MAX_SURGE", "50%")
+	os.Setenv("ROLLER_K8S_NODE_MAX_SURGE", "25%")
+	defer os.Unsetenv("ROLLER_MAX_SURGE")
+	defer os.Unsetenv("ROLLER_K8S_NODE_MAX_SURGE")
+
+	if value := componentSetting("k8s-node", "MAX_SURGE"); value != "25%" {
+		t.Errorf("expected 25%%, got %s", value)
+	}
+	if value := componentSetting("etcd", "MAX_SURGE"); value != "50%" {
+		t.Errorf("expected 50%%, got %s", value)
+	}
+}
+
+func TestGetSurgeSettingsDefaults(t *testing.T) {
+	settings, err := getSurgeSettings("k8s-node")
+	if err != nil {
+		t.Errorf("got error when getting surge settings: %s", err)
+	}
+	if settings.batchSize != 5 || settings.finalBatchThreshold != 10 || settings.maxSurge != "100%" {
+		t.Errorf("got unexpected default surge settings: %+v", settings)
+	}
+	if count := settings.surgeCount(8); count != 8 {
+		t.Errorf("expected a surge of 8, got %d", count)
+	}
+	if settings.drain || settings.decrement {
+		t.Errorf("expected drain and decrement to be off by default: %+v", settings)
+	}
+}
+
+func TestGetSurgeSettingsDecrement(t *testing.T) {
+	os.Setenv("ROLLER_K8S_NODE_DECREMENT_DESIRED_CAPACITY", "true")
+	defer os.Unsetenv("ROLLER_K8S_NODE_DECREMENT_DESIRED_CAPACITY")
+
+	settings, err := getSurgeSettings("k8s-node")
+	if err != nil {
+		t.Errorf("got error when getting surge settings: %s", err)
+	}
+	if !settings.decrement {
+		t.Error("expected decrement to be enabled for k8s-node")
+	}
+}
+
+func TestSurgeCount(t *testing.T) {
+	cases := []struct {
+		maxSurge     string
+		desiredCount int
+		expected     int
+	}{
+		{"25%", 40, 10},
+		{"25%", 2, 1},
+		{"3", 40, 3},
+		{"300", 40, 40},
+	}
+	for _, c := range cases {
+		settings := &surgeSettings{maxSurge: c.maxSurge}
+		if count := settings.surgeCount(c.desiredCount); count != c.expected {
+			t.Errorf("expected a surge of %d for %s of %d, got %d", c.expected, c.maxSurge, c.desiredCount, count)
+		}
+	}
+}
+
+func TestGetSurgeSettingsInvalid(t *testing.T) {
+	os.Setenv("ROLLER_ETCD_SURGE_BATCH_SIZE", "0")
+	defer os.Unsetenv("ROLLER_ETCD_SURGE_BATCH_SIZE")
+
+	if _, err := getSurgeSettings("etcd"); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestGetWaveSettings(t *testing.T) {
+	os.Setenv("ROLLER_K8S_NODE_WAVE_SIZE", "10%")
+	defer os.Unsetenv("ROLLER_K8S_NODE_WAVE_SIZE")
+
+	settings, err := getWaveSettings("k8s-node")
+	if err != nil {
+		t.Errorf("got error when getting wave settings: %s", err)
+	}
+	if !settings.drain {
+		t.Error("expected wave mode to drain the old nodes")
+	}
+	if count := settings.surgeCount(300); count != 30 {
+		t.Errorf("expected waves of 30 instances, got %d", count)
+	}
+}
+
+func TestGetMaxUnavailable(t *testing.T) {
+	os.Setenv("ROLLER_MAX_UNAVAILABLE", "3")
+	os.Setenv("ROLLER_K8S_NODE_MAX_UNAVAILABLE", "25%")
+	defer os.Unsetenv("ROLLER_MAX_UNAVAILABLE")
+	defer os.Unsetenv("ROLLER_K8S_NODE_MAX_UNAVAILABLE")
+
+	cases := map[string]string{
+		"k8s-node":   "25%",
+		"k8s-master": "3",
+		"etcd":       "1",
+	}
+	for component, expected := range cases {
+		value, err := getMaxUnavailable(component)
+		if err != nil {
+			t.Errorf("got error when getting the max unavailable of %s: %s", component, err)
+		}
+		if value != expected {
+			t.Errorf("expected %s for %s, got %s", expected, component, value)
+		}
+	}
+
+	os.Setenv("ROLLER_K8S_NODE_MAX_UNAVAILABLE", "lots")
+	if _, err := getMaxUnavailable("k8s-node"); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
+
+func TestLifecycleHooksEnabled(t *testing.T) {
+	os.Setenv("ROLLER_LIFECYCLE_HOOKS", "true")
+	defer os.Unsetenv("ROLLER_LIFECYCLE_HOOKS")
+
+	// etcd instances have no node to drain
+	cases := map[string]bool{
+		"k8s-node":   true,
+		"k8s-master": true,
+		"etcd":       false,
+	}
+	for component, expected := range cases {
+		if enabled := lifecycleHooksEnabled(component); enabled != expected {
+			t.Errorf("expected lifecycle hooks enabled %t for %s, got %t", expected, component, enabled)
+		}
+	}
+}
+
+func TestGetStrategy(t *testing.T) {
+	os.Setenv("ROLLER_K8S_NODE_STRATEGY", "wave")
+	os.Setenv("ROLLER_ETCD_STRATEGY", "verify-and-terminate")
+	defer os.Unsetenv("ROLLER_K8S_NODE_STRATEGY")
+	defer os.Unsetenv("ROLLER_ETCD_STRATEGY")
+
+	cases := map[string]string{
+		"k8s-node":   strategyWave,
+		"k8s-master": strategyTerminateAndVerify,
+		"etcd":       strategyVerifyAndTerminate,
+	}
+	for component, expected := range cases {
+		strategy, err := getStrategy(component)
+		if err != nil {
+			t.Errorf("got error when getting the strategy of %s: %s", component, err)
+		}
+		if strategy != expected {
+			t.Errorf("expected strategy %s for %s, got %s", expected, component, strategy)
+		}
+	}
+
+	os.Setenv("ROLLER_ETCD_STRATEGY", "yolo")
+	if _, err := getStrategy("etcd"); err == nil {
+		t.Error("expected error but got nil")
+	}
+
+	os.Setenv("ROLLER_ETCD_STRATEGY", "wave")
+	if _, err := getStrategy("etcd"); err == nil {
+		t.Error("expected wave to be rejected for etcd")
+	}
+}
+
+func TestGetInstanceRefreshSettings(t *testing.T) {
+	os.Setenv("ROLLER_K8S_NODE_INSTANCE_REFRESH_CHECKPOINTS", "25, 50,100")
+	defer os.Unsetenv("ROLLER_K8S_NODE_INSTANCE_REFRESH_CHECKPOINTS")
+
+	settings, err := getInstanceRefreshSettings("k8s-node")
+	if err != nil {
+		t.Errorf("got error when getting instance refresh settings: %s", err)
+	}
+	if settings.minHealthyPercentage != 90 {
+		t.Errorf("expected a min healthy percentage of 90, got %d", settings.minHealthyPercentage)
+	}
+	if len(settings.checkpoints) != 3 || settings.checkpoints[0] != 25 || settings.checkpoints[2] != 100 {
+		t.Errorf("expected checkpoints 25, 50 and 100, got %v", settings.checkpoints)
+	}
+
+	os.Setenv("ROLLER_K8S_NODE_INSTANCE_REFRESH_CHECKPOINTS", "50,25")
+	if _, err := getInstanceRefreshSettings("k8s-node"); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
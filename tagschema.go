@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// tagSchema names the EC2 tags the roller relies on to find the instances of a cluster and its components,
+// and to check their version and health. Keys and values can contain the {cluster}, {component} and
+// {role} placeholders, {role} being the component without its k8s- prefix. An empty value matches any
+// value of the key.
+type tagSchema struct {
+	clusterKey     string
+	clusterValue   string
+	componentKey   string
+	componentValue string
+	versionKey     string
+	healthKey      string
+	healthyValue   string
+	asgKey         string
+	// How the cluster name is derived from the account, region and CLUSTER
+	clusterNameFormat string
+}
+
+const (
+	tagSchemaLegacy     = "legacy"
+	tagSchemaKubernetes = "kubernetes"
+)
+
+// The tag schema of the cluster being rolled
+var tags = legacyTagSchema()
+
+// The tags our clusters have always been provisioned with
+func legacyTagSchema() *tagSchema {
+	return &tagSchema{
+		clusterKey:        "KubernetesCluster",
+		clusterValue:      "{cluster}",
+		componentKey:      "ServiceComponent",
+		componentValue:    "{component}",
+		versionKey:        "version",
+		healthKey:         "healthy",
+		healthyValue:      "True",
+		asgKey:            "aws:autoscaling:groupName",
+		clusterNameFormat: "{account}-{region}-{cluster}",
+	}
+}
+
+// The tags used by the upstream kubernetes AWS integrations
+func kubernetesTagSchema() *tagSchema {
+	schema := legacyTagSchema()
+	schema.clusterKey = "kubernetes.io/cluster/{cluster}"
+	schema.clusterValue = "owned"
+	schema.componentKey = "k8s.io/role/{role}"
+	schema.componentValue = ""
+	schema.clusterNameFormat = "{cluster}"
+	return schema
+}
+
+// Returns the tag schema preset set with ROLLER_TAG_SCHEMA, with any of its
+// tags overridden by ROLLER_TAG_<TAG>
+func getTagSchema() (*tagSchema, error) {
+	var schema *tagSchema
+	switch preset := os.Getenv("ROLLER_TAG_SCHEMA"); preset {
+	case "", tagSchemaLegacy:
+		schema = legacyTagSchema()
+	case tagSchemaKubernetes:
+		schema = kubernetesTagSchema()
+	default:
+		return nil, fmt.Errorf("unknown tag schema %q", preset)
+	}
+
+	overrides := map[string]*string{
+		"ROLLER_TAG_CLUSTER_KEY":     &schema.clusterKey,
+		"ROLLER_TAG_CLUSTER_VALUE":   &schema.clusterValue,
+		"ROLLER_TAG_COMPONENT_KEY":   &schema.componentKey,
+		"ROLLER_TAG_COMPONENT_VALUE": &schema.componentValue,
+		"ROLLER_TAG_VERSION_KEY":     &schema.versionKey,
+		"ROLLER_TAG_HEALTH_KEY":      &schema.healthKey,
+		"ROLLER_TAG_HEALTHY_VALUE":   &schema.healthyValue,
+		"ROLLER_CLUSTER_NAME_FORMAT": &schema.clusterNameFormat,
+	}
+	for name, field := range overrides {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+
+	if schema.clusterKey == "" || schema.componentKey == "" || schema.versionKey == "" || schema.healthKey == "" {
+		return nil, fmt.Errorf("the cluster, component, version and health tag keys can't be empty")
+	}
+	return schema, nil
+}
+
+func (s *tagSchema) expand(template string, component string) string {
+	return strings.NewReplacer(
+		"{cluster}", kubernetesCluster,
+		"{component}", component,
+		"{role}", strings.TrimPrefix(component, "k8s-"),
+	).Replace(template)
+}
+
+// Returns the name of the cluster the roller manages
+func (s *tagSchema) clusterName(account, region, cluster string) string {
+	return strings.NewReplacer(
+		"{account}", account,
+		"{region}", region,
+		"{cluster}", cluster,
+	).Replace(s.clusterNameFormat)
+}
+
+func (s *tagSchema) filter(key, value string) *ec2.Filter {
+	if value == "" {
+		return &ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String(key)},
+		}
+	}
+	return &ec2.Filter{
+		Name:   aws.String("tag:" + key),
+		Values: []*string{aws.String(value)},
+	}
+}
+
+// Filters the instances of the cluster
+func (s *tagSchema) clusterFilter() *ec2.Filter {
+	return s.filter(s.expand(s.clusterKey, ""), s.expand(s.clusterValue, ""))
+}
+
+// Filters the instances of a component of the cluster. The component tags,
+// such as k8s.io/role/node, are usually the same in every cluster, so the
+// instances are filtered by cluster too.
+func (s *tagSchema) componentFilters(component string) []*ec2.Filter {
+	return []*ec2.Filter{
+		s.clusterFilter(),
+		s.filter(s.expand(s.componentKey, component), s.expand(s.componentValue, component)),
+	}
+}
+
+// Filters the instances of an ASG
+func (s *tagSchema) asgFilter(asg string) *ec2.Filter {
+	return s.filter(s.asgKey, asg)
+}
+
+func (s *tagSchema) isComponent(instance *ec2.Instance, component string) bool {
+	key := s.expand(s.componentKey, component)
+	value := s.expand(s.componentValue, component)
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return value == "" || aws.StringValue(tag.Value) == value
+		}
+	}
+	return false
+}
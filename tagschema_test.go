@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestLegacyTagSchema(t *testing.T) {
+	schema, err := getTagSchema()
+	if err != nil {
+		t.Errorf("got error when getting the tag schema: %s", err)
+	}
+
+	kubernetesCluster = schema.clusterName("123456789012", "us-east-1", "infra")
+	defer func() { kubernetesCluster = "" }()
+	if kubernetesCluster != "123456789012-us-east-1-infra" {
+		t.Errorf("got unexpected cluster name %s", kubernetesCluster)
+	}
+
+	filter := schema.clusterFilter()
+	if *filter.Name != "tag:KubernetesCluster" || *filter.Values[0] != "123456789012-us-east-1-infra" {
+		t.Errorf("got unexpected cluster filter %s", filter)
+	}
+	filters := schema.componentFilters("k8s-node")
+	if len(filters) != 2 || *filters[0].Name != "tag:KubernetesCluster" || *filters[1].Name != "tag:ServiceComponent" || *filters[1].Values[0] != "k8s-node" {
+		t.Errorf("got unexpected component filters %s", filters)
+	}
+}
+
+func TestKubernetesTagSchema(t *testing.T) {
+	os.Setenv("ROLLER_TAG_SCHEMA", "kubernetes")
+	os.Setenv("ROLLER_TAG_HEALTHY_VALUE", "yes")
+	defer os.Unsetenv("ROLLER_TAG_SCHEMA")
+	defer os.Unsetenv("ROLLER_TAG_HEALTHY_VALUE")
+
+	schema, err := getTagSchema()
+	if err != nil {
+		t.Errorf("got error when getting the tag schema: %s", err)
+	}
+	if schema.healthyValue != "yes" {
+		t.Errorf("expected the healthy value to be overridden, got %s", schema.healthyValue)
+	}
+
+	kubernetesCluster = schema.clusterName("123456789012", "us-east-1", "infra")
+	defer func() { kubernetesCluster = "" }()
+
+	filter := schema.clusterFilter()
+	if *filter.Name != "tag:kubernetes.io/cluster/infra" || *filter.Values[0] != "owned" {
+		t.Errorf("got unexpected cluster filter %s", filter)
+	}
+	// The role tags are the same in every cluster, so the component is scoped to the cluster
+	filters := schema.componentFilters("k8s-node")
+	if len(filters) != 2 || *filters[0].Name != "tag:kubernetes.io/cluster/infra" || *filters[0].Values[0] != "owned" ||
+		*filters[1].Name != "tag-key" || *filters[1].Values[0] != "k8s.io/role/node" {
+		t.Errorf("got unexpected component filters %s", filters)
+	}
+
+	instance := &ec2.Instance{
+		Tags: []*ec2.Tag{
+			{Key: aws.String("k8s.io/role/node"), Value: aws.String("1")},
+		},
+	}
+	if !schema.isComponent(instance, "k8s-node") || schema.isComponent(instance, "k8s-master") {
+		t.Error("expected the instance to only be part of k8s-node")
+	}
+}
+
+func TestGetTagSchemaInvalid(t *testing.T) {
+	os.Setenv("ROLLER_TAG_SCHEMA", "random")
+	defer os.Unsetenv("ROLLER_TAG_SCHEMA")
+
+	if _, err := getTagSchema(); err == nil {
+		t.Error("expected error but got nil")
+	}
+}
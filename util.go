@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Helper function to create an int32 pointer
@@ -21,3 +25,78 @@ func keysString(m map[string]string) string {
 	}
 	return strings.Join(keys, ",")
 }
+
+// Helper function to parse an integer setting coming from the environment,
+// falling back to a default when it is not set
+func parseIntSetting(name, value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback, fmt.Errorf("unable to parse %s: %s", name, err)
+	}
+	return i, nil
+}
+
+// Helper function to resolve a setting which is either an absolute number or
+// a percentage of total, such as "3" or "25%". Percentages are rounded down.
+func resolveIntOrPercent(value string, total int) (int, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid percentage %q: %s", value, err)
+		}
+		if percent < 0 {
+			return 0, fmt.Errorf("invalid percentage %q: must not be negative", value)
+		}
+		return total * percent / 100, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q: %s", value, err)
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("invalid value %q: must not be negative", value)
+	}
+	return i, nil
+}
+
+// Cancelled when the roller is interrupted, so that the components stop at their next wait and put their
+// ASGs back before the summary is posted
+var rollContext, abortRoll = context.WithCancel(context.Background())
+
+var errRollAborted = errors.New("the rolling update was aborted")
+
+// Sleeps for the duration, or returns errRollAborted as soon as the roll is aborted
+func sleepUnlessAborted(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-rollContext.Done():
+		return errRollAborted
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Returns the slice without the occurrences of value
+func removeString(slice []string, value string) []string {
+	var result []string
+	for _, s := range slice {
+		if s != value {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// Returns whether the slice contains value
+func containsString(slice []string, value string) bool {
+	for _, s := range slice {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
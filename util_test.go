@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestResolveIntOrPercent(t *testing.T) {
+	cases := []struct {
+		value    string
+		total    int
+		expected int
+	}{
+		{"3", 40, 3},
+		{"25%", 40, 10},
+		{"25%", 6, 1},
+		{"0%", 6, 0},
+	}
+	for _, c := range cases {
+		got, err := resolveIntOrPercent(c.value, c.total)
+		if err != nil {
+			t.Errorf("got error when resolving %s of %d: %s", c.value, c.total, err)
+		}
+		if got != c.expected {
+			t.Errorf("expected %d when resolving %s of %d, got %d", c.expected, c.value, c.total, got)
+		}
+	}
+}
+
+func TestResolveIntOrPercentInvalid(t *testing.T) {
+	for _, value := range []string{"", "abc", "ten%", "-1", "-5%"} {
+		if _, err := resolveIntOrPercent(value, 10); err == nil {
+			t.Errorf("expected error when resolving %q but got nil", value)
+		}
+	}
+}
+
+func TestRemoveString(t *testing.T) {
+	result := removeString([]string{"i-1", "i-2", "i-1", "i-3"}, "i-1")
+	if len(result) != 2 || result[0] != "i-2" || result[1] != "i-3" {
+		t.Errorf("expected [i-2 i-3], got %v", result)
+	}
+}
+
+// Gives the test a roll of its own to abort
+func withRollContext(t *testing.T) {
+	previousContext, previousAbort := rollContext, abortRoll
+	rollContext, abortRoll = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		abortRoll()
+		rollContext, abortRoll = previousContext, previousAbort
+	})
+}
+
+func TestSleepUnlessAborted(t *testing.T) {
+	withRollContext(t)
+
+	if err := sleepUnlessAborted(time.Millisecond); err != nil {
+		t.Errorf("got error when sleeping: %s", err)
+	}
+
+	abortRoll()
+	start := time.Now()
+	if err := sleepUnlessAborted(time.Hour); err != errRollAborted {
+		t.Errorf("expected %s, got %v", errRollAborted, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected the sleep to stop right away, took %s", time.Since(start))
+	}
+}